@@ -0,0 +1,211 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// An allocator for the shared region. The central keeps the
+// allocations and the free extents between them, so every client
+// gets the same offset for the same allocation. A named allocation
+// is made by the first client to ask for it, and every later request
+// for the name gets the same one, as long as it asks for no more
+// bytes, and no page alignment the allocation lacks; anonymous
+// allocations are new each time. Under the distributed managers, client 0 keeps the
+// allocator.
+//
+// Allocations are aligned to allocAlign bytes, or if asked, to whole
+// pages, so that they share no page with any other allocation.
+
+const allocAlign = 8
+
+// A run of bytes in the shared region.
+type Extent struct {
+	Offset uintptr
+	Size   uintptr
+}
+
+type Allocation struct {
+	Name string // "" if anonymous
+	Extent
+}
+
+// the outcome of a client's last allocator request, for its retries.
+type AllocResult struct {
+	Seq    int64
+	Offset uintptr
+	Size   uintptr
+	Err    Err
+}
+
+func alignUp(x uintptr, align uintptr) uintptr {
+	return (x + align - 1) &^ (align - 1)
+}
+
+func (c *Central) Malloc(args *MallocArgs, reply *MallocReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opMalloc, ClientID: args.ClientID, ReqSeq: args.Seq, Name: args.Name, Size: args.Size, PageAligned: args.PageAligned}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := c.allocResults[args.ClientID]
+	reply.Offset = res.Offset
+	reply.Err = res.Err
+	return nil
+}
+
+func (c *Central) Free(args *FreeArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opFree, ClientID: args.ClientID, ReqSeq: args.Seq, Addr: args.Offset}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply.Err = c.allocResults[args.ClientID].Err
+	return nil
+}
+
+// apply an allocator request, unless it is a retry. c.mu must be
+// held.
+func (c *Central) applyAlloc(op Op) {
+	if op.ReqSeq <= c.allocResults[op.ClientID].Seq {
+		return
+	}
+	res := AllocResult{Seq: op.ReqSeq, Err: OK}
+	switch op.Type {
+	case opMalloc:
+		res.Offset, res.Err = c.malloc(op.Name, op.Size, op.PageAligned)
+	case opFree:
+		res.Err = c.free(op.Addr)
+	case opSegmentOpen:
+		res.Offset, res.Size, res.Err = c.segmentOpen(op.ClientID, op.Name, op.Size, op.BlockSize, op.Update)
+	case opSegmentClose:
+		res.Err = c.segmentClose(op.ClientID, op.Addr)
+	case opSegmentDestroy:
+		res.Err = c.segmentDestroy(op.Name)
+	}
+	c.allocResults[op.ClientID] = res
+}
+
+func (c *Central) malloc(name string, size uintptr, pageAligned bool) (uintptr, Err) {
+	if name != "" {
+		if offset, ok := c.named[name]; ok {
+			a := c.allocs[offset]
+			if size > a.Size || (pageAligned && (offset%uintptr(PageSize) != 0 || a.Size%uintptr(PageSize) != 0)) {
+				// the allocation someone else made is too small,
+				// or shares a page
+				return 0, ErrAllocSize
+			}
+			return offset, OK
+		}
+	}
+	align := uintptr(allocAlign)
+	if pageAligned {
+		align = uintptr(PageSize)
+	}
+	e, err := c.carve(size, align)
+	if err != OK {
+		return 0, err
+	}
+	c.allocs[e.Offset] = Allocation{Name: name, Extent: e}
+	if name != "" {
+		c.named[name] = e.Offset
+	}
+	return e.Offset, OK
+}
+
+func (c *Central) free(offset uintptr) Err {
+	a, ok := c.allocs[offset]
+	if !ok {
+		return ErrNotAllocated
+	}
+	delete(c.allocs, offset)
+	if a.Name != "" {
+		delete(c.named, a.Name)
+	}
+	c.uncarve(a.Extent)
+	return OK
+}
+
+// carve an extent of at least size bytes, aligned to align, out of
+// the free extents.
+func (c *Central) carve(size uintptr, align uintptr) (Extent, Err) {
+	size = alignUp(size, align)
+	if size == 0 {
+		size = align
+	}
+	// first fit
+	for i, e := range c.freeExtents {
+		start := alignUp(e.Offset, align)
+		if start+size > e.Offset+e.Size {
+			continue
+		}
+		c.freeExtents = append(c.freeExtents[:i:i], c.freeExtents[i+1:]...)
+		if start > e.Offset {
+			c.freeExtents = append(c.freeExtents, Extent{Offset: e.Offset, Size: start - e.Offset})
+		}
+		if end := e.Offset + e.Size; start+size < end {
+			c.freeExtents = append(c.freeExtents, Extent{Offset: start + size, Size: end - start - size})
+		}
+		sort.Slice(c.freeExtents, func(a, b int) bool { return c.freeExtents[a].Offset < c.freeExtents[b].Offset })
+		return Extent{Offset: start, Size: size}, OK
+	}
+	return Extent{}, ErrNoMemory
+}
+
+// return an extent to the free extents.
+func (c *Central) uncarve(extent Extent) {
+	c.freeExtents = append(c.freeExtents, extent)
+	sort.Slice(c.freeExtents, func(a, b int) bool { return c.freeExtents[a].Offset < c.freeExtents[b].Offset })
+	// merge with the neighbours
+	merged := c.freeExtents[:1]
+	for _, e := range c.freeExtents[1:] {
+		last := &merged[len(merged)-1]
+		if last.Offset+last.Size == e.Offset {
+			last.Size += e.Size
+		} else {
+			merged = append(merged, e)
+		}
+	}
+	c.freeExtents = merged
+}
+
+// Malloc allocates size bytes of the shared region and returns their
+// offset, or false if the region is full. If name is not "", every
+// client that asks for name gets the same allocation, or false if it
+// asks for more than the first. A page-aligned
+// allocation shares no page with any other.
+func (c *Client) Malloc(name string, size int, pageAligned bool) (uintptr, bool) {
+	c.alloc.Lock()
+	defer c.alloc.Unlock()
+	args := &MallocArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Name: name, Size: uintptr(size), PageAligned: pageAligned}
+	reply := &MallocReply{}
+	c.callManagerAt(0, "Central.Malloc", args, reply)
+	if reply.Err != OK {
+		log.Println("could not allocate", size, "bytes:", reply.Err)
+		return 0, false
+	}
+	return reply.Offset, true
+}
+
+// Free frees the allocation at offset.
+func (c *Client) Free(offset uintptr) {
+	c.alloc.Lock()
+	defer c.alloc.Unlock()
+	args := &FreeArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Offset: offset}
+	reply := &Reply{}
+	c.callManagerAt(0, "Central.Free", args, reply)
+	if reply.Err != OK {
+		log.Println("could not free", offset, reply.Err)
+	}
+}
@@ -0,0 +1,255 @@
+package dsm
+
+import (
+	"encoding/binary"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Atomic read-modify-write operations on 32- and 64-bit words of the
+// shared region, done by the page's manager so that they are atomic
+// with respect to the protocol, not just to the local copy.
+//
+// Under sequential consistency, if one client owns the page writable,
+// the manager has that client do the operation on its copy, with the
+// page's lock held so no fault can move the page meanwhile. Otherwise
+// the manager invalidates every copy of the page, takes the owner's
+// data if there is an owner, and does the operation on its own copy,
+// which becomes the home of the page. Under release consistency, it
+// does the operation on the home's copy, and other clients see it
+// after their next acquire.
+//
+// Each operation is applied once, however often its RPC is retried:
+// the central records the last one it did for each client. Lazy
+// release consistency has no home copy to operate on, and the dynamic
+// manager no manager, so neither supports them.
+
+type AtomicOp int
+
+const (
+	AtomicFetchAdd AtomicOp = iota
+	AtomicCompareAndSwap
+	AtomicSwap
+)
+
+// do op on the size-byte word at the start of word, returning its old
+// value.
+func doAtomic(word []byte, size int, op AtomicOp, operand uint64, expected uint64) uint64 {
+	var old uint64
+	if size == 4 {
+		old = uint64(binary.LittleEndian.Uint32(word))
+	} else {
+		old = binary.LittleEndian.Uint64(word)
+	}
+	next := old
+	switch op {
+	case AtomicFetchAdd:
+		next = old + operand
+	case AtomicCompareAndSwap:
+		if old == expected {
+			next = operand
+		}
+	case AtomicSwap:
+		next = operand
+	}
+	if size == 4 {
+		binary.LittleEndian.PutUint32(word, uint32(next))
+	} else {
+		binary.LittleEndian.PutUint64(word, next)
+	}
+	return old
+}
+
+func (c *Central) Atomic(args *AtomicArgs, reply *AtomicReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if c.isDead(args.ClientID) {
+		reply.Err = ErrClientDead
+		return nil
+	}
+	pg := pageOf(args.Addr)
+	l, ok := c.locks[pg]
+	if !ok {
+		reply.Err = ErrNotAllocated
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	c.mu.Lock()
+	done := c.atomicSeq[args.ClientID] >= args.Seq
+	bound := c.isBound(pg)
+	c.mu.Unlock()
+	if done {
+		reply.Err, reply.Old = c.atomicResult(args)
+		return nil
+	}
+	if bound {
+		reply.Err = ErrBound
+		return nil
+	}
+	op := Op{Type: opAtomic, ClientID: args.ClientID, ReqSeq: args.Seq, Addr: args.Addr, Size: uintptr(args.Size), AtomicOp: args.Op, Operand: args.Operand, Expected: args.Expected}
+	if !args.Home && !c.atomicAtOwner(args, &op) {
+		page, err := c.invalidateCaches(pg, -1)
+		if err != OK {
+			reply.Err = err
+			return nil
+		}
+		if _, found := c.getOwner(pg); !found {
+			page = c.homePage(pg)
+		}
+		if page == nil {
+			page = make([]byte, PageSize)
+		}
+		op.Pages = map[uintptr][]byte{pg: page}
+	}
+	if err := c.commit(op); err != OK {
+		reply.Err = err
+		return nil
+	}
+	reply.Err, reply.Old = c.atomicResult(args)
+	return nil
+}
+
+// the old value that the client's operation args.Seq found.
+func (c *Central) atomicResult(args *AtomicArgs) (Err, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.atomicSeq[args.ClientID] != args.Seq {
+		// a later operation has overwritten the result, so the
+		// client has given up on this one
+		return ErrStale, 0
+	}
+	return OK, c.atomicOld[args.ClientID]
+}
+
+// have the page's owner do the operation, if it owns the page writable
+// and so has the only copy, recording its result in op. Reports
+// whether it did.
+func (c *Central) atomicAtOwner(args *AtomicArgs, op *Op) bool {
+	owner, found := c.getOwner(pageOf(args.Addr))
+	if !found || owner.AccessType != 2 || c.isDeadAddr(owner.OwnerAddr) {
+		return false
+	}
+	ownerReply := &AtomicReply{}
+	if !c.callClient(owner.OwnerAddr, "Client.Atomic", args, ownerReply, time.Time{}) || ownerReply.Err != OK {
+		// the owner died, or its copy isn't writable after all
+		return false
+	}
+	op.Done = true
+	op.Old = ownerReply.Old
+	return true
+}
+
+// apply an atomic operation, unless it is a retry of one already
+// applied. If op.Pages has the page, every copy of it has been
+// invalidated, and the central's copy becomes its home. c.mu must be
+// held.
+func (c *Central) applyAtomic(op Op) {
+	if op.ReqSeq <= c.atomicSeq[op.ClientID] {
+		return
+	}
+	c.atomicSeq[op.ClientID] = op.ReqSeq
+	if op.Done {
+		c.atomicOld[op.ClientID] = op.Old
+		return
+	}
+	pg := pageOf(op.Addr)
+	if page, ok := op.Pages[pg]; ok {
+		delete(c.owner, pg)
+		delete(c.copyset, pg)
+		c.pages[pg] = page
+	}
+	page, ok := c.pages[pg]
+	if !ok {
+		page = make([]byte, PageSize)
+		c.pages[pg] = page
+	}
+	c.atomicOld[op.ClientID] = doAtomic(page[op.Addr-pg:], int(op.Size), op.AtomicOp, op.Operand, op.Expected)
+	c.versions[pg]++
+}
+
+// Atomic does an operation on this client's copy of a page that it
+// owns writable, for the page's manager. A retry of the last
+// operation for the same client gets the same result.
+func (c *Client) Atomic(args *AtomicArgs, reply *AtomicReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.atomicDone[args.ClientID]; ok && last.Seq == args.Seq {
+		reply.Err = OK
+		reply.Old = last.Old
+		return nil
+	}
+	old, ok := c.mem.Atomic(args.Addr, args.Size, args.Op, args.Operand, args.Expected)
+	if !ok {
+		reply.Err = ErrStale
+		return nil
+	}
+	c.atomicDone[args.ClientID] = atomicResult{Seq: args.Seq, Old: old}
+	reply.Err = OK
+	reply.Old = old
+	return nil
+}
+
+type atomicResult struct {
+	Seq int64
+	Old uint64
+}
+
+// do op on the size-byte word at addr at its manager, returning the
+// word's old value.
+func (c *Client) atomic(addr uintptr, size int, op AtomicOp, operand uint64, expected uint64) uint64 {
+	if c.protocol == LazyReleaseConsistency || c.manager == DynamicManager {
+		log.Fatalf("dsm: atomic operations need sequential or release consistency, and a central or fixed manager")
+	}
+	if (size != 4 && size != 8) || addr%uintptr(size) != 0 {
+		log.Fatalf("dsm: atomic operation on %v bytes at %v, which is not an aligned 32- or 64-bit word", size, addr)
+	}
+	c.atomics.Lock()
+	defer c.atomics.Unlock()
+	args := &AtomicArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Addr: addr, Size: size, Op: op, Operand: operand, Expected: expected, Home: c.protocol == ReleaseConsistency}
+	reply := &AtomicReply{}
+	c.callManager(addr, "Central.Atomic", args, reply)
+	for reply.Err == ErrOwnerDead && !c.killed() {
+		// wait for the central to recover the page
+		time.Sleep(pollInterval)
+		c.callManager(addr, "Central.Atomic", args, reply)
+	}
+	switch reply.Err {
+	case ErrBound:
+		log.Fatalf("dsm: atomic operation on page %v, which is bound to a lock", pageOf(addr))
+	case ErrNotAllocated:
+		log.Fatalf("dsm: atomic operation at %v, outside the shared region", addr)
+	}
+	c.faultOK(reply.Err)
+	if c.protocol == ReleaseConsistency {
+		// our copy is stale now, unless we have writes to keep
+		pg := pageOf(addr)
+		c.rc.Lock()
+		if _, dirty := c.twins[pg]; !dirty {
+			c.rcInvalidate(pg)
+		}
+		c.rc.Unlock()
+	}
+	return reply.Old
+}
+
+// FetchAdd adds delta to the size-byte word at addr, atomically across
+// the DSM, and returns the word's old value.
+func (c *Client) FetchAdd(addr uintptr, size int, delta uint64) uint64 {
+	return c.atomic(addr, size, AtomicFetchAdd, delta, 0)
+}
+
+// CompareAndSwap stores new in the size-byte word at addr if it holds
+// old, atomically across the DSM, and returns the word's old value.
+func (c *Client) CompareAndSwap(addr uintptr, size int, old uint64, new uint64) uint64 {
+	return c.atomic(addr, size, AtomicCompareAndSwap, new, old)
+}
+
+// Swap stores v in the size-byte word at addr, atomically across the
+// DSM, and returns the word's old value.
+func (c *Client) Swap(addr uintptr, size int, v uint64) uint64 {
+	return c.atomic(addr, size, AtomicSwap, v, 0)
+}
@@ -0,0 +1,117 @@
+package dsm
+
+import (
+	"log"
+	"time"
+)
+
+// A barrier that holds clients until every client has reached it.
+// The central counts the arrivals at each barrier, and lets them all
+// go by starting the barrier's next generation. Under the fixed
+// distributed managers, barrier id is kept by client id modulo the
+// number of clients.
+
+// A barrier, as the central keeps it.
+type BarrierState struct {
+	Gen       int
+	Arrived   map[int]bool
+	VC        VectorClock // of every arrival so far
+	Validated VectorClock // the least of this generation's arrivals'
+	Collected VectorClock // when the last generation left
+}
+
+func (c *Central) Barrier(args *BarrierArgs, reply *BarrierReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opBarrier, ClientID: args.ClientID, ID: args.BarrierID, Gen: args.Gen, VC: args.VC, Intervals: args.Intervals, Validated: args.Validated}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	for !c.killed() {
+		c.mu.Lock()
+		b := c.barriers[args.BarrierID]
+		passed := b.Gen > args.Gen
+		if passed {
+			reply.VC = b.VC.copy()
+			reply.Intervals = c.intervalsSince(b.VC, args.VC)
+			reply.Collected = b.Collected.copy()
+		}
+		c.mu.Unlock()
+		if passed {
+			reply.Err = OK
+			return nil
+		}
+		if !c.isLeader() {
+			reply.Err = ErrWrongLeader
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+	reply.Err = ErrWrongLeader
+	return nil
+}
+
+// count a client's arrival at a barrier, unless it is a retry from a
+// generation that has already gone. c.mu must be held.
+func (c *Central) applyBarrier(op Op) {
+	b, ok := c.barriers[op.ID]
+	if !ok {
+		b = &BarrierState{}
+		c.barriers[op.ID] = b
+	}
+	if op.Gen < b.Gen {
+		return
+	}
+	c.addIntervals(op.Intervals)
+	if b.VC == nil {
+		b.VC = make(VectorClock)
+	}
+	b.VC.merge(op.VC)
+	if len(b.Arrived) == 0 {
+		b.Validated = op.Validated.copy()
+	} else {
+		b.Validated.meet(op.Validated)
+	}
+	if b.Arrived == nil {
+		b.Arrived = make(map[int]bool)
+	}
+	b.Arrived[op.ClientID] = true
+	if len(b.Arrived) >= c.liveClients() {
+		c.passBarrier(b)
+	}
+}
+
+// let a barrier's arrivals go. Every client has now said which
+// intervals it has brought its pages up to date with, so the ones
+// they all have can be collected. c.mu must be held.
+func (c *Central) passBarrier(b *BarrierState) {
+	b.Gen++
+	b.Arrived = nil
+	c.collectIntervals(b.Validated)
+	b.Collected = b.Validated
+	b.Validated = nil
+}
+
+// Barrier blocks until every client has called Barrier with the same
+// id. This client's writes are released before, and everyone's are
+// acquired after.
+func (c *Client) Barrier(id int) {
+	c.Release()
+	c.mu.Lock()
+	gen := c.barriers[id]
+	c.mu.Unlock()
+	log.Println("waiting at barrier", id, gen)
+	args := &BarrierArgs{ClientID: c.id, BarrierID: id, Gen: gen, Validated: c.lrcValidated()}
+	args.Intervals, args.VC = c.lrcPublish()
+	reply := &BarrierReply{}
+	c.callManagerAt(c.syncManager(id), "Central.Barrier", args, reply)
+	c.lrcPublished(args.Intervals)
+	c.mu.Lock()
+	c.barriers[id] = gen + 1
+	c.mu.Unlock()
+	c.lrcAcquire(reply.Intervals, reply.VC)
+	c.lrcCollect(reply.Collected)
+	c.Acquire()
+}
@@ -0,0 +1,127 @@
+package dsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Blocks, the unit of coherence under the central manager. A fault
+// on any page of a block brings in the whole block with one request
+// to the central, one page request to each owner, and one
+// confirmation, so workloads that touch memory in bulk pay for the
+// protocol once per block instead of once per page. The central still
+// keeps its owner and copyset tables by page, so blocks can change
+// size as segments come and go.
+//
+// Outside segments, blocks are BlockSize bytes, aligned to BlockSize.
+// A segment has blocks of its own size, aligned to its base, and no
+// block crosses its edges. The central chooses a segment's block size
+// when it creates the segment: the one SegmentBlockSizes gives for
+// its name if any, or else the one the creating client asked for, or
+// else BlockSize.
+
+var (
+	// bytes in a block; 0 means one page.
+	BlockSize = 0
+	// block sizes for segments, by name, that override what the
+	// program asks for.
+	SegmentBlockSizes = map[string]int{}
+)
+
+// ParseBlockSize parses a block size in bytes, such as 65536, with an
+// optional suffix K, M or G, as in 64K or 2M, with or without iB. A
+// block is a whole number of pages.
+func ParseBlockSize(s string) (int, error) {
+	t := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "iB"), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(t, "K"):
+		shift = 10
+	case strings.HasSuffix(t, "M"):
+		shift = 20
+	case strings.HasSuffix(t, "G"):
+		shift = 30
+	}
+	if shift != 0 {
+		t = t[:len(t)-1]
+	}
+	n, err := strconv.Atoi(t)
+	if err != nil {
+		return 0, fmt.Errorf("bad block size %q", s)
+	}
+	n <<= shift
+	if n <= 0 || n%PageSize != 0 {
+		return 0, fmt.Errorf("block size %q is not a whole number of %v-byte pages", s, PageSize)
+	}
+	return n, nil
+}
+
+// ParseSegmentBlockSizes parses a comma-separated list of name=size.
+func ParseSegmentBlockSizes(s string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		name, size, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not name=size", kv)
+		}
+		n, err := ParseBlockSize(size)
+		if err != nil {
+			return nil, err
+		}
+		sizes[name] = n
+	}
+	return sizes, nil
+}
+
+// the block size for a new segment called name, whose creator asked
+// for asked bytes, or 0.
+func (c *Central) segmentBlockSize(name string, asked uintptr) uintptr {
+	if bs, ok := c.segmentBlocks[name]; ok {
+		return bs
+	}
+	if asked != 0 {
+		return (asked + uintptr(PageSize) - 1) / uintptr(PageSize) * uintptr(PageSize)
+	}
+	return c.blockSize
+}
+
+// the pages of the block that holds the page at addr, in order.
+func (c *Central) blockOf(addr uintptr) []uintptr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perPage {
+		return []uintptr{addr}
+	}
+	bs := c.blockSize
+	origin, lo, hi := uintptr(0), uintptr(0), uintptr(len(c.locks)*PageSize)
+	for _, s := range c.segments {
+		end := s.Offset + s.Size
+		switch {
+		case s.Offset <= addr && addr < end:
+			origin, lo, hi = s.Offset, s.Offset, end
+			if s.BlockSize != 0 {
+				bs = s.BlockSize
+			}
+		case end <= addr && end > lo:
+			lo = end
+		case s.Offset > addr && s.Offset < hi:
+			hi = s.Offset
+		}
+	}
+	base := addr - (addr-origin)%bs
+	end := base + bs
+	if base < lo {
+		// the block is cut short, but still ends where the aligned
+		// one does, so that blocks never overlap
+		base = lo
+	}
+	if end > hi {
+		end = hi
+	}
+	var pages []uintptr
+	for pg := base; pg < end; pg += uintptr(PageSize) {
+		pages = append(pages, pg)
+	}
+	return pages
+}
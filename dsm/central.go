@@ -2,10 +2,11 @@ package dsm
 
 import (
 	"log"
-	"net"
-	"net/rpc"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/6.5840-dsm/raft"
 )
 
 type Owner struct {
@@ -13,20 +14,99 @@ type Owner struct {
 	AccessType int
 }
 
+// A fault being served for one client. The page's lock is held from
+// HandleReadWrite until the matching HandleConfirmation, and a retried
+// request from the same client gets the saved reply instead of
+// deadlocking on the lock it already holds.
+type inflight struct {
+	clientID int
+	access   int
+	seq      int64
+	term     int
+	reply    ReadWriteReply
+	done     chan struct{}
+	pages    []uintptr // of the block, all locked
+}
+
 type Central struct {
 	// The central's name
+	mu          sync.Mutex
+	transport   Transport
 	num_clients int
 	register    map[int]bool
 	clients     map[int]string
 	copyset     map[uintptr]map[int]int
 	owner       map[uintptr]Owner
 	locks       map[uintptr]*sync.Mutex
+	inflight    map[uintptr]*inflight
 	dead        int32 // for testing
+
+	// release consistency; the central is home to every page
+	pages    map[uintptr][]byte
+	versions map[uintptr]int
+	diffSeq  map[int]int64 // the last diff merged from each client
+
+	lockTable map[int]*LockState
+	barriers  map[int]*BarrierState
+	conds     map[int]*CondState
+	sems      map[int]*SemState
+	rwlocks   map[int]*RWLockState
+	rwPolicy  RWPolicy // for new reader-writer locks
+
+	// the last atomic operation applied for each client, and the
+	// old value it found
+	atomicSeq map[int]int64
+	atomicOld map[int]uint64
+
+	// the allocator
+	allocs       map[uintptr]Allocation // by offset
+	named        map[string]uintptr
+	freeExtents  []Extent // sorted by offset
+	allocResults map[int]AllocResult
+	segments     map[uintptr]*Segment // by base
+
+	// failure detection
+	deadClients    map[int]bool      // dead, or left
+	lastHeard      map[int]time.Time // on the leader
+	checkpointPath string            // the last checkpoint taken or restored
+
+	// entry consistency: the lock each bound page is bound to
+	bound map[uintptr]int
+	binds map[int]*AppliedSeqs // by client
+
+	// lazy release consistency: every client's published intervals,
+	// but for the first collected[id] of client id's
+	intervals map[int][]Interval
+	collected VectorClock
+
+	// blocks
+	blockSize     uintptr
+	segmentBlocks map[string]uintptr
+	perPage       bool // blocks are always one page, for the fixed manager
+
+	// leases on read-only copies, on the leader
+	leases      map[uintptr]map[int]time.Time
+	leaderSince time.Time
+
+	// replication; rf is nil for a single unreplicated central, and
+	// for a replica until MakeReplicatedCentral has made it
+	replicated   bool
+	rf           *raft.Raft
+	me           int
+	persister    *raft.Persister
+	maxraftstate int // snapshot if log grows this big
+	applyCh      chan raft.ApplyMsg
+	lastApplied  int
+	seq          int64
+	waiters      map[int]chan applied
+	readyTerm    int64 // the term in which this replica caught up as leader
 }
 
 func (c *Central) Kill() {
 	atomic.StoreInt32(&c.dead, 1)
-	// Your code here, if desired.
+	if c.rf != nil {
+		c.rf.Kill()
+	}
 }
 
 func (c *Central) killed() bool {
@@ -35,126 +115,387 @@ func (c *Central) killed() bool {
 }
 
 func (c *Central) RegisterClient(args *RegisterArgs, reply *RegisterReply) error {
-	c.register[args.ClientID] = true
-	c.num_clients++
-	if c.num_clients == len(c.clients) {
-		// all clients have registered
-		go c.allClientsRegistered()
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
 	}
-	reply.Err = OK
+	reply.Err = c.commit(Op{Type: opRegister, ClientID: args.ClientID})
 	return nil
 }
 
 func (c *Central) allClientsRegistered() {
-	for id, _ := range c.clients {
-		call(c.clients[id], "Client.AllClientsRegistered", Args{}, Reply{})
+	c.mu.Lock()
+	clients := make(map[int]string)
+	for id, addr := range c.clients {
+		clients[id] = addr
+	}
+	c.mu.Unlock()
+	for id, addr := range clients {
+		ok := c.transport.Call(addr, "Client.AllClientsRegistered", &Args{}, &Reply{})
+		for !ok && !c.killed() && !c.isDead(id) {
+			ok = c.transport.Call(addr, "Client.AllClientsRegistered", &Args{}, &Reply{})
+		}
 	}
 }
 
 func (c *Central) HandleConfirmation(args *ConfirmationArgs, reply *Reply) error {
-	c.locks[args.Addr].Unlock()
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = OK
+	for addr, owner := range args.Owners {
+		if err := c.commit(Op{Type: opConfirm, ClientID: args.ClientID, Addr: addr, Access: args.Access, Owner: Owner{OwnerAddr: owner}}); err != OK {
+			reply.Err = err
+		}
+	}
+
+	c.mu.Lock()
+	f, ok := c.inflight[args.Addr]
+	c.mu.Unlock()
+	if !ok || f.clientID != args.ClientID {
+		// a retried confirmation that was already handled
+		return nil
+	}
+	c.releaseBlock(f)
 	return nil
 }
 
 func (c *Central) HandleReadWrite(args *ReadWriteArgs, reply *ReadWriteReply) error {
 	// Handle no owner starting state
 	// Handle safety checks for no invalidating ourselves
-	c.locks[args.Addr].Lock()
+	term, isLeader := c.getState()
+	if !isLeader {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	c.mu.Lock()
+	if c.deadClients[args.ClientID] {
+		c.mu.Unlock()
+		reply.Err = ErrClientDead
+		return nil
+	}
+	if c.isBound(args.Addr) {
+		c.mu.Unlock()
+		reply.Err = ErrBound
+		return nil
+	}
+	if f, ok := c.inflight[args.Addr]; ok && f.clientID == args.ClientID && f.seq == args.Seq {
+		// the client lost our reply and asked again
+		c.mu.Unlock()
+		<-f.done
+		*reply = f.reply
+		return nil
+	}
+	c.mu.Unlock()
+
+	pages := c.blockOf(args.Addr)
+	for _, pg := range pages {
+		c.locks[pg].Lock()
+	}
+	f := &inflight{clientID: args.ClientID, access: args.Access, seq: args.Seq, term: term, done: make(chan struct{}), pages: pages}
+	c.mu.Lock()
+	for _, pg := range pages {
+		c.inflight[pg] = f
+	}
 	log.Println("owner", c.owner)
 	log.Println("copyset", c.copyset)
-	if args.Access == 1 {
-		log.Println("central handling read on go side", args.Addr, c.clients[args.ClientID])
-		// make owner readonly
-		pageOwner, found := c.owner[args.Addr]
-		if _, ok := c.copyset[args.Addr]; !ok {
-			c.copyset[args.Addr] = make(map[int]int)
+	c.mu.Unlock()
+	reply.Err = c.handleBlock(args, pages, reply)
+	log.Println("done handling")
+	f.reply = *reply
+	close(f.done)
+	if reply.Err != OK {
+		// the client will retry, maybe at another replica
+		c.releaseBlock(f)
+	}
+	return nil
+}
+
+// serve a fault on each page of the faulting page's block that the
+// client needs, all at once.
+func (c *Central) handleBlock(args *ReadWriteArgs, pages []uintptr, reply *ReadWriteReply) Err {
+	var need []uintptr
+	for _, pg := range pages {
+		if pg == args.Addr || c.needs(args.ClientID, pg, args.Access) {
+			need = append(need, pg)
 		}
-		if found {
-			c.makeReadonlyOwner(args.Addr, pageOwner.OwnerAddr)
-			// update copyset
-			c.copyset[args.Addr][args.ClientID] = 1
-			reply.HadOwner = true
-		} else {
-			c.owner[args.Addr] = Owner{OwnerAddr: c.clients[args.ClientID], AccessType: 1}
-			reply.HadOwner = false
+	}
+	grants := make([]PageGrant, len(need))
+	errs := make([]Err, len(need))
+	var wg sync.WaitGroup
+	for i, pg := range need {
+		wg.Add(1)
+		go func(i int, pg uintptr) {
+			defer wg.Done()
+			pgArgs := *args
+			pgArgs.Addr = pg
+			grants[i].Addr = pg
+			if args.Access == 1 {
+				log.Println("central handling read on go side", pg, c.clientAddr(args.ClientID))
+				errs[i] = c.handleRead(&pgArgs, &grants[i])
+			} else if args.Access == 2 {
+				log.Println("central handling write on go side", pg, c.clientAddr(args.ClientID))
+				errs[i] = c.handleWrite(&pgArgs, &grants[i])
+			}
+		}(i, pg)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != OK {
+			return err
 		}
-		reply.Err = OK
-		reply.Owner = c.owner[args.Addr].OwnerAddr
-	} else if args.Access == 2 {
-		log.Println("central handling write on go side", args.Addr, c.clients[args.ClientID])
-		// invalidate all pages and return data
-		delete(c.copyset[args.Addr], args.ClientID)
-		reply.Data = c.invalidateCaches(args.Addr, args.ClientID)
-		// wait for invalidation to finish
-		for len(c.copyset[args.Addr]) > 0 {
+	}
+	reply.Pages = grants
+	return OK
+}
+
+// whether clientID lacks the access it faulted for on the page at
+// addr, as far as the central knows.
+func (c *Central) needs(clientID int, addr uintptr, access int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isBound(addr) {
+		return false
+	}
+	me := c.clients[clientID]
+	owner, found := c.owner[addr]
+	if access == 1 {
+		if _, ok := c.copyset[addr][clientID]; ok {
+			return false
 		}
-		reply.Err = OK
-		// update owner
-		c.owner[args.Addr] = Owner{OwnerAddr: c.clients[args.ClientID], AccessType: 2}
+		return !found || owner.OwnerAddr != me || owner.AccessType == 0
 	}
-	log.Println("done handling")
-	return nil
+	return owner != Owner{OwnerAddr: me, AccessType: 2}
 }
 
-func (c *Central) invalidateCaches(pageID uintptr, thisClient int) []byte {
-	copyset, ok := c.copyset[pageID]
-	if ok {
-		for clientID, _ := range copyset {
-			if clientID == thisClient {
-				continue
-			}
-			log.Println(c.clients[clientID])
-			go c.makeInvalidCopyset(pageID, clientID)
+func (c *Central) handleRead(args *ReadWriteArgs, reply *PageGrant) Err {
+	// make owner readonly
+	pageOwner, found := c.getOwner(args.Addr)
+	if found {
+		if err := c.makeReadonlyOwner(args.Addr, pageOwner.OwnerAddr); err != OK {
+			return err
+		}
+		// update copyset
+		if err := c.commit(Op{Type: opAddCopyset, ClientID: args.ClientID, Addr: args.Addr}); err != OK {
+			return err
+		}
+		reply.HadOwner = true
+		reply.Lease = c.grantLease(args.Addr, args.ClientID)
+	} else {
+		reply.Data = c.homePage(args.Addr)
+		pageOwner = Owner{OwnerAddr: c.clientAddr(args.ClientID), AccessType: 1}
+		if err := c.commit(Op{Type: opSetOwner, Addr: args.Addr, Owner: pageOwner}); err != OK {
+			return err
 		}
+		reply.HadOwner = false
+	}
+	reply.Owner = pageOwner.OwnerAddr
+	return OK
+}
+
+// A write takes the page's data from its owner, but ownership only
+// moves to the writer when it confirms that it has installed the
+// data, so that a write retried after a leader change can fetch the
+// data again from the old owner.
+func (c *Central) handleWrite(args *ReadWriteArgs, reply *PageGrant) Err {
+	if c.isUpdatePage(args.Addr) {
+		return c.handleUpdateWrite(args, reply)
+	}
+	pageOwner, found := c.getOwner(args.Addr)
+	// invalidate all pages and return data
+	if err := c.commit(Op{Type: opRemoveCopyset, ClientID: args.ClientID, Addr: args.Addr}); err != OK {
+		return err
+	}
+	data, err := c.invalidateCaches(args.Addr, args.ClientID)
+	if err != OK {
+		return err
+	}
+	if !found {
+		data = c.homePage(args.Addr)
+	}
+	reply.Data = data
+	reply.Owner = pageOwner.OwnerAddr
+	return OK
+}
+
+// release the page lock held for a fault, unless it has already been
+// released.
+func (c *Central) release(addr uintptr, f *inflight) {
+	c.mu.Lock()
+	if c.inflight[addr] != f {
+		c.mu.Unlock()
+		return
 	}
-	if owner, ok := c.owner[pageID]; ok && owner.OwnerAddr != c.clients[thisClient] {
-		return c.makeInvalidOwner(pageID, owner.OwnerAddr)
+	delete(c.inflight, addr)
+	c.mu.Unlock()
+	c.locks[addr].Unlock()
+}
+
+// release every page lock held for a fault.
+func (c *Central) releaseBlock(f *inflight) {
+	for _, pg := range f.pages {
+		c.release(pg, f)
+	}
+}
+
+func (c *Central) clientAddr(clientID int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clients[clientID]
+}
+
+func (c *Central) getOwner(addr uintptr) (Owner, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner, ok := c.owner[addr]
+	return owner, ok
+}
+
+// the central's copy of a page that no client owns, restored from a
+// checkpoint, or nil.
+func (c *Central) homePage(addr uintptr) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page, ok := c.pages[addr]; ok {
+		return append([]byte(nil), page...)
 	}
 	return nil
 }
 
-func (c *Central) makeReadonlyOwner(addr uintptr, clientAddr string) {
+// invalidate every copy of pageID except thisClient's, returning the
+// owner's data if thisClient is not the owner.
+func (c *Central) invalidateCaches(pageID uintptr, thisClient int) ([]byte, Err) {
+	c.mu.Lock()
+	var invalidate []int
+	for clientID, _ := range c.copyset[pageID] {
+		if clientID == thisClient {
+			continue
+		}
+		log.Println(c.clients[clientID])
+		invalidate = append(invalidate, clientID)
+	}
+	owner, ok := c.owner[pageID]
+	thisAddr := c.clients[thisClient]
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]Err, len(invalidate))
+	for i, clientID := range invalidate {
+		wg.Add(1)
+		go func(i int, clientID int) {
+			defer wg.Done()
+			errs[i] = c.makeInvalidCopyset(pageID, clientID)
+		}(i, clientID)
+	}
+	var data []byte
+	err := Err(OK)
+	if ok && owner.OwnerAddr != thisAddr {
+		data, err = c.makeInvalidOwner(pageID, owner.OwnerAddr)
+	}
+	// wait for invalidation to finish
+	wg.Wait()
+	for _, e := range errs {
+		if e != OK {
+			err = e
+		}
+	}
+	return data, err
+}
+
+// changeAccess sends a ChangeAccess RPC until it gets through, the
+// client is declared dead, or the deadline passes, if there is one.
+func (c *Central) changeAccess(clientAddr string, args *InvalidateArgs, reply *InvalidateReply, deadline time.Time) bool {
+	return c.callClient(clientAddr, "Client.ChangeAccess", args, reply, deadline)
+}
+
+// callClient sends an RPC to a client until it gets through, the
+// client is declared dead, or the deadline passes, if there is one.
+func (c *Central) callClient(clientAddr string, rpcname string, args interface{}, reply interface{}, deadline time.Time) bool {
+	for !c.killed() && !c.isDeadAddr(clientAddr) && (deadline.IsZero() || time.Now().Before(deadline)) {
+		if c.transport.Call(clientAddr, rpcname, args, reply) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Central) makeReadonlyOwner(addr uintptr, clientAddr string) Err {
 	log.Println("make readonly owner", clientAddr)
 	args := InvalidateArgs{Addr: addr, NewAccess: 1, ReturnPage: false}
 	reply := InvalidateReply{}
-	ok := call(clientAddr, "Client.ChangeAccess", &args, &reply)
-	for !ok {
-		// Wait until expires
-		ok = call(clientAddr, "Client.ChangeAccess", &args, &reply)
+	if !c.changeAccess(clientAddr, &args, &reply, time.Time{}) {
+		return ErrOwnerDead
 	}
-	c.owner[addr] = Owner{OwnerAddr: clientAddr, AccessType: 1}
+	c.pushUpdate(addr, reply.Diff, c.clientID(clientAddr))
+	return c.commit(Op{Type: opSetOwner, Addr: addr, Owner: Owner{OwnerAddr: clientAddr, AccessType: 1}})
 }
 
-func (c *Central) makeInvalidOwner(addr uintptr, clientAddr string) []byte {
+func (c *Central) makeInvalidOwner(addr uintptr, clientAddr string) ([]byte, Err) {
 	log.Println("make invalid owner", clientAddr)
 	args := InvalidateArgs{Addr: addr, NewAccess: 0, ReturnPage: true}
 	reply := InvalidateReply{}
-	ok := call(clientAddr, "Client.ChangeAccess", &args, &reply)
-	for !ok {
-		// Wait until expires
-		ok = call(clientAddr, "Client.ChangeAccess", &args, &reply)
+	if !c.changeAccess(clientAddr, &args, &reply, time.Time{}) {
+		return nil, ErrOwnerDead
 	}
-	c.owner[addr] = Owner{OwnerAddr: clientAddr, AccessType: 0}
-	return reply.Data
+	err := c.commit(Op{Type: opSetOwner, Addr: addr, Owner: Owner{OwnerAddr: clientAddr, AccessType: 0}})
+	return reply.Data, err
 }
 
-func (c *Central) makeInvalidCopyset(addr uintptr, clientID int) {
-	log.Println("make invalid copyset", c.clients[clientID])
+func (c *Central) makeInvalidCopyset(addr uintptr, clientID int) Err {
+	clientAddr := c.clientAddr(clientID)
+	log.Println("make invalid copyset", clientAddr)
 	args := InvalidateArgs{Addr: addr, NewAccess: 0, ReturnPage: false}
 	reply := InvalidateReply{}
-	ok := call(c.clients[clientID], "Client.ChangeAccess", &args, &reply)
-	for !ok {
-		// Wait until expires
-		ok = call(c.clients[clientID], "Client.ChangeAccess", &args, &reply)
+	// a dead client's copy is gone already, and a reader we can't
+	// reach drops its copy when its lease runs out
+	if !c.changeAccess(clientAddr, &args, &reply, c.leaseExpiry(addr, clientID)) {
+		log.Println("could not invalidate", clientAddr, "; its lease has run out")
 	}
-	delete(c.copyset[addr], clientID)
+	c.dropLease(addr, clientID)
+	return c.commit(Op{Type: opRemoveCopyset, ClientID: clientID, Addr: addr})
 }
 
-func (c *Central) initialize(clients map[int]string, numpages int) {
+func (c *Central) initialize(clients map[int]string, numpages int, transport Transport) {
+	c.transport = transport
 	c.clients = make(map[int]string)
 	c.register = make(map[int]bool)
 	c.owner = make(map[uintptr]Owner)
 	c.locks = make(map[uintptr]*sync.Mutex)
+	c.inflight = make(map[uintptr]*inflight)
+	c.waiters = make(map[int]chan applied)
+	c.pages = make(map[uintptr][]byte)
+	c.versions = make(map[uintptr]int)
+	c.diffSeq = make(map[int]int64)
+	c.lockTable = make(map[int]*LockState)
+	c.barriers = make(map[int]*BarrierState)
+	c.conds = make(map[int]*CondState)
+	c.sems = make(map[int]*SemState)
+	c.rwlocks = make(map[int]*RWLockState)
+	c.rwPolicy = RWLockPolicy
+	c.atomicSeq = make(map[int]int64)
+	c.atomicOld = make(map[int]uint64)
+	c.allocs = make(map[uintptr]Allocation)
+	c.named = make(map[string]uintptr)
+	c.freeExtents = []Extent{{Offset: 0, Size: uintptr(numpages * PageSize)}}
+	c.allocResults = make(map[int]AllocResult)
+	c.segments = make(map[uintptr]*Segment)
+	c.deadClients = make(map[int]bool)
+	c.lastHeard = make(map[int]time.Time)
+	c.leases = make(map[uintptr]map[int]time.Time)
+	c.leaderSince = time.Now()
+	c.blockSize = uintptr(PageSize)
+	if BlockSize > PageSize {
+		c.blockSize = uintptr(BlockSize)
+	}
+	c.segmentBlocks = make(map[string]uintptr)
+	c.bound = make(map[uintptr]int)
+	c.binds = make(map[int]*AppliedSeqs)
+	c.intervals = make(map[int][]Interval)
+	c.collected = make(VectorClock)
+	for name, bs := range SegmentBlockSizes {
+		c.segmentBlocks[name] = uintptr(bs)
+	}
 	for id, addr := range clients {
 		c.clients[id] = addr
 	}
@@ -162,29 +503,14 @@ func (c *Central) initialize(clients map[int]string, numpages int) {
 		c.locks[uintptr(i*PageSize)] = &sync.Mutex{}
 	}
 	c.copyset = make(map[uintptr]map[int]int)
-	go c.initializeRPC()
 }
 
-func MakeCentral(clients map[int]string, numpages int) *Central {
+// MakeCentral starts a central server for numpages pages, serving
+// RPCs from the given clients over transport.
+func MakeCentral(clients map[int]string, numpages int, transport Transport) *Central {
 	c := Central{}
-	c.initialize(clients, numpages)
+	c.initialize(clients, numpages, transport)
+	c.transport.Serve(&c)
+	go c.failureDetector()
 	return &c
 }
-
-func (c *Central) initializeRPC() {
-	rpc.Register(c)
-	l, err := net.Listen("tcp", port)
-	if err != nil {
-		log.Fatal("listen error:", err)
-	}
-	defer l.Close()
-	log.Println("central server listening on port", port)
-
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal("accept error:", err)
-		}
-		go rpc.ServeConn(conn)
-	}
-}
@@ -0,0 +1,199 @@
+package dsm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/6.5840-dsm/labgob"
+)
+
+// Checkpoints of the whole shared region, for a DSM with a central
+// server. To take one, the central holds every page's lock, so that
+// no fault is in progress and none can start, makes every writable
+// page read-only at its owner, and collects the pages from their
+// owners. The pages, the owner and copyset tables and the allocator
+// go to a file. Writes to bound pages that a lock holder has not yet
+// released are not in it.
+//
+// A central restored from a checkpoint is the home of every page in
+// it: the processes that owned the pages are gone, so the first
+// client to fault on a page gets the checkpointed copy from the
+// central, and pages start out with no owner. Locks, reader-writer
+// locks, barriers, condition variables, semaphores and registrations
+// start over too.
+
+type Checkpoint struct {
+	NumPages    int
+	Owner       map[uintptr]Owner
+	Copyset     map[uintptr]map[int]int
+	Pages       map[uintptr][]byte
+	Versions    map[uintptr]int
+	Allocs      map[uintptr]Allocation
+	Named       map[string]uintptr
+	FreeExtents []Extent
+	Segments    map[uintptr]*Segment
+	Bound       map[uintptr]int
+}
+
+func (c *Central) Checkpoint(args *CheckpointArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.checkpoint(args.Path); err != nil {
+		log.Println("checkpoint failed:", err)
+		reply.Err = ErrCheckpoint
+		return nil
+	}
+	reply.Err = OK
+	return nil
+}
+
+func (c *Central) checkpoint(path string) error {
+	// quiesce: a fault holds its page's lock until it is confirmed
+	for i := 0; i < len(c.locks); i++ {
+		l := c.locks[uintptr(i*PageSize)]
+		l.Lock()
+		defer l.Unlock()
+	}
+	log.Println("checkpointing to", path)
+
+	c.mu.Lock()
+	owners := make(map[uintptr]Owner)
+	for addr, o := range c.owner {
+		owners[addr] = o
+	}
+	c.mu.Unlock()
+	pages := make(map[uintptr][]byte)
+	for addr, o := range owners {
+		if o.AccessType == 2 {
+			// keep the owner from writing while we copy
+			if err := c.makeReadonlyOwner(addr, o.OwnerAddr); err != OK {
+				return fmt.Errorf("%v", err)
+			}
+		}
+		reply := &PageRequestReply{}
+		ok := c.transport.Call(o.OwnerAddr, "Client.HandlePageRequest", &PageRequestArgs{Addr: addr}, reply)
+		for !ok && !c.killed() {
+			if c.isDeadAddr(o.OwnerAddr) {
+				return fmt.Errorf("owner of %v died", addr)
+			}
+			ok = c.transport.Call(o.OwnerAddr, "Client.HandlePageRequest", &PageRequestArgs{Addr: addr}, reply)
+		}
+		pages[addr] = reply.Data
+	}
+
+	c.mu.Lock()
+	// home copies: pages under release consistency, and pages
+	// restored from an earlier checkpoint that no one has faulted
+	// on since
+	for addr, page := range c.pages {
+		if _, ok := pages[addr]; !ok {
+			pages[addr] = append([]byte(nil), page...)
+		}
+	}
+	cp := Checkpoint{
+		NumPages:    len(c.locks),
+		Owner:       c.owner,
+		Copyset:     c.copyset,
+		Pages:       pages,
+		Versions:    c.versions,
+		Allocs:      c.allocs,
+		Named:       c.named,
+		FreeExtents: c.freeExtents,
+		Segments:    c.segments,
+		Bound:       c.bound,
+	}
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	err := e.Encode(cp)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash never leaves half a checkpoint
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, w.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.checkpointPath = path
+	c.mu.Unlock()
+	return nil
+}
+
+// restore the central's pages and allocator from the checkpoint at
+// path.
+func (c *Central) restore(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cp Checkpoint
+	d := labgob.NewDecoder(bytes.NewBuffer(data))
+	if err := d.Decode(&cp); err != nil {
+		return err
+	}
+	if cp.NumPages != len(c.locks) {
+		return fmt.Errorf("checkpoint has %v pages, not %v", cp.NumPages, len(c.locks))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = cp.Pages
+	c.versions = cp.Versions
+	c.allocs = cp.Allocs
+	c.named = cp.Named
+	c.freeExtents = cp.FreeExtents
+	c.segments = cp.Segments
+	if cp.Bound != nil {
+		c.bound = cp.Bound
+	}
+	for _, s := range c.segments {
+		// the clients that had it open are gone
+		s.Openers = nil
+		c.maybeFreeSegment(s)
+	}
+	c.checkpointPath = path
+	log.Println("restored", len(c.pages), "pages from", path)
+	return nil
+}
+
+// MakeRestoredCentral starts a central server like MakeCentral, with
+// the pages and allocations of the checkpoint at path.
+func MakeRestoredCentral(clients map[int]string, numpages int, transport Transport, path string) (*Central, error) {
+	c := Central{}
+	c.initialize(clients, numpages, transport)
+	if err := c.restore(path); err != nil {
+		c.Kill()
+		return nil, err
+	}
+	c.transport.Serve(&c)
+	go c.failureDetector()
+	return &c, nil
+}
+
+// CheckpointSetup asks the central, whose replicas are at centrals,
+// to write a checkpoint to path on its machine.
+func CheckpointSetup(centrals []string, path string) {
+	// never serves, so it listens nowhere
+	transport := MakeNetTransport("")
+	for i := 0; ; i = (i + 1) % len(centrals) {
+		reply := &Reply{}
+		ok := transport.Call(centrals[i], "Central.Checkpoint", &CheckpointArgs{Path: path}, reply)
+		if ok && reply.Err == OK {
+			log.Println("checkpoint written to", path)
+			return
+		}
+		if ok && reply.Err != ErrWrongLeader {
+			log.Fatal("could not checkpoint: ", reply.Err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,34 +9,139 @@ import "C"
 import (
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"net"
-	"net/rpc"
+	"github.com/6.5840-dsm/raft"
 )
 
 const (
-	OK = "OK"
+	OK              = "OK"
+	ErrWrongLeader  = "ErrWrongLeader"
+	ErrStale        = "ErrStale"
+	ErrNotOwner     = "ErrNotOwner"
+	ErrNoMemory     = "ErrNoMemory"
+	ErrNotAllocated = "ErrNotAllocated"
+	ErrNoSegment    = "ErrNoSegment"
+	ErrSegmentSize  = "ErrSegmentSize"
+	ErrAllocSize    = "ErrAllocSize"
+	ErrCheckpoint   = "ErrCheckpoint"
+	ErrClientDead   = "ErrClientDead"
+	ErrOwnerDead    = "ErrOwnerDead"
+	ErrBound        = "ErrBound"
+)
+
+// How the clients find out who owns a page.
+type Manager int
+
+const (
+	// a central server, possibly replicated, manages every page.
+	CentralManager Manager = iota
+	// each client manages the pages whose index maps to it modulo
+	// the number of clients.
+	FixedManager
+	// there is no manager; clients follow probable-owner hints.
+	DynamicManager
+)
+
+// How the clients keep their copies of a page coherent.
+type Protocol int
+
+const (
+	// a page is writable at one client at a time, and every
+	// write invalidates the other copies.
+	SequentialConsistency Protocol = iota
+	// clients write their own copies at once and merge their
+	// writes at the central when they release.
+	ReleaseConsistency
+	// clients write their own copies at once, and fetch each
+	// other's writes when they fault after an acquire.
+	LazyReleaseConsistency
 )
 
 var PageSize = syscall.Getpagesize()
 
-const port = ":1234"
+// a replicated central snapshots its Raft log past this many bytes.
+const maxraftstate = 1 << 20
+
+// the directory where each replica keeps its Raft state and snapshot,
+// in replica-<index>.raft, so that it can restart.
+var ReplicaStateDir = "."
 
 type Client struct {
-	central string
-	id      int
-	dead    int32 // for testing
-	mu      sync.Mutex
-	ready   bool
+	centrals  []string // the central's replicas
+	leader    int      // the replica we last heard from
+	id        int
+	seq       int64 // the last fault we asked the central about
+	dead      int32 // for testing
+	mu        sync.Mutex
+	ready     bool
+	transport Transport
+	mem       Memory
+
+	// distributed managers
+	manager Manager
+	peers   []string // all the clients, by id
+	central *Central // the pages this client manages, if any
+	pages   map[uintptr]*dynPage
+
+	// release consistency
+	protocol Protocol
+	rc       sync.Mutex
+	twins    map[uintptr][]byte
+	versions map[uintptr]int // of the pages we have valid copies of
+
+	// lazy release consistency, under c.rc
+	vc        VectorClock
+	intervals []Interval                    // ours that the central hasn't got
+	notices   map[uintptr][]Interval        // whose diffs our copies lack
+	lrcDiffs  map[uintptr]map[int][]DiffRun // ours, by interval; under c.mu
+	validated VectorClock                   // our pages have every write up to here
+	passed    int                           // barriers, since we started
+
+	// one allocator request at a time, so that the central sees
+	// their Seqs in order
+	alloc sync.Mutex
+
+	// the same for atomic operations
+	atomics    sync.Mutex
+	atomicDone map[int]atomicResult // the last we did as owner, by client
+
+	locks    map[int]*sync.Mutex  // the DSM locks our threads are holding
+	rwlocks  map[int]*localRWLock // our side of reader-writer locks
+	barriers map[int]int          // the times we have passed each barrier
+	leaseGen map[uintptr]int64    // numbers the leases on each page
+
+	// prefetching
+	advice      []adviceRange
+	epochs      map[uintptr]int64 // numbers what we hear about each page
+	faulted     bool
+	lastFault   uintptr // the last read fault
+	lastStride  int64   // from the read fault before it
+	prefetching bool
+
+	// entry consistency
+	ecVersions map[uintptr]int    // of our copies of bound pages
+	ecTwins    map[uintptr][]byte // of the bound pages of locks we hold
+	ecHeld     map[int][]uintptr  // the bound pages of each lock we hold
+
+	// write-update segments
+	update      sync.Mutex
+	updateTwins map[uintptr][]byte // of the pages we may write
 }
 
 func (c *Client) Kill() {
 	atomic.StoreInt32(&c.dead, 1)
-	// Your code here, if desired.
+	if c.central != nil {
+		c.central.Kill()
+	}
 }
 
 func (c *Client) killed() bool {
@@ -46,15 +151,30 @@ func (c *Client) killed() bool {
 
 func (c *Client) AllClientsRegistered(args *Args, reply *Reply) error {
 	log.Println("all clients registered")
+	c.mu.Lock()
 	c.ready = true
+	c.mu.Unlock()
 	return nil
 }
 
+func (c *Client) isReady() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready
+}
+
 var client *Client
 
 func (c *Client) HandlePageRequest(args *PageRequestArgs, reply *PageRequestReply) error {
+	if len(args.Addrs) > 0 {
+		log.Println("handling page request on go side", args.Addrs)
+		for _, addr := range args.Addrs {
+			reply.Pages = append(reply.Pages, c.mem.GetPage(addr))
+		}
+		return nil
+	}
 	log.Println("handling page request on go side", args.Addr)
-	reply.Data = C.GoBytes(C.get_page(C.uintptr_t(args.Addr)), C.int(PageSize))
+	reply.Data = c.mem.GetPage(args.Addr)
 	return nil
 }
 
@@ -65,28 +185,225 @@ func HandleRead(addr C.uintptr_t) {
 
 func (c *Client) handleRead(addr uintptr) {
 	log.Println("handling read on go side", addr)
+	if c.protocol != SequentialConsistency {
+		c.releaseFault(addr, 1)
+		return
+	}
+	if c.manager == DynamicManager {
+		c.dynamicFault(addr, 1)
+		return
+	}
 	ownerReply := &ReadWriteReply{}
+	start := time.Now()
 	// get owner of page
-	ok := call(c.central, "Central.HandleReadWrite", &ReadWriteArgs{ClientID: c.id, Addr: addr, Access: 1}, ownerReply)
-	if !ok {
-		log.Println("error could not get owner of page")
+	c.callManager(addr, "Central.HandleReadWrite", &ReadWriteArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Addr: addr, Access: 1}, ownerReply)
+	if ownerReply.Err == ErrBound {
+		c.boundFault(addr, 1)
+		return
+	}
+	if !c.faultOK(ownerReply.Err) {
+		return
+	}
+	data := c.fetchBlock(ownerReply.Pages)
+	for _, g := range ownerReply.Pages {
+		// write to page
+		c.setPage(g.Addr, data[g.Addr])
+		c.mem.ChangeAccess(g.Addr, 1)
 	}
-	if ownerReply.HadOwner {
+
+	c.confirm(addr, 1, ownerReply.Pages)
+	for _, g := range ownerReply.Pages {
+		if g.Lease.Duration > 0 {
+			c.holdLease(g.Addr, start, g.Lease)
+		}
+	}
+	c.notePrefetch(addr)
+}
+
+// the data for each page of a fault's block: from its owner, with
+// one request to each owner, or else from the central, which sends
+// nil unless it restored the page.
+func (c *Client) fetchBlock(grants []PageGrant) map[uintptr][]byte {
+	data := make(map[uintptr][]byte)
+	byOwner := make(map[string][]uintptr)
+	for _, g := range grants {
+		if g.HadOwner {
+			byOwner[g.Owner] = append(byOwner[g.Owner], g.Addr)
+		} else {
+			data[g.Addr] = g.Data
+		}
+	}
+	for owner, addrs := range byOwner {
 		pageReply := &PageRequestReply{}
 		// get page data
-		ok = call(ownerReply.Owner, "Client.HandlePageRequest", &PageRequestArgs{Addr: addr, RequestType: 1}, pageReply)
-		if !ok {
+		ok := c.transport.Call(owner, "Client.HandlePageRequest", &PageRequestArgs{Addrs: addrs, RequestType: 1}, pageReply)
+		for !ok {
 			log.Println("error could not get page data")
+			ok = c.transport.Call(owner, "Client.HandlePageRequest", &PageRequestArgs{Addrs: addrs, RequestType: 1}, pageReply)
 		}
-		// write to page
-		C.set_page(C.uintptr_t(addr), C.CBytes(pageReply.Data))
-	} else {
-		var empty_page []byte
-		C.set_page(C.uintptr_t(addr), C.CBytes(empty_page))
+		for i, addr := range addrs {
+			data[addr] = pageReply.Pages[i]
+		}
+	}
+	return data
+}
+
+// install a page that a fault brought in, over any prefetched copy
+// still on its way.
+func (c *Client) setPage(addr uintptr, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bumpEpoch(addr)
+	c.mem.SetPage(addr, data)
+}
+
+//export DsmAdvise
+func DsmAdvise(addr C.long, length C.size_t, advice C.int) {
+	client.Advise(uintptr(addr), int(length), Advice(advice))
+}
+
+//export DsmFlush
+func DsmFlush() {
+	client.Flush()
+}
+
+//export DsmAcquire
+func DsmAcquire() {
+	client.Acquire()
+}
+
+//export DsmRelease
+func DsmRelease() {
+	client.Release()
+}
+
+//export DsmLockAcquire
+func DsmLockAcquire(id C.int) {
+	client.LockAcquire(int(id))
+}
+
+//export DsmLockRelease
+func DsmLockRelease(id C.int) {
+	client.LockRelease(int(id))
+}
+
+//export DsmBind
+func DsmBind(id C.int, offset C.long, size C.size_t) C.int {
+	if client.Bind(int(id), uintptr(offset), int(size)) {
+		return 0
+	}
+	return -1
+}
+
+//export DsmCondWait
+func DsmCondWait(cond C.int, lock C.int) {
+	client.CondWait(int(cond), int(lock))
+}
+
+//export DsmCondSignal
+func DsmCondSignal(cond C.int) {
+	client.CondSignal(int(cond))
+}
+
+//export DsmCondBroadcast
+func DsmCondBroadcast(cond C.int) {
+	client.CondBroadcast(int(cond))
+}
+
+//export DsmSemInit
+func DsmSemInit(id C.int, value C.int) {
+	client.SemInit(int(id), int(value))
+}
+
+//export DsmSemWait
+func DsmSemWait(id C.int) {
+	client.SemWait(int(id))
+}
+
+//export DsmSemPost
+func DsmSemPost(id C.int) {
+	client.SemPost(int(id))
+}
+
+//export DsmRWLockRead
+func DsmRWLockRead(id C.int) {
+	client.ReadLock(int(id))
+}
+
+//export DsmRWLockReadUnlock
+func DsmRWLockReadUnlock(id C.int) {
+	client.ReadUnlock(int(id))
+}
+
+//export DsmRWLockWrite
+func DsmRWLockWrite(id C.int) {
+	client.WriteLock(int(id))
+}
+
+//export DsmRWLockWriteUnlock
+func DsmRWLockWriteUnlock(id C.int) {
+	client.WriteUnlock(int(id))
+}
+
+//export DsmRWLockProtect
+func DsmRWLockProtect(id C.int, offset C.long, size C.size_t) {
+	client.RWLockProtect(int(id), uintptr(offset), int(size))
+}
+
+//export DsmAtomic
+func DsmAtomic(addr C.long, size C.int, op C.int, operand C.uint64_t, expected C.uint64_t) C.uint64_t {
+	return C.uint64_t(client.atomic(uintptr(addr), int(size), AtomicOp(op), uint64(operand), uint64(expected)))
+}
+
+//export DsmBarrier
+func DsmBarrier(id C.int) {
+	client.Barrier(int(id))
+}
+
+// returns the offset of the allocation in the shared region, or -1
+// if there is no room.
+//
+//export DsmMalloc
+func DsmMalloc(name *C.char, size C.size_t, pageAligned C.int) C.long {
+	goName := ""
+	if name != nil {
+		goName = C.GoString(name)
+	}
+	offset, ok := client.Malloc(goName, int(size), pageAligned != 0)
+	if !ok {
+		return -1
+	}
+	return C.long(offset)
+}
+
+//export DsmFree
+func DsmFree(offset C.long) {
+	client.Free(uintptr(offset))
+}
+
+// returns the segment's offset in the shared region, or -1 if it
+// could not be opened.
+//
+//export DsmSegmentOpen
+func DsmSegmentOpen(name *C.char, size C.size_t, blockSize C.size_t, update C.int) C.long {
+	base, _, ok := client.SegmentOpenWith(C.GoString(name), int(size), SegmentOptions{BlockSize: int(blockSize), Update: update != 0})
+	if !ok {
+		return -1
 	}
-	C.change_access(C.uintptr_t(addr), 1)
+	return C.long(base)
+}
+
+//export DsmSegmentClose
+func DsmSegmentClose(base C.long) {
+	client.SegmentClose(uintptr(base))
+}
 
-	ok = call(c.central, "Central.HandleConfirmation", &ConfirmationArgs{ClientID: c.id, Addr: addr}, &Reply{})
+//export DsmSegmentDestroy
+func DsmSegmentDestroy(name *C.char) C.int {
+	if !client.SegmentDestroy(C.GoString(name)) {
+		return -1
+	}
+	return 0
 }
 
 //export HandleWrite
@@ -96,117 +413,303 @@ func HandleWrite(addr C.uintptr_t) {
 
 func (c *Client) handleWrite(addr uintptr) {
 	log.Println("handling write on go side", addr)
+	if c.protocol != SequentialConsistency {
+		c.releaseFault(addr, 2)
+		return
+	}
+	if c.manager == DynamicManager {
+		c.dynamicFault(addr, 2)
+		return
+	}
 	ownerReply := &ReadWriteReply{}
 	// invalidate caches and load page
-	ok := call(c.central, "Central.HandleReadWrite", &ReadWriteArgs{ClientID: c.id, Addr: addr, Access: 2}, ownerReply)
-	if !ok {
+	c.callManager(addr, "Central.HandleReadWrite", &ReadWriteArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Addr: addr, Access: 2}, ownerReply)
+	if ownerReply.Err == ErrBound {
+		c.boundFault(addr, 2)
 		return
 	}
-	if ownerReply.Err != OK {
+	if !c.faultOK(ownerReply.Err) {
 		return
 	}
-	// write to page
-	C.set_page(C.uintptr_t(addr), C.CBytes(ownerReply.Data))
-	ok = call(c.central, "Central.HandleConfirmation", &ConfirmationArgs{ClientID: c.id, Addr: addr}, &Reply{})
+	for _, g := range ownerReply.Pages {
+		// write to page; no data means we already hold the
+		// latest copy, or the page has never been written
+		if g.Data != nil {
+			c.setPage(g.Addr, g.Data)
+		} else {
+			c.mu.Lock()
+			c.bumpEpoch(g.Addr)
+			c.mu.Unlock()
+		}
+		c.cancelLease(g.Addr)
+		if g.Update {
+			c.twinUpdate(g.Addr)
+		}
+		c.mem.ChangeAccess(g.Addr, 2)
+	}
+	c.confirm(addr, 2, ownerReply.Pages)
 }
 
-func (c *Client) ChangeAccess(args *InvalidateArgs, reply *InvalidateReply) error {
-	if args.ReturnPage {
-		log.Println("changing access on go side and returning page first", args.Addr)
-		reply.Data = C.GoBytes(C.get_page(C.uintptr_t(args.Addr)), C.int(PageSize))
+// faultOK reports whether the central served a fault. If not, the
+// access faults again, unless the central has declared this client
+// dead, in which case there is nothing left to do.
+func (c *Client) faultOK(err Err) bool {
+	if err == ErrClientDead {
+		log.Println("declared dead by the central")
+		c.Kill()
 	}
-	C.change_access(C.uintptr_t(args.Addr), C.int(args.NewAccess))
-	return nil
+	return err == OK
 }
 
-func call(addr string, rpcname string, args interface{}, reply interface{}) bool {
-	if addr == "" {
-		log.Println("invalid address")
-		for {
-		}
+// fault takes the fault that the C signal handler would take for an
+// access to addr: a read fault if the page is invalid, a write fault
+// if it is read-only.
+func (c *Client) fault(addr uintptr) {
+	pg := pageOf(addr)
+	if c.mem.Access(pg) >= 1 {
+		c.handleWrite(pg)
+	} else {
+		c.handleRead(pg)
 	}
-	client, err := rpc.Dial("tcp", addr+port)
-	log.Println("dialing", addr+port)
-	if err != nil {
-		log.Fatal(fmt.Sprintf("could not connect to %v", addr), err)
+}
+
+// confirm tells the central that the fault on addr is done, so it can
+// release the pages of its block to the next faulting client. If the
+// central no longer stands by the fault, the pages are dropped and
+// the access faults again.
+func (c *Client) confirm(addr uintptr, access int, grants []PageGrant) {
+	owners := make(map[uintptr]string)
+	for _, g := range grants {
+		owners[g.Addr] = g.Owner
 	}
-	defer client.Close()
-	log.Println("connected to", addr)
-	log.Println("calling", rpcname)
-	err = client.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+	reply := &Reply{}
+	c.callManager(addr, "Central.HandleConfirmation", &ConfirmationArgs{ClientID: c.id, Addr: addr, Access: access, Owners: owners}, reply)
+	if reply.Err == ErrStale {
+		log.Println("stale fault, dropping pages", addr)
+		for _, g := range grants {
+			c.mem.ChangeAccess(g.Addr, 0)
+		}
 	}
-	return false
 }
 
-func (c *Client) initialize(centralAddr string, me int) {
-	go c.initializeRPC()
-	c.central = centralAddr
-	c.id = me
-	c.mu = sync.Mutex{}
-	reply := &RegisterReply{}
-	ok := call(c.central, "Central.RegisterClient", &RegisterArgs{ClientID: c.id}, reply)
-	if !ok {
-		log.Println("error could not register client")
+// callCentral sends an RPC to the central, retrying until some
+// replica handles it. A replica that isn't the leader answers
+// ErrWrongLeader, and we move on to the next one.
+func (c *Client) callCentral(rpcname string, args interface{}, reply interface{}) {
+	v := reflect.ValueOf(reply).Elem()
+	c.mu.Lock()
+	server := c.leader
+	c.mu.Unlock()
+	for !c.killed() {
+		// a fresh reply for each try, since labgob won't decode
+		// into one that is already filled in.
+		v.Set(reflect.Zero(v.Type()))
+		ok := c.transport.Call(c.centrals[server], rpcname, args, reply)
+		if ok && v.FieldByName("Err").String() != ErrWrongLeader {
+			c.mu.Lock()
+			c.leader = server
+			c.mu.Unlock()
+			return
+		}
+		server = (server + 1) % len(c.centrals)
+		if server == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
 	}
 }
 
-func MakeClient(centralAddr string, me int) {
-	c := &Client{}
-	c.initialize(centralAddr, me)
-	client = c
+// the index of the manager that is home to addr, among the managers
+// a client talks to.
+func (c *Client) managerOf(addr uintptr) int {
+	if c.manager == FixedManager {
+		return c.home(addr)
+	}
+	return 0
 }
 
-func (c *Client) initializeRPC() {
-	rpc.Register(c)
-	l, err := net.Listen("tcp", port)
-	if err != nil {
-		log.Fatal("listen error:", err)
-	}
-	defer l.Close()
-	log.Println("client server listening on port", port)
+// callManager sends an RPC about the page at addr to whoever manages
+// it, retrying until it is handled.
+func (c *Client) callManager(addr uintptr, rpcname string, args interface{}, reply interface{}) {
+	c.callManagerAt(c.managerOf(addr), rpcname, args, reply)
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal("accept error:", err)
+// callManagerAt sends an RPC to manager m: the central if there is
+// one, or else client m.
+func (c *Client) callManagerAt(m int, rpcname string, args interface{}, reply interface{}) {
+	if c.manager != FixedManager {
+		c.callCentral(rpcname, args, reply)
+		return
+	}
+	v := reflect.ValueOf(reply).Elem()
+	server := c.peers[m]
+	for !c.killed() {
+		v.Set(reflect.Zero(v.Type()))
+		if c.transport.Call(server, rpcname, args, reply) {
+			return
 		}
-		go rpc.ServeConn(conn)
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func ClientSetup(numpages int, index int, numservers int, central string) {
-	MakeClient(central, index)
+func (c *Client) ChangeAccess(args *InvalidateArgs, reply *InvalidateReply) error {
+	if args.ReturnPage {
+		log.Println("changing access on go side and returning page first", args.Addr)
+		reply.Data = c.mem.GetPage(args.Addr)
+	}
+	if args.NewAccess < 2 {
+		c.update.Lock()
+		reply.Diff = c.takeUpdate(args.Addr)
+		c.update.Unlock()
+	}
+	c.mu.Lock()
+	c.bumpEpoch(args.Addr)
+	c.mem.ChangeAccess(args.Addr, args.NewAccess)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) initialize(centrals []string, me int, transport Transport, mem Memory) {
+	c.transport = transport
+	c.mem = mem
+	c.pages = make(map[uintptr]*dynPage)
+	c.twins = make(map[uintptr][]byte)
+	c.versions = make(map[uintptr]int)
+	c.vc = make(VectorClock)
+	c.validated = make(VectorClock)
+	c.notices = make(map[uintptr][]Interval)
+	c.lrcDiffs = make(map[uintptr]map[int][]DiffRun)
+	c.locks = make(map[int]*sync.Mutex)
+	c.rwlocks = make(map[int]*localRWLock)
+	c.barriers = make(map[int]int)
+	c.leaseGen = make(map[uintptr]int64)
+	c.epochs = make(map[uintptr]int64)
+	c.updateTwins = make(map[uintptr][]byte)
+	c.ecVersions = make(map[uintptr]int)
+	c.ecTwins = make(map[uintptr][]byte)
+	c.ecHeld = make(map[int][]uintptr)
+	c.atomicDone = make(map[int]atomicResult)
+	c.transport.Serve(c)
+	c.centrals = centrals
+	c.id = me
+}
+
+func (c *Client) register() {
+	c.callCentral("Central.RegisterClient", &RegisterArgs{ClientID: c.id}, &RegisterReply{})
+}
+
+// MakeClient starts client me of the DSM and registers it with the
+// central, whose replicas are at centrals, keeping pages coherent
+// with protocol. Pages are kept in mem.
+func MakeClient(centrals []string, me int, protocol Protocol, transport Transport, mem Memory) *Client {
+	c := &Client{}
+	c.protocol = protocol
+	c.initialize(centrals, me, transport, mem)
+	c.register()
+	return c
+}
+
+// MakeDistributedClient starts client me of a DSM whose pages are
+// managed by the clients themselves, without a central server. peers
+// are the addresses of all the clients, by id. Client 0 collects the
+// registrations that a central would, and under release consistency
+// with the dynamic manager, it is also the home of every page.
+func MakeDistributedClient(peers []string, me int, numpages int, manager Manager, protocol Protocol, transport Transport, mem Memory) *Client {
+	c := &Client{}
+	c.protocol = protocol
+	c.manager = manager
+	c.peers = peers
+	if manager == FixedManager || me == 0 {
+		clients := make(map[int]string)
+		for id, addr := range peers {
+			clients[id] = addr
+		}
+		c.central = MakeCentral(clients, numpages, transport)
+		// a block's pages may have different managers
+		c.central.perPage = true
+	}
+	c.initialize([]string{peers[0]}, me, transport, mem)
+	c.register()
+	return c
+}
 
-	// C.setup(C.int(numpages), C.int(index), C.int(numservers))
-	// C.test_one_client(C.int(numpages), C.int(index), C.int(numservers))
+// central is the central's address, or a comma-separated list of
+// addresses if it is replicated. The client listens on listen, which
+// must match its address in the central's list of clients.
+func ClientSetup(numpages int, index int, numservers int, central string, listen string, protocol Protocol, workload string) {
+	w := mustLookupWorkload(workload)
+	client = MakeClient(strings.Split(central, ","), index, protocol, MakeNetTransport(listen), makeCgoMemory())
+	run(w, numpages, index, numservers)
+}
 
-	// for client.killed() == false {
-	// 	time.Sleep(time.Second)
-	// 	if client.ready {
-	// 		C.test_concurrent_clients(C.int(numpages), C.int(index), C.int(numservers))
-	// 		break
-	// 	}
-	// }
+// DistributedClientSetup runs client index of a DSM managed by its
+// clients, whose addresses are peers.
+func DistributedClientSetup(numpages int, index int, peers []string, manager Manager, protocol Protocol, workload string) {
+	w := mustLookupWorkload(workload)
+	client = MakeDistributedClient(peers, index, numpages, manager, protocol, MakeNetTransport(ListenAddr(peers[index])), makeCgoMemory())
+	run(w, numpages, index, len(peers))
+}
 
-	C.setup_matmul(C.int(numpages), C.int(index), C.int(numservers))
+func mustLookupWorkload(name string) Workload {
+	w, ok := lookupWorkload(name)
+	if !ok {
+		log.Fatalf("no workload %v; try one of %v", name, Workloads())
+	}
+	return w
+}
 
+// run the workload on this client, and then keep serving the other
+// clients. An interrupted client with a central manager leaves the
+// DSM on its way out.
+func run(w Workload, numpages int, index int, numservers int) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		if client.manager == CentralManager {
+			client.Leave()
+		} else {
+			client.Kill()
+		}
+	}()
+	if runWorkload(w, client, numpages, index, numservers) {
+		log.Println("workload verified")
+	} else {
+		log.Println("workload FAILED to verify")
+	}
 	for client.killed() == false {
 		time.Sleep(time.Second)
-		if client.ready {
-			C.multiply_matrices(C.int(index), C.int(numservers))
-			break
+	}
+	time.Sleep(time.Second)
+}
+
+// CentralSetup runs a central server listening on listen, from the
+// checkpoint at restore unless it is "".
+func CentralSetup(clients map[int]string, numpages int, listen string, restore string) {
+	var central *Central
+	if restore == "" {
+		central = MakeCentral(clients, numpages, MakeNetTransport(listen))
+	} else {
+		var err error
+		central, err = MakeRestoredCentral(clients, numpages, MakeNetTransport(listen), restore)
+		if err != nil {
+			log.Fatal("could not restore checkpoint: ", err)
 		}
 	}
-	for client.killed() == false {
+
+	for central.killed() == false {
 		time.Sleep(time.Second)
 	}
 	time.Sleep(time.Second)
 }
 
-func CentralSetup(clients map[int]string, numpages int) {
-	central := MakeCentral(clients, numpages)
+// ReplicaSetup runs replica me of a central replicated across peers.
+// It starts from the state it saved in ReplicaStateDir, if any.
+func ReplicaSetup(clients map[int]string, numpages int, peers []string, me int) {
+	persister, err := raft.MakeFilePersister(filepath.Join(ReplicaStateDir, fmt.Sprintf("replica-%d.raft", me)))
+	if err != nil {
+		log.Fatal("could not read replica state: ", err)
+	}
+	central := MakeReplicatedCentral(clients, numpages, peers, me, MakeNetTransport(ListenAddr(peers[me])), persister, maxraftstate)
 
 	for central.killed() == false {
 		time.Sleep(time.Second)
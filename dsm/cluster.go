@@ -0,0 +1,296 @@
+package dsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A cluster configuration file, in JSON, so that every machine of a
+// DSM can start from the same description of it instead of a long
+// argument list. For example:
+//
+//	{
+//	  "central": "10.0.0.1:7000",
+//	  "clients": [
+//	    {"id": 0, "address": "10.0.0.2:7000"},
+//	    {"id": 1, "address": "10.0.0.3:7000"}
+//	  ],
+//	  "num_pages": 16,
+//	  "block_size": "16KiB",
+//	  "protocol": "release",
+//	  "workload": "matmul"
+//	}
+//
+// A replicated central lists its replicas in "replicas" instead of
+// "central", and clients that manage the pages themselves set
+// "manager" to "fixed" or "dynamic" and have neither.
+
+type ClusterConfig struct {
+	Central     string          `json:"central"`
+	Replicas    []string        `json:"replicas"`
+	Clients     []ClientAddress `json:"clients"`
+	NumPages    int             `json:"num_pages"`
+	PageSize    int             `json:"page_size"` // optional; must be the machine's
+	Protocol    string          `json:"protocol"`  // "sequential" (the default), "release" or "lazy"
+	Manager     string          `json:"manager"`   // "central" (the default), "fixed" or "dynamic"
+	Workload    string          `json:"workload"`  // "matmul" by default
+	Restore     string          `json:"restore"`   // a checkpoint for the central to start from
+	StateDir    string          `json:"state_dir"` // where replicas keep their Raft state
+	DialTimeout string          `json:"dial_timeout"`
+	CallTimeout string          `json:"call_timeout"`
+
+	// blocks, such as "64KiB"; see BlockSize and SegmentBlockSizes
+	BlockSize         string            `json:"block_size"`
+	SegmentBlockSizes map[string]string `json:"segment_block_sizes"`
+
+	// segments that are write-update; see UpdateSegments
+	UpdateSegments []string `json:"update_segments"`
+
+	// "writer" (the default), "reader" or "fair"; see RWLockPolicy
+	RWLockPolicy string `json:"rwlock_policy"`
+}
+
+type ClientAddress struct {
+	ID      int    `json:"id"`
+	Address string `json:"address"`
+}
+
+// LoadClusterConfig reads and checks the configuration file at path.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseClusterConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseClusterConfig parses and checks a configuration.
+func ParseClusterConfig(data []byte) (*ClusterConfig, error) {
+	cfg := &ClusterConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = "sequential"
+	}
+	if cfg.Manager == "" {
+		cfg.Manager = "central"
+	}
+	if cfg.Workload == "" {
+		cfg.Workload = "matmul"
+	}
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *ClusterConfig) check() error {
+	if cfg.NumPages <= 0 {
+		return fmt.Errorf("num_pages must be positive, not %v", cfg.NumPages)
+	}
+	if cfg.PageSize != 0 && cfg.PageSize != PageSize {
+		return fmt.Errorf("page_size is %v, but this machine's pages are %v bytes", cfg.PageSize, PageSize)
+	}
+	if _, err := cfg.protocol(); err != nil {
+		return err
+	}
+	manager, err := cfg.manager()
+	if err != nil {
+		return err
+	}
+	if _, ok := lookupWorkload(cfg.Workload); !ok {
+		return fmt.Errorf("no workload %q; try one of %v", cfg.Workload, Workloads())
+	}
+	for _, d := range []string{cfg.DialTimeout, cfg.CallTimeout} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return fmt.Errorf("bad timeout: %v", err)
+		}
+	}
+	if cfg.BlockSize != "" {
+		if _, err := ParseBlockSize(cfg.BlockSize); err != nil {
+			return err
+		}
+	}
+	for name, size := range cfg.SegmentBlockSizes {
+		if _, err := ParseBlockSize(size); err != nil {
+			return fmt.Errorf("segment %v: %v", name, err)
+		}
+	}
+	if cfg.RWLockPolicy != "" {
+		if _, err := ParseRWPolicy(cfg.RWLockPolicy); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]string)
+	checkAddr := func(what string, addr string) error {
+		if addr == "" {
+			return fmt.Errorf("%v has no address", what)
+		}
+		if _, _, err := net.SplitHostPort(WithPort(addr)); err != nil {
+			return fmt.Errorf("%v: %v", what, err)
+		}
+		if other, ok := seen[WithPort(addr)]; ok {
+			return fmt.Errorf("%v and %v both have address %v", other, what, addr)
+		}
+		seen[WithPort(addr)] = what
+		return nil
+	}
+
+	if manager == CentralManager {
+		if cfg.Central == "" && len(cfg.Replicas) == 0 {
+			return fmt.Errorf("no central or replicas")
+		}
+		if cfg.Central != "" && len(cfg.Replicas) > 0 {
+			return fmt.Errorf("both a central and replicas")
+		}
+	} else if cfg.Central != "" || len(cfg.Replicas) > 0 {
+		return fmt.Errorf("the %v manager runs without a central", cfg.Manager)
+	}
+	if cfg.Central != "" {
+		if err := checkAddr("the central", cfg.Central); err != nil {
+			return err
+		}
+	}
+	for i, addr := range cfg.Replicas {
+		if err := checkAddr(fmt.Sprintf("replica %v", i), addr); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.Clients) == 0 {
+		return fmt.Errorf("no clients")
+	}
+	ids := make(map[int]bool)
+	for _, c := range cfg.Clients {
+		if c.ID < 0 || c.ID >= len(cfg.Clients) {
+			return fmt.Errorf("client id %v is not between 0 and %v", c.ID, len(cfg.Clients)-1)
+		}
+		if ids[c.ID] {
+			return fmt.Errorf("two clients have id %v", c.ID)
+		}
+		ids[c.ID] = true
+		if err := checkAddr(fmt.Sprintf("client %v", c.ID), c.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *ClusterConfig) protocol() (Protocol, error) {
+	switch cfg.Protocol {
+	case "sequential":
+		return SequentialConsistency, nil
+	case "release":
+		return ReleaseConsistency, nil
+	case "lazy":
+		return LazyReleaseConsistency, nil
+	}
+	return 0, fmt.Errorf("protocol must be sequential, release or lazy, not %q", cfg.Protocol)
+}
+
+func (cfg *ClusterConfig) manager() (Manager, error) {
+	switch cfg.Manager {
+	case "central":
+		return CentralManager, nil
+	case "fixed":
+		return FixedManager, nil
+	case "dynamic":
+		return DynamicManager, nil
+	}
+	return 0, fmt.Errorf("manager must be central, fixed or dynamic, not %q", cfg.Manager)
+}
+
+// the clients' addresses, by id.
+func (cfg *ClusterConfig) clientAddrs() map[int]string {
+	addrs := make(map[int]string)
+	for _, c := range cfg.Clients {
+		addrs[c.ID] = c.Address
+	}
+	return addrs
+}
+
+// the clients' addresses in id order.
+func (cfg *ClusterConfig) peers() []string {
+	addrs := cfg.clientAddrs()
+	ids := make([]int, 0, len(addrs))
+	for id := range addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	peers := make([]string, len(ids))
+	for i, id := range ids {
+		peers[i] = addrs[id]
+	}
+	return peers
+}
+
+// Run runs this machine's part of the cluster: "central", or replica
+// or client index.
+func (cfg *ClusterConfig) Run(role string, index int) error {
+	if cfg.StateDir != "" {
+		ReplicaStateDir = cfg.StateDir
+	}
+	if cfg.DialTimeout != "" {
+		DialTimeout, _ = time.ParseDuration(cfg.DialTimeout)
+	}
+	if cfg.CallTimeout != "" {
+		CallTimeout, _ = time.ParseDuration(cfg.CallTimeout)
+	}
+	if cfg.BlockSize != "" {
+		BlockSize, _ = ParseBlockSize(cfg.BlockSize)
+	}
+	for name, size := range cfg.SegmentBlockSizes {
+		SegmentBlockSizes[name], _ = ParseBlockSize(size)
+	}
+	for _, name := range cfg.UpdateSegments {
+		UpdateSegments[name] = true
+	}
+	if cfg.RWLockPolicy != "" {
+		RWLockPolicy, _ = ParseRWPolicy(cfg.RWLockPolicy)
+	}
+	protocol, _ := cfg.protocol()
+	manager, _ := cfg.manager()
+	switch role {
+	case "central":
+		if cfg.Central == "" {
+			return fmt.Errorf("the configuration has no central")
+		}
+		CentralSetup(cfg.clientAddrs(), cfg.NumPages, ListenAddr(cfg.Central), cfg.Restore)
+	case "replica":
+		if index < 0 || index >= len(cfg.Replicas) {
+			return fmt.Errorf("no replica %v", index)
+		}
+		ReplicaSetup(cfg.clientAddrs(), cfg.NumPages, cfg.Replicas, index)
+	case "client":
+		peers := cfg.peers()
+		if index < 0 || index >= len(peers) {
+			return fmt.Errorf("no client %v", index)
+		}
+		if manager != CentralManager {
+			DistributedClientSetup(cfg.NumPages, index, peers, manager, protocol, cfg.Workload)
+			return nil
+		}
+		centrals := cfg.Central
+		if centrals == "" {
+			centrals = strings.Join(cfg.Replicas, ",")
+		}
+		ClientSetup(cfg.NumPages, index, len(peers), centrals, ListenAddr(peers[index]), protocol, cfg.Workload)
+	default:
+		return fmt.Errorf("no role %q; try central, replica or client", role)
+	}
+	return nil
+}
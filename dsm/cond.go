@@ -0,0 +1,309 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Condition variables and counting semaphores for DSM programs, kept
+// by the central like locks, so that clients that wait for each other
+// block in an RPC instead of spinning on shared pages. Under the fixed
+// distributed managers, condition variable or semaphore id is kept by
+// the same client as lock id.
+//
+// A condition variable has Mesa semantics: a client waits while
+// holding a lock, and is queued on the condition before it releases
+// the lock, so that a signal from the next holder can't be missed. A
+// woken waiter acquires the lock again before it returns, and should
+// check its condition again.
+//
+// A client's threads may have several requests to one condition
+// variable or semaphore out at once, and they can arrive in any
+// order, so the central remembers each request it applied, not just
+// the last.
+
+// how many of each client's requests a condition variable, semaphore
+// or the binds remember; an older one is taken for a retry.
+const maxApplied = 64
+
+// the requests of one client applied to a condition variable, a
+// semaphore, or the binds.
+type AppliedSeqs struct {
+	Floor  int64   // every request up to here counts as applied
+	Recent []int64 // and these, above it
+}
+
+// whether the request seq from clientID is new, recording it if so.
+func firstApply(applied map[int]*AppliedSeqs, clientID int, seq int64) bool {
+	a, ok := applied[clientID]
+	if !ok {
+		a = &AppliedSeqs{}
+		applied[clientID] = a
+	}
+	if seq <= a.Floor {
+		return false
+	}
+	for _, s := range a.Recent {
+		if s == seq {
+			return false
+		}
+	}
+	a.Recent = append(a.Recent, seq)
+	if len(a.Recent) > maxApplied {
+		sort.Slice(a.Recent, func(i, j int) bool { return a.Recent[i] < a.Recent[j] })
+		a.Floor = a.Recent[0]
+		a.Recent = a.Recent[1:]
+	}
+	return true
+}
+
+// A client's request to wait, numbered like its lock requests.
+type Waiter struct {
+	ClientID int
+	Seq      int64
+}
+
+// A condition variable, as the central keeps it.
+type CondState struct {
+	Waiting []Waiter             // in the order they waited
+	Applied map[int]*AppliedSeqs // by client
+}
+
+// A semaphore, as the central keeps it.
+type SemState struct {
+	Count   int
+	Waiting []Waiter
+	Applied map[int]*AppliedSeqs
+	VC      VectorClock // of every post so far
+}
+
+// whether w is in waiting.
+func isWaiting(waiting []Waiter, w Waiter) bool {
+	for _, x := range waiting {
+		if x == w {
+			return true
+		}
+	}
+	return false
+}
+
+// the waiters in waiting that aren't client id's.
+func dropWaiters(waiting []Waiter, id int) []Waiter {
+	kept := waiting[:0]
+	for _, w := range waiting {
+		if w.ClientID != id {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// block until w has left the waiting list that queue returns.
+func (c *Central) awaitWakeup(w Waiter, queue func() []Waiter) Err {
+	for !c.killed() {
+		c.mu.Lock()
+		waiting := isWaiting(queue(), w)
+		c.mu.Unlock()
+		if !waiting {
+			return OK
+		}
+		if !c.isLeader() {
+			// the client will wait at the new leader
+			return ErrWrongLeader
+		}
+		time.Sleep(pollInterval)
+	}
+	return ErrWrongLeader
+}
+
+// CondWait queues the client on a condition variable. The client then
+// releases the lock and calls CondSleep.
+func (c *Central) CondWait(args *CondArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opCondWait, ClientID: args.ClientID, ID: args.CondID, ReqSeq: args.Seq})
+	return nil
+}
+
+// CondSleep blocks until the wait that the client queued with args.Seq
+// has been signaled.
+func (c *Central) CondSleep(args *CondArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	w := Waiter{ClientID: args.ClientID, Seq: args.Seq}
+	reply.Err = c.awaitWakeup(w, func() []Waiter {
+		if cv, ok := c.conds[args.CondID]; ok {
+			return cv.Waiting
+		}
+		return nil
+	})
+	return nil
+}
+
+func (c *Central) CondSignal(args *CondArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	op := opCondSignal
+	if args.Broadcast {
+		op = opCondBroadcast
+	}
+	reply.Err = c.commit(Op{Type: op, ClientID: args.ClientID, ID: args.CondID, ReqSeq: args.Seq})
+	return nil
+}
+
+// apply a condition variable request. c.mu must be held.
+func (c *Central) applyCond(op Op) {
+	cv, ok := c.conds[op.ID]
+	if !ok {
+		cv = &CondState{Applied: make(map[int]*AppliedSeqs)}
+		c.conds[op.ID] = cv
+	}
+	if !firstApply(cv.Applied, op.ClientID, op.ReqSeq) {
+		return
+	}
+	switch op.Type {
+	case opCondWait:
+		cv.Waiting = append(cv.Waiting, Waiter{ClientID: op.ClientID, Seq: op.ReqSeq})
+	case opCondSignal:
+		if len(cv.Waiting) > 0 {
+			cv.Waiting = cv.Waiting[1:]
+		}
+	case opCondBroadcast:
+		cv.Waiting = nil
+	}
+}
+
+func (c *Central) SemInit(args *SemArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opSemInit, ClientID: args.ClientID, ID: args.SemID, ReqSeq: args.Seq, Value: args.Value})
+	return nil
+}
+
+// SemWait blocks until the client has taken one from the semaphore.
+func (c *Central) SemWait(args *SemArgs, reply *SemReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opSemWait, ClientID: args.ClientID, ID: args.SemID, ReqSeq: args.Seq}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	w := Waiter{ClientID: args.ClientID, Seq: args.Seq}
+	reply.Err = c.awaitWakeup(w, func() []Waiter { return c.sems[args.SemID].Waiting })
+	if reply.Err == OK {
+		c.mu.Lock()
+		s := c.sems[args.SemID]
+		reply.VC = s.VC.copy()
+		reply.Intervals = c.intervalsSince(s.VC, args.VC)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *Central) SemPost(args *SemArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opSemPost, ClientID: args.ClientID, ID: args.SemID, ReqSeq: args.Seq, VC: args.VC, Intervals: args.Intervals})
+	return nil
+}
+
+// apply a semaphore request: a post wakes the first waiter, if there
+// is one, instead of counting up. c.mu must be held.
+func (c *Central) applySem(op Op) {
+	s, ok := c.sems[op.ID]
+	if !ok {
+		s = &SemState{Applied: make(map[int]*AppliedSeqs)}
+		c.sems[op.ID] = s
+		if op.Type == opSemInit {
+			s.Count = op.Value
+		}
+	}
+	if !firstApply(s.Applied, op.ClientID, op.ReqSeq) {
+		return
+	}
+	switch op.Type {
+	case opSemWait:
+		if s.Count > 0 && len(s.Waiting) == 0 {
+			s.Count--
+		} else {
+			s.Waiting = append(s.Waiting, Waiter{ClientID: op.ClientID, Seq: op.ReqSeq})
+		}
+	case opSemPost:
+		c.addIntervals(op.Intervals)
+		if s.VC == nil {
+			s.VC = make(VectorClock)
+		}
+		s.VC.merge(op.VC)
+		if len(s.Waiting) > 0 {
+			s.Waiting = s.Waiting[1:]
+		} else {
+			s.Count++
+		}
+	}
+}
+
+// CondWait releases lock, which this client holds, waits until another
+// client signals cond, and acquires lock again.
+func (c *Client) CondWait(cond int, lock int) {
+	args := &CondArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), CondID: cond}
+	log.Println("waiting on condition", cond)
+	c.callManagerAt(c.syncManager(cond), "Central.CondWait", args, &Reply{})
+	c.LockRelease(lock)
+	c.callManagerAt(c.syncManager(cond), "Central.CondSleep", args, &Reply{})
+	c.LockAcquire(lock)
+}
+
+// CondSignal wakes the client that has waited longest on cond, if any.
+func (c *Client) CondSignal(cond int) {
+	args := &CondArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), CondID: cond}
+	c.callManagerAt(c.syncManager(cond), "Central.CondSignal", args, &Reply{})
+}
+
+// CondBroadcast wakes every client waiting on cond.
+func (c *Client) CondBroadcast(cond int) {
+	args := &CondArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), CondID: cond, Broadcast: true}
+	c.callManagerAt(c.syncManager(cond), "Central.CondSignal", args, &Reply{})
+}
+
+// SemInit gives semaphore id the count value, unless some client has
+// used it already, so every client may call it.
+func (c *Client) SemInit(id int, value int) {
+	args := &SemArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), SemID: id, Value: value}
+	c.callManagerAt(c.syncManager(id), "Central.SemInit", args, &Reply{})
+}
+
+// SemWait blocks until semaphore id's count is positive, and takes one
+// from it. Under release consistency, it then sees every write
+// released before.
+func (c *Client) SemWait(id int) {
+	log.Println("waiting on semaphore", id)
+	args := &SemArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), SemID: id, VC: c.clock()}
+	reply := &SemReply{}
+	c.callManagerAt(c.syncManager(id), "Central.SemWait", args, reply)
+	c.lrcAcquire(reply.Intervals, reply.VC)
+	c.Acquire()
+}
+
+// SemPost adds one to semaphore id, waking a waiter if there is one,
+// after releasing this client's writes.
+func (c *Client) SemPost(id int) {
+	c.Release()
+	args := &SemArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), SemID: id}
+	args.Intervals, args.VC = c.lrcPublish()
+	c.callManagerAt(c.syncManager(id), "Central.SemPost", args, &Reply{})
+	c.lrcPublished(args.Intervals)
+}
@@ -0,0 +1,294 @@
+package dsm
+
+//
+// support for DSM tester.
+//
+// runs a central server and n clients in one process, talking over
+// a labrpc network, with each client's pages held in a localMemory.
+//
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/6.5840-dsm/labrpc"
+	"github.com/6.5840-dsm/raft"
+)
+
+const centralName = "central"
+
+func clientName(i int) string {
+	return "client-" + strconv.Itoa(i)
+}
+
+func replicaName(i int) string {
+	return "central-" + strconv.Itoa(i)
+}
+
+type config struct {
+	mu      sync.Mutex
+	t       *testing.T
+	net     *labrpc.Network
+	n       int
+	npages  int
+	central *Central // nil if the central is replicated
+	// replicated central
+	replicas   []*Central
+	persisters []*raft.Persister
+	peers      []string
+	addrs      map[int]string // the clients, as the central knows them
+	clients    []*Client
+	mems       []*localMemory
+	start      time.Time // time at which make_config() was called
+	// begin()/end() statistics
+	t0    time.Time // time at which test_test.go called cfg.begin()
+	rpcs0 int       // rpcTotal() at start of test
+}
+
+func make_config(t *testing.T, n int, npages int, unreliable bool) *config {
+	return make_replicated_config(t, 0, n, npages, unreliable, -1, SequentialConsistency)
+}
+
+// a config whose central is replicated on nreplicas servers, or a
+// single unreplicated central if nreplicas is 0.
+func make_replicated_config(t *testing.T, nreplicas int, n int, npages int, unreliable bool, maxraftstate int, protocol Protocol) *config {
+	runtime.GOMAXPROCS(4)
+	cfg := &config{}
+	cfg.t = t
+	cfg.net = labrpc.MakeNetwork()
+	cfg.n = n
+	cfg.npages = npages
+	cfg.clients = make([]*Client, n)
+	cfg.mems = make([]*localMemory, n)
+	cfg.start = time.Now()
+
+	cfg.net.Reliable(!unreliable)
+
+	addrs := make(map[int]string)
+	for i := 0; i < n; i++ {
+		addrs[i] = clientName(i)
+	}
+	cfg.addrs = addrs
+	centrals := []string{centralName}
+	if nreplicas == 0 {
+		cfg.central = MakeCentral(addrs, npages, MakeLabrpcTransport(cfg.net, centralName))
+	} else {
+		cfg.replicas = make([]*Central, nreplicas)
+		cfg.persisters = make([]*raft.Persister, nreplicas)
+		cfg.peers = make([]string, nreplicas)
+		for i := 0; i < nreplicas; i++ {
+			cfg.peers[i] = replicaName(i)
+		}
+		for i := 0; i < nreplicas; i++ {
+			cfg.persisters[i] = raft.MakePersister()
+			cfg.startReplica(i, maxraftstate)
+		}
+		centrals = cfg.peers
+	}
+
+	for i := 0; i < n; i++ {
+		cfg.mems[i] = makeLocalMemory()
+		transport := MakeLabrpcTransport(cfg.net, clientName(i))
+		cfg.clients[i] = MakeClient(centrals, i, protocol, transport, cfg.mems[i])
+	}
+	cfg.waitReady()
+	return cfg
+}
+
+// a config with no central server, whose clients manage the pages
+// themselves.
+func make_distributed_config(t *testing.T, n int, npages int, unreliable bool, manager Manager, protocol Protocol) *config {
+	runtime.GOMAXPROCS(4)
+	cfg := &config{}
+	cfg.t = t
+	cfg.net = labrpc.MakeNetwork()
+	cfg.n = n
+	cfg.npages = npages
+	cfg.clients = make([]*Client, n)
+	cfg.mems = make([]*localMemory, n)
+	cfg.start = time.Now()
+
+	cfg.net.Reliable(!unreliable)
+
+	peers := make([]string, n)
+	for i := 0; i < n; i++ {
+		peers[i] = clientName(i)
+	}
+	// start the clients concurrently, since each one's
+	// registration waits for client 0.
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		cfg.mems[i] = makeLocalMemory()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			transport := MakeLabrpcTransport(cfg.net, clientName(i))
+			cfg.clients[i] = MakeDistributedClient(peers, i, npages, manager, protocol, transport, cfg.mems[i])
+		}(i)
+	}
+	wg.Wait()
+	cfg.waitReady()
+	return cfg
+}
+
+// wait for every client to hear that all clients have registered.
+func (cfg *config) waitReady() {
+	for i := 0; i < cfg.n; i++ {
+		for !cfg.clients[i].isReady() {
+			time.Sleep(10 * time.Millisecond)
+			if time.Since(cfg.start) > 10*time.Second {
+				cfg.t.Fatalf("client %v never saw all clients register", i)
+			}
+		}
+	}
+}
+
+// start replica i of the central, from whatever it had persisted.
+func (cfg *config) startReplica(i int, maxraftstate int) {
+	transport := MakeLabrpcTransport(cfg.net, cfg.peers[i])
+	// a fresh persister, so a crashed incarnation can't
+	// overwrite the new one's state.
+	cfg.persisters[i] = cfg.persisters[i].Copy()
+	cfg.replicas[i] = MakeReplicatedCentral(cfg.addrs, cfg.npages, cfg.peers, i, transport, cfg.persisters[i], maxraftstate)
+}
+
+// crash replica i of the central.
+func (cfg *config) crashReplica(i int) {
+	cfg.net.DeleteServer(cfg.peers[i])
+	cfg.replicas[i].Kill()
+}
+
+// start a client that joins the running DSM, returning its index.
+func (cfg *config) join() (int, *JoinReply) {
+	centrals := []string{centralName}
+	if cfg.central == nil {
+		centrals = cfg.peers
+	}
+	i := cfg.n
+	mem := makeLocalMemory()
+	transport := MakeLabrpcTransport(cfg.net, clientName(i))
+	c, reply := MakeJoiningClient(centrals, clientName(i), SequentialConsistency, transport, mem)
+	cfg.clients = append(cfg.clients, c)
+	cfg.mems = append(cfg.mems, mem)
+	cfg.n++
+	return i, reply
+}
+
+// crash client i.
+func (cfg *config) crashClient(i int) {
+	cfg.net.DeleteServer(clientName(i))
+	cfg.clients[i].Kill()
+}
+
+// the index of the replica that thinks it is the leader.
+func (cfg *config) leader() int {
+	for iters := 0; iters < 50; iters++ {
+		for i, c := range cfg.replicas {
+			if !c.killed() && c.isLeader() {
+				return i
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cfg.t.Fatalf("no central replica is leader")
+	return -1
+}
+
+// crash the central and every client, and start them all again, the
+// central from the checkpoint at path.
+func (cfg *config) restart(path string) {
+	cfg.central.Kill()
+	cfg.net.DeleteServer(centralName)
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].Kill()
+		cfg.net.DeleteServer(clientName(i))
+	}
+	central, err := MakeRestoredCentral(cfg.addrs, cfg.npages, MakeLabrpcTransport(cfg.net, centralName), path)
+	if err != nil {
+		cfg.t.Fatalf("could not restore: %v", err)
+	}
+	cfg.central = central
+	for i := 0; i < cfg.n; i++ {
+		cfg.mems[i] = makeLocalMemory()
+		transport := MakeLabrpcTransport(cfg.net, clientName(i))
+		cfg.clients[i] = MakeClient([]string{centralName}, i, SequentialConsistency, transport, cfg.mems[i])
+	}
+	cfg.start = time.Now()
+	cfg.waitReady()
+}
+
+func (cfg *config) cleanup() {
+	if cfg.central != nil {
+		cfg.central.Kill()
+	}
+	for _, c := range cfg.replicas {
+		c.Kill()
+	}
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].Kill()
+	}
+	cfg.net.Cleanup()
+}
+
+// read the byte at addr on client i, faulting it in if needed.
+func (cfg *config) read(i int, addr uintptr) byte {
+	buf := make([]byte, 1)
+	for !cfg.mems[i].Load(addr, buf) {
+		if cfg.clients[i].killed() {
+			cfg.t.Fatalf("client %v is dead", i)
+		}
+		cfg.clients[i].fault(addr)
+	}
+	return buf[0]
+}
+
+// write the byte at addr on client i, faulting it in if needed.
+func (cfg *config) write(i int, addr uintptr, v byte) {
+	for !cfg.mems[i].Store(addr, []byte{v}) {
+		if cfg.clients[i].killed() {
+			cfg.t.Fatalf("client %v is dead", i)
+		}
+		cfg.clients[i].fault(addr)
+	}
+}
+
+// check that every client reads v at addr.
+func (cfg *config) checkAll(addr uintptr, v byte) {
+	for i := 0; i < cfg.n; i++ {
+		if x := cfg.read(i, addr); x != v {
+			cfg.t.Fatalf("client %v read %v at %v; expected %v", i, x, addr, v)
+		}
+	}
+}
+
+func (cfg *config) rpcTotal() int {
+	return cfg.net.GetTotalCount()
+}
+
+// start a Test.
+// print the Test message.
+// e.g. cfg.begin("Test: concurrent writers")
+func (cfg *config) begin(description string) {
+	fmt.Printf("%s ...\n", description)
+	cfg.t0 = time.Now()
+	cfg.rpcs0 = cfg.rpcTotal()
+}
+
+// end a Test -- the fact that we got here means there
+// was no failure.
+// print the Passed message,
+// and some performance numbers.
+func (cfg *config) end() {
+	if cfg.t.Failed() == false {
+		t := time.Since(cfg.t0).Seconds()  // real time
+		npeers := cfg.n                    // number of clients
+		nrpc := cfg.rpcTotal() - cfg.rpcs0 // number of RPC sends
+
+		fmt.Printf("  ... Passed --")
+		fmt.Printf("  %4.1f  %d %4d\n", t, npeers, nrpc)
+	}
+}
@@ -1,3 +1,4 @@
+#define _GNU_SOURCE // for memfd_create
 #include <stdlib.h>
 #include <stdio.h>
 #include <errno.h>
@@ -20,6 +21,11 @@
 // Returns an aligned value.
 char* p;
 
+// a second mapping of the same memory as p, always readable and
+// writable, so that the DSM can copy a page out without changing what
+// local threads may do with it.
+static char *shadow;
+
 void *align_down(void *addr) {
     return (void *)((uintptr_t)addr & ~(PAGE_SIZE - 1));
 }
@@ -37,7 +43,7 @@ handle_sigsegv(int sig, siginfo_t *info, void *ctx)
     pg = (uintptr_t)align_down((void *) info->si_addr);
     unsigned long pte;
 
-    if (mincore((void *)pg, PAGE_SIZE, (char *)&pte) == -1) {
+    if (mincore((void *)pg, PAGE_SIZE, (unsigned char *)&pte) == -1) {
         perror("mincore");
         return;
     }
@@ -73,12 +79,211 @@ void setup_handler() {
     }
 }
 
+// under release consistency, writes become visible to other clients
+// when the writer releases and the reader acquires. both do nothing
+// under sequential consistency.
+void dsm_acquire(void) {
+    DsmAcquire();
+}
+
+void dsm_release(void) {
+    DsmRelease();
+}
+
+// locks are shared by all clients, and acquiring one also does a
+// dsm_acquire(), and releasing one a dsm_release().
+void dsm_lock_acquire(int id) {
+    DsmLockAcquire(id);
+}
+
+void dsm_lock_release(int id) {
+    DsmLockRelease(id);
+}
+
+// bind the pages that hold len bytes at addr to lock, which then
+// carries them from holder to holder: acquiring the lock brings in
+// their latest contents, and only its holder may write them. returns
+// -1 unless the DSM runs sequential consistency with a central manager.
+int dsm_bind(int lock, void *addr, size_t len) {
+    return DsmBind(lock, (char *)addr - p, len);
+}
+
+// condition variables are shared by all clients. dsm_cond_wait
+// releases lock, which the caller holds, sleeps until another client
+// signals cond, and acquires lock again. a woken client should check
+// what it waited for again.
+void dsm_cond_wait(int cond, int lock) {
+    DsmCondWait(cond, lock);
+}
+
+void dsm_cond_signal(int cond) {
+    DsmCondSignal(cond);
+}
+
+void dsm_cond_broadcast(int cond) {
+    DsmCondBroadcast(cond);
+}
+
+// counting semaphores are shared by all clients, and start at 0 unless
+// a client calls dsm_sem_init before anyone uses them. waiting also
+// does a dsm_acquire(), and posting a dsm_release().
+void dsm_sem_init(int id, int value) {
+    DsmSemInit(id, value);
+}
+
+void dsm_sem_wait(int id) {
+    DsmSemWait(id);
+}
+
+void dsm_sem_post(int id) {
+    DsmSemPost(id);
+}
+
+// reader-writer locks are shared by all clients: any number may hold
+// one for reading, or one client for writing. who goes first when both
+// wait is the DSM's -rwpolicy. taking a lock for writing also does a
+// dsm_acquire(), and releasing it a dsm_release().
+void dsm_rwlock_rdlock(int id) {
+    DsmRWLockRead(id);
+}
+
+void dsm_rwlock_rdunlock(int id) {
+    DsmRWLockReadUnlock(id);
+}
+
+void dsm_rwlock_wrlock(int id) {
+    DsmRWLockWrite(id);
+}
+
+void dsm_rwlock_wrunlock(int id) {
+    DsmRWLockWriteUnlock(id);
+}
+
+// the lock protects len bytes at addr: under sequential consistency,
+// a reader gets read-only copies of their pages with the lock.
+void dsm_rwlock_protect(int id, void *addr, size_t len) {
+    DsmRWLockProtect(id, (char *)addr - p, len);
+}
+
+// atomic operations on aligned 32- and 64-bit words of the region,
+// done by the page's manager, so they are atomic across every client.
+// each returns the word's old value; a compare-and-swap succeeded if
+// that is expected. dsm_fetch_add, dsm_cas and dsm_swap pick the size
+// from the type of addr.
+int32_t dsm_fetch_add32(int32_t *addr, int32_t delta) {
+    return (int32_t)DsmAtomic((char *)addr - p, 4, 0, (uint32_t)delta, 0);
+}
+
+int64_t dsm_fetch_add64(int64_t *addr, int64_t delta) {
+    return (int64_t)DsmAtomic((char *)addr - p, 8, 0, (uint64_t)delta, 0);
+}
+
+int32_t dsm_cas32(int32_t *addr, int32_t expected, int32_t desired) {
+    return (int32_t)DsmAtomic((char *)addr - p, 4, 1, (uint32_t)desired, (uint32_t)expected);
+}
+
+int64_t dsm_cas64(int64_t *addr, int64_t expected, int64_t desired) {
+    return (int64_t)DsmAtomic((char *)addr - p, 8, 1, (uint64_t)desired, (uint64_t)expected);
+}
+
+int32_t dsm_swap32(int32_t *addr, int32_t value) {
+    return (int32_t)DsmAtomic((char *)addr - p, 4, 2, (uint32_t)value, 0);
+}
+
+int64_t dsm_swap64(int64_t *addr, int64_t value) {
+    return (int64_t)DsmAtomic((char *)addr - p, 8, 2, (uint64_t)value, 0);
+}
+
+// wait for every client to reach barrier id. a barrier also releases
+// this client's writes and acquires everyone else's.
+void dsm_barrier(int id) {
+    DsmBarrier(id);
+}
+
+// tell the DSM how len bytes at addr will be read, as madvise does:
+// DSM_ADV_SEQUENTIAL prefetches the pages after each read fault,
+// DSM_ADV_RANDOM never prefetches, DSM_ADV_WILLNEED prefetches the
+// range now, and DSM_ADV_NORMAL prefetches when read faults follow a
+// steady stride. prefetching needs sequential consistency and a
+// central or fixed manager.
+void dsm_advise(void *addr, size_t len, int advice) {
+    DsmAdvise((char *)addr - p, len, advice);
+}
+
+// allocate size bytes of the shared region, or return NULL if it is
+// full. every client that allocates the same name gets the same
+// pointer; name may be NULL for an allocation of its own. with
+// DSM_PAGE_ALIGNED in flags, the allocation shares no page with any
+// other.
+void *dsm_malloc(const char *name, size_t size, int flags) {
+    long offset = DsmMalloc((char *)name, size, flags & DSM_PAGE_ALIGNED);
+    if (offset < 0) {
+        return NULL;
+    }
+    return p + offset;
+}
+
+void dsm_free(void *ptr) {
+    DsmFree((char *)ptr - p);
+}
+
+// open the segment called name, creating it with size bytes if there
+// is no such segment. a size of 0 only opens an existing segment.
+// returns NULL if the segment doesn't exist, or is smaller than size,
+// or there is no room for it.
+void *dsm_segment_open(const char *name, size_t size) {
+    return dsm_segment_open_blocks(name, size, 0);
+}
+
+// dsm_segment_open, asking for a segment whose unit of coherence is
+// block_size bytes, a whole number of pages, if it creates one. the
+// central's configuration for name takes precedence.
+void *dsm_segment_open_blocks(const char *name, size_t size, size_t block_size) {
+    return dsm_segment_open_with(name, size, block_size, 0);
+}
+
+// dsm_segment_open_blocks, with flags for a segment it creates: with
+// DSM_WRITE_UPDATE, writes to the segment patch the other clients'
+// copies at the writer's next release or dsm_flush(), instead of
+// invalidating them.
+void *dsm_segment_open_with(const char *name, size_t size, size_t block_size, int flags) {
+    long offset = DsmSegmentOpen((char *)name, size, block_size, flags & DSM_WRITE_UPDATE);
+    if (offset < 0) {
+        return NULL;
+    }
+    return p + offset;
+}
+
+// send this client's writes to write-update segments to every client
+// with a copy.
+void dsm_flush(void) {
+    DsmFlush();
+}
+
+void dsm_segment_close(void *base) {
+    DsmSegmentClose((char *)base - p);
+}
+
+// remove the name of a segment. its pages are freed once every client
+// that has it open closes it.
+int dsm_segment_destroy(const char *name) {
+    return DsmSegmentDestroy((char *)name);
+}
+
 void create_pages(int num_pages) {
-    p = mmap(NULL, num_pages * PAGE_SIZE, PROT_NONE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
-    if (p == MAP_FAILED) {
+    size_t size = (size_t)num_pages * PAGE_SIZE;
+    int fd = memfd_create("dsm", 0);
+    if (fd == -1 || ftruncate(fd, size) == -1) {
+        fprintf(stderr, "Couldn't create shared memory; %s\n", strerror(errno));
+        exit(EXIT_FAILURE);
+    }
+    p = mmap(NULL, size, PROT_NONE, MAP_SHARED, fd, 0);
+    shadow = mmap(NULL, size, PROT_READ | PROT_WRITE, MAP_SHARED, fd, 0);
+    if (p == MAP_FAILED || shadow == MAP_FAILED) {
         fprintf(stderr, "Couldn't mmap memory; %s\n", strerror(errno));
         exit(EXIT_FAILURE);
     }
+    close(fd);
 }
 
 void
@@ -267,9 +472,10 @@ void change_access(uintptr_t addr, int NEW_PROT) {
     mprotect((void *)p + addr, PAGE_SIZE, NEW_PROT);
 }
 
+// copy a page out through the shadow mapping, whatever its access.
 void *get_page(uintptr_t addr) {
-    void *page_start = get_pa((void *)addr);
-    printf("Getting page %p: %d\n", page_start, *(int *)page_start);
+    void *page_start = shadow + addr;
+    printf("Getting page %p: %d\n", get_pa((void *)addr), *(int *)page_start);
 
     // Allocate memory to hold the page copy
     void *page_copy = malloc(PAGE_SIZE);
@@ -284,6 +490,46 @@ void *get_page(uintptr_t addr) {
     return page_copy;
 }
 
+// copy n bytes out of and into the region, faulting like any other
+// access. for Go code, which can't touch the region itself.
+void dsm_read(uintptr_t addr, void *buf, size_t n) {
+    memcpy(buf, p + addr, n);
+}
+
+void dsm_write(uintptr_t addr, const void *buf, size_t n) {
+    memcpy(p + addr, buf, n);
+}
+
+// do an atomic operation for the page's manager on a page this client
+// owns writable, atomically with respect to this client's threads. op
+// is 0 for fetch-and-add, 1 for compare-and-swap and 2 for swap.
+uint64_t local_atomic(uintptr_t addr, int size, int op, uint64_t operand, uint64_t expected) {
+    if (size == 4) {
+        uint32_t *w = (uint32_t *)(p + addr);
+        uint32_t old = (uint32_t)expected;
+        switch (op) {
+        case 0:
+            return __atomic_fetch_add(w, (uint32_t)operand, __ATOMIC_SEQ_CST);
+        case 1:
+            __atomic_compare_exchange_n(w, &old, (uint32_t)operand, false, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST);
+            return old;
+        default:
+            return __atomic_exchange_n(w, (uint32_t)operand, __ATOMIC_SEQ_CST);
+        }
+    }
+    uint64_t *w = (uint64_t *)(p + addr);
+    uint64_t old = expected;
+    switch (op) {
+    case 0:
+        return __atomic_fetch_add(w, operand, __ATOMIC_SEQ_CST);
+    case 1:
+        __atomic_compare_exchange_n(w, &old, operand, false, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST);
+        return old;
+    default:
+        return __atomic_exchange_n(w, operand, __ATOMIC_SEQ_CST);
+    }
+}
+
 void set_page(uintptr_t addr, void *data) {
     void *page_start = get_pa((void *)addr);
     printf("Setting page %p\n", page_start);
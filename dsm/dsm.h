@@ -3,6 +3,7 @@
 #include <stdint.h>
 #include <stdbool.h>
 #include <signal.h>
+#include <stddef.h>
 #define PAGE_SIZE sysconf(_SC_PAGESIZE)
 
 extern char *p;
@@ -10,6 +11,9 @@ void create_pages(int num_pages);
 void change_access(uintptr_t addr, int NEW_PROT);
 void *get_page(uintptr_t addr);
 void set_page(uintptr_t addr, void *page_copy);
+void dsm_read(uintptr_t addr, void *buf, size_t n);
+void dsm_write(uintptr_t addr, const void *buf, size_t n);
+uint64_t local_atomic(uintptr_t addr, int size, int op, uint64_t operand, uint64_t expected);
 void setup(int num_pages, int index, int total_servers);
 void test_one_client(int num_pages, int index, int total_servers);
 void test_concurrent_clients(int num_pages, int index, int total_servers);
@@ -29,7 +33,55 @@ void *align_down(void *addr);
 void *get_pa(void *va);
 void setup_handler();
 
+void dsm_acquire(void);
+void dsm_release(void);
+void dsm_lock_acquire(int id);
+void dsm_lock_release(int id);
+int dsm_bind(int lock, void *addr, size_t len);
+void dsm_cond_wait(int cond, int lock);
+void dsm_cond_signal(int cond);
+void dsm_cond_broadcast(int cond);
+void dsm_sem_init(int id, int value);
+void dsm_sem_wait(int id);
+void dsm_sem_post(int id);
+void dsm_rwlock_rdlock(int id);
+void dsm_rwlock_rdunlock(int id);
+void dsm_rwlock_wrlock(int id);
+void dsm_rwlock_wrunlock(int id);
+void dsm_rwlock_protect(int id, void *addr, size_t len);
+
+int32_t dsm_fetch_add32(int32_t *addr, int32_t delta);
+int64_t dsm_fetch_add64(int64_t *addr, int64_t delta);
+int32_t dsm_cas32(int32_t *addr, int32_t expected, int32_t desired);
+int64_t dsm_cas64(int64_t *addr, int64_t expected, int64_t desired);
+int32_t dsm_swap32(int32_t *addr, int32_t value);
+int64_t dsm_swap64(int64_t *addr, int64_t value);
+#define dsm_fetch_add(addr, delta) _Generic(*(addr), int64_t: dsm_fetch_add64, uint64_t: dsm_fetch_add64, default: dsm_fetch_add32)((void *)(addr), (delta))
+#define dsm_cas(addr, expected, desired) _Generic(*(addr), int64_t: dsm_cas64, uint64_t: dsm_cas64, default: dsm_cas32)((void *)(addr), (expected), (desired))
+#define dsm_swap(addr, value) _Generic(*(addr), int64_t: dsm_swap64, uint64_t: dsm_swap64, default: dsm_swap32)((void *)(addr), (value))
+void dsm_barrier(int id);
+
+#define DSM_ADV_NORMAL 0
+#define DSM_ADV_SEQUENTIAL 1
+#define DSM_ADV_RANDOM 2
+#define DSM_ADV_WILLNEED 3
+void dsm_advise(void *addr, size_t len, int advice);
+
+#define DSM_PAGE_ALIGNED 1
+void *dsm_malloc(const char *name, size_t size, int flags);
+void dsm_free(void *ptr);
+
+void *dsm_segment_open(const char *name, size_t size);
+void *dsm_segment_open_blocks(const char *name, size_t size, size_t block_size);
+#define DSM_WRITE_UPDATE 1
+void *dsm_segment_open_with(const char *name, size_t size, size_t block_size, int flags);
+void dsm_flush(void);
+void dsm_segment_close(void *base);
+int dsm_segment_destroy(const char *name);
+
+void alloc_matrices();
 void setup_matmul(int num_pages, int index, int total_servers);
 void multiply_matrices(int index, int total_servers);
+int verify_matmul();
 void print_matrix(int row, int col, int* matrix);
 #endif
\ No newline at end of file
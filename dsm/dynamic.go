@@ -0,0 +1,238 @@
+package dsm
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The dynamic distributed manager of IVY. There is no manager at
+// all: the owner of a page keeps its copyset, and every client keeps
+// a probable owner for each page, a hint that leads to the true owner
+// by way of clients that used to own it. A faulting client follows
+// the hints until it reaches the owner, which shares the page with a
+// reader or hands the page and its copyset over to a writer.
+//
+// A hint only changes when the page really moves, so following a
+// chain of hints always leads to a later owner. IVY also points a
+// client's hint at any writer whose request it forwards, but then a
+// writer that has to start its search over can find the hints
+// leading back to itself.
+//
+// Every page starts out owned by its home client, with no data.
+
+// a page's state at one client.
+type dynPage struct {
+	mu          sync.Mutex
+	fault       sync.Mutex // serializes this client's faults on the page
+	owner       bool
+	probOwner   string
+	copyset     map[int]bool
+	access      int
+	invalidated bool // an invalidation arrived during a read fault
+	served      map[int]servedRequest
+}
+
+// the last request an owner served for a client, so that a client
+// that lost the reply gets the same one again, and a late duplicate
+// can't take the page a second time.
+type servedRequest struct {
+	seq   int64
+	reply OwnerReply
+}
+
+// the client that owns addr before anyone has faulted on it.
+func (c *Client) home(addr uintptr) int {
+	return int(addr/uintptr(PageSize)) % len(c.peers)
+}
+
+func (c *Client) page(addr uintptr) *dynPage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pg, ok := c.pages[addr]
+	if !ok {
+		pg = &dynPage{}
+		pg.probOwner = c.peers[c.home(addr)]
+		pg.owner = c.home(addr) == c.id
+		pg.copyset = make(map[int]bool)
+		pg.served = make(map[int]servedRequest)
+		c.pages[addr] = pg
+	}
+	return pg
+}
+
+// dynamicFault gets access to addr, following probable owners to the
+// page's owner.
+func (c *Client) dynamicFault(addr uintptr, access int) {
+	pg := c.page(addr)
+	pg.fault.Lock()
+	defer pg.fault.Unlock()
+	me := c.peers[c.id]
+
+	for !c.killed() {
+		pg.mu.Lock()
+		if pg.access >= access {
+			pg.mu.Unlock()
+			return
+		}
+		if pg.owner {
+			c.ownerFault(pg, addr, access)
+			pg.mu.Unlock()
+			return
+		}
+		pg.invalidated = false
+		target := pg.probOwner
+		pg.mu.Unlock()
+
+		args := &ReadWriteArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Addr: addr, Access: access}
+		reply := &OwnerReply{}
+		for hops := 0; !c.killed(); hops++ {
+			*reply = OwnerReply{}
+			if !c.transport.Call(target, "Client.HandleOwnerRequest", args, reply) {
+				// ask the same client again, since it may have
+				// served us and lost the reply.
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if reply.Err != ErrNotOwner {
+				break
+			}
+			if reply.Forward == me {
+				// a hint left over from when we owned the page.
+				// the page is moving, so start over.
+				break
+			}
+			target = reply.Forward
+			if hops > len(c.peers) {
+				// the page is in flight between clients
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if reply.Err != OK {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		pg.mu.Lock()
+		if access == 1 {
+			if pg.invalidated {
+				// our copy may be older than the write that
+				// invalidated it
+				pg.mu.Unlock()
+				continue
+			}
+			c.mem.SetPage(addr, reply.Data)
+			c.setAccess(pg, addr, 1)
+			pg.probOwner = target
+		} else {
+			log.Println("took ownership of", addr, "from", target)
+			c.mem.SetPage(addr, reply.Data)
+			pg.owner = true
+			pg.probOwner = me
+			pg.copyset = reply.Copyset
+			if pg.copyset == nil {
+				pg.copyset = make(map[int]bool)
+			}
+			c.invalidateCopyset(pg, addr)
+			c.setAccess(pg, addr, 2)
+		}
+		pg.mu.Unlock()
+		return
+	}
+}
+
+// ownerFault handles a fault on a page that we own, invalidating
+// the readers' copies before we write. pg.mu must be held.
+func (c *Client) ownerFault(pg *dynPage, addr uintptr, access int) {
+	if pg.access == 0 {
+		c.mem.SetPage(addr, nil)
+	}
+	if access == 2 {
+		c.invalidateCopyset(pg, addr)
+	}
+	c.setAccess(pg, addr, access)
+}
+
+// invalidateCopyset is the only place a client makes RPCs while
+// holding a page's lock. Only the owner does it, and no client
+// makes RPCs while handling an invalidation, so this can't deadlock.
+func (c *Client) invalidateCopyset(pg *dynPage, addr uintptr) {
+	var wg sync.WaitGroup
+	for clientID := range pg.copyset {
+		if clientID == c.id {
+			continue
+		}
+		wg.Add(1)
+		go func(clientID int) {
+			defer wg.Done()
+			args := &InvalidateArgs{Addr: addr, NewAccess: 0, Owner: c.peers[c.id]}
+			ok := c.transport.Call(c.peers[clientID], "Client.HandleInvalidate", args, &InvalidateReply{})
+			for !ok && !c.killed() {
+				ok = c.transport.Call(c.peers[clientID], "Client.HandleInvalidate", args, &InvalidateReply{})
+			}
+		}(clientID)
+	}
+	wg.Wait()
+	pg.copyset = make(map[int]bool)
+}
+
+func (c *Client) setAccess(pg *dynPage, addr uintptr, access int) {
+	pg.access = access
+	c.mem.ChangeAccess(addr, access)
+}
+
+func (c *Client) HandleOwnerRequest(args *ReadWriteArgs, reply *OwnerReply) error {
+	pg := c.page(args.Addr)
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if s, ok := pg.served[args.ClientID]; ok && s.seq >= args.Seq {
+		if s.seq == args.Seq {
+			*reply = s.reply
+		} else {
+			reply.Err = ErrStale
+		}
+		return nil
+	}
+	if !pg.owner {
+		reply.Err = ErrNotOwner
+		reply.Forward = pg.probOwner
+		return nil
+	}
+
+	log.Println("owner handling request", args.Addr, args.Access, "from", args.ClientID)
+	if pg.access == 2 {
+		c.setAccess(pg, args.Addr, 1)
+	}
+	if pg.access >= 1 {
+		reply.Data = c.mem.GetPage(args.Addr)
+	}
+	if args.Access == 1 {
+		pg.copyset[args.ClientID] = true
+	} else {
+		reply.Copyset = pg.copyset
+		pg.owner = false
+		pg.probOwner = c.peers[args.ClientID]
+		pg.copyset = make(map[int]bool)
+		c.setAccess(pg, args.Addr, 0)
+	}
+	reply.Err = OK
+	pg.served[args.ClientID] = servedRequest{seq: args.Seq, reply: *reply}
+	return nil
+}
+
+func (c *Client) HandleInvalidate(args *InvalidateArgs, reply *InvalidateReply) error {
+	pg := c.page(args.Addr)
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.owner {
+		// a late duplicate from a previous owner
+		reply.Err = OK
+		return nil
+	}
+	c.setAccess(pg, args.Addr, 0)
+	pg.invalidated = true
+	pg.probOwner = args.Owner
+	reply.Err = OK
+	return nil
+}
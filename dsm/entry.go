@@ -0,0 +1,269 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Entry consistency, after Midway, under sequential consistency with
+// the central manager. A program binds a range of pages to a DSM lock,
+// and from then on the pages stay out of the page tables: the central
+// keeps their master copies, and the lock carries them. Acquiring the
+// lock brings in the pages that changed since this client last held
+// it, writable; releasing it sends the central diffs of what this
+// client wrote, and drops the pages. So a client that works on bound
+// data under its lock never faults on it and never invalidates anyone.
+//
+// Outside the lock, a read of bound data gets the master copy as it
+// was at the last release, and a write is a bug in the program. The
+// central keeps such readers in the page's copyset, under a lease, and
+// a release that changes the page invalidates their copies before it
+// takes effect.
+
+type BoundPage struct {
+	Addr    uintptr
+	Version int
+	Data    []byte // nil if the acquirer's copy is current
+}
+
+func (c *Central) Bind(args *BindArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	var pages []uintptr
+	for pg := pageOf(args.Addr); pg < args.Addr+args.Size; pg += uintptr(PageSize) {
+		if _, ok := c.locks[pg]; ok {
+			pages = append(pages, pg)
+		}
+	}
+	// no fault on the pages while we take them out of the tables
+	for _, pg := range pages {
+		c.locks[pg].Lock()
+		defer c.locks[pg].Unlock()
+	}
+	data := make(map[uintptr][]byte)
+	for _, pg := range pages {
+		page, err := c.invalidateCaches(pg, -1)
+		if err != OK {
+			reply.Err = err
+			return nil
+		}
+		if _, found := c.getOwner(pg); !found {
+			page = c.homePage(pg)
+		}
+		data[pg] = page
+	}
+	reply.Err = c.commit(Op{Type: opBind, ClientID: args.ClientID, ReqSeq: args.Seq, ID: args.LockID, Pages: data})
+	return nil
+}
+
+// ReadBound gives a client that faulted on a bound page without its
+// lock the master copy, and makes it a reader of the page.
+func (c *Central) ReadBound(args *ReadWriteArgs, reply *BoundReadReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	// no release changes the page until the reader is in its copyset
+	if l, ok := c.locks[args.Addr]; ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+	if err := c.commit(Op{Type: opAddCopyset, ClientID: args.ClientID, Addr: args.Addr}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	c.mu.Lock()
+	reply.Data = append([]byte(nil), c.pages[args.Addr]...)
+	c.mu.Unlock()
+	reply.Lease = c.grantLease(args.Addr, args.ClientID)
+	reply.Err = OK
+	return nil
+}
+
+// lock the bound pages that a release's diffs change, and invalidate
+// the copies that clients read outside the lock. the caller unlocks
+// the pages it returns once the release is applied.
+func (c *Central) invalidateBoundReaders(diffs map[uintptr][]DiffRun) []uintptr {
+	var pages []uintptr
+	for pg := range diffs {
+		if _, ok := c.locks[pg]; ok {
+			pages = append(pages, pg)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	for _, pg := range pages {
+		c.locks[pg].Lock()
+	}
+	for _, pg := range pages {
+		c.mu.Lock()
+		var readers []int
+		for clientID := range c.copyset[pg] {
+			readers = append(readers, clientID)
+		}
+		c.mu.Unlock()
+		for _, clientID := range readers {
+			c.makeInvalidCopyset(pg, clientID)
+		}
+	}
+	return pages
+}
+
+// bind the pages of op.Pages to lock op.ID, with op.Pages as their
+// master copies, unless the bind is a retry. c.mu must be held.
+func (c *Central) applyBind(op Op) {
+	if !firstApply(c.binds, op.ClientID, op.ReqSeq) {
+		return
+	}
+	for pg, page := range op.Pages {
+		delete(c.owner, pg)
+		delete(c.copyset, pg)
+		if page != nil {
+			c.pages[pg] = page
+		}
+		c.bound[pg] = op.ID
+		c.versions[pg]++
+	}
+}
+
+// whether the page at addr is bound to a lock. c.mu must be held.
+func (c *Central) isBound(addr uintptr) bool {
+	_, ok := c.bound[addr]
+	return ok
+}
+
+// the pages bound to lock id, with the data of those that the
+// acquirer, whose copies have versions, lacks. c.mu must be held.
+func (c *Central) boundPages(id int, versions map[uintptr]int) []BoundPage {
+	var bound []BoundPage
+	for pg, lockID := range c.bound {
+		if lockID != id {
+			continue
+		}
+		b := BoundPage{Addr: pg, Version: c.versions[pg]}
+		if v, ok := versions[pg]; !ok || v != b.Version {
+			b.Data = make([]byte, PageSize)
+			copy(b.Data, c.pages[pg])
+		}
+		bound = append(bound, b)
+	}
+	sort.Slice(bound, func(i, j int) bool { return bound[i].Addr < bound[j].Addr })
+	return bound
+}
+
+// merge the diffs a releasing holder sent of the pages bound to its
+// lock. c.mu must be held.
+func (c *Central) applyBoundDiffs(op Op) {
+	for pg, diff := range op.Diffs {
+		if c.bound[pg] != op.ID {
+			continue
+		}
+		page, ok := c.pages[pg]
+		if !ok {
+			page = make([]byte, PageSize)
+			c.pages[pg] = page
+		}
+		applyDiff(page, diff)
+		c.versions[pg]++
+	}
+}
+
+// Bind binds the pages that hold the size bytes at addr to lock id,
+// which from then on carries their contents from holder to holder. It
+// needs sequential consistency and the central manager.
+func (c *Client) Bind(id int, addr uintptr, size int) bool {
+	if c.protocol != SequentialConsistency || c.manager != CentralManager {
+		log.Println("entry consistency needs sequential consistency and a central manager")
+		return false
+	}
+	reply := &Reply{}
+	args := &BindArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Addr: addr, Size: uintptr(size)}
+	c.callCentral("Central.Bind", args, reply)
+	return reply.Err == OK
+}
+
+// the versions of the bound pages this client has copies of.
+func (c *Client) boundVersions() map[uintptr]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := make(map[uintptr]int)
+	for pg, v := range c.ecVersions {
+		versions[pg] = v
+	}
+	return versions
+}
+
+// install the pages bound to lock id that came with it, writable, and
+// twin them.
+func (c *Client) installBound(id int, bound []BoundPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pages []uintptr
+	for _, b := range bound {
+		if b.Data != nil {
+			c.bumpEpoch(b.Addr)
+			c.mem.SetPage(b.Addr, b.Data)
+		}
+		c.ecVersions[b.Addr] = b.Version
+		// a copy read outside the lock is ours to write now
+		c.leaseGen[b.Addr]++
+		c.ecTwins[b.Addr] = c.mem.GetPage(b.Addr)
+		c.mem.ChangeAccess(b.Addr, 2)
+		pages = append(pages, b.Addr)
+	}
+	c.ecHeld[id] = pages
+}
+
+// drop the pages bound to lock id, returning diffs of what this client
+// wrote to them.
+func (c *Client) releaseBound(id int) map[uintptr][]DiffRun {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var diffs map[uintptr][]DiffRun
+	for _, pg := range c.ecHeld[id] {
+		diff := makeDiff(c.ecTwins[pg], c.mem.GetPage(pg))
+		c.mem.ChangeAccess(pg, 0)
+		delete(c.ecTwins, pg)
+		if len(diff) == 0 {
+			continue
+		}
+		if diffs == nil {
+			diffs = make(map[uintptr][]DiffRun)
+		}
+		diffs[pg] = diff
+		// the central's copy will be ours
+		c.ecVersions[pg]++
+	}
+	delete(c.ecHeld, id)
+	return diffs
+}
+
+// a fault on a bound page without its lock: a read gets the master
+// copy, read-only until the next release that changes it, and a write
+// is fatal.
+func (c *Client) boundFault(addr uintptr, access int) {
+	if access == 2 {
+		log.Fatalf("dsm: write to page %v, which is bound to a lock this client doesn't hold", addr)
+	}
+	c.mu.Lock()
+	epoch := c.epochs[addr]
+	c.mu.Unlock()
+	start := time.Now()
+	reply := &BoundReadReply{}
+	c.callCentral("Central.ReadBound", &ReadWriteArgs{ClientID: c.id, Addr: addr, Access: 1}, reply)
+	c.mu.Lock()
+	installed := c.epochs[addr] == epoch
+	if installed {
+		// no release has invalidated the copy on its way here
+		c.bumpEpoch(addr)
+		c.mem.SetPage(addr, reply.Data)
+		c.mem.ChangeAccess(addr, 1)
+	}
+	c.mu.Unlock()
+	if installed {
+		c.holdLease(addr, start, reply.Lease)
+	}
+}
@@ -0,0 +1,269 @@
+package dsm
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/6.5840-dsm/labgob"
+)
+
+// Failure detection. The leader of the central pings every
+// registered client, and declares a client dead once it has gone
+// failureTimeout without an answer. A dead client is taken out of
+// every copyset, lock queue, barrier and segment, and each page it
+// owned goes to a client with a read-only copy of it if there is
+// one. Otherwise the page falls back to the central's copy from the
+// last checkpoint, or if there is none, its contents are lost. A page
+// whose data a write fault has already taken from the dead client is
+// left for the writer, which becomes its owner when it confirms.
+//
+// A dead client stays dead: the central refuses its faults, and it
+// kills itself when it hears so.
+
+const (
+	heartbeatInterval = 100 * time.Millisecond
+	failureTimeout    = 3 * time.Second
+)
+
+func (c *Client) Heartbeat(args *Args, reply *Reply) error {
+	if !c.killed() {
+		reply.Err = OK
+	}
+	return nil
+}
+
+func (c *Central) isDead(clientID int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadClients[clientID]
+}
+
+// whether the client at addr has been declared dead.
+func (c *Central) isDeadAddr(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, a := range c.clients {
+		if a == addr {
+			return c.deadClients[id]
+		}
+	}
+	return false
+}
+
+// the number of clients that are not dead. c.mu must be held.
+func (c *Central) liveClients() int {
+	return len(c.clients) - len(c.deadClients)
+}
+
+func (c *Central) failureDetector() {
+	for !c.killed() {
+		time.Sleep(heartbeatInterval)
+		if !c.isLeader() {
+			// a new leader gives every client a fresh timeout
+			c.mu.Lock()
+			c.lastHeard = make(map[int]time.Time)
+			c.mu.Unlock()
+			continue
+		}
+		c.mu.Lock()
+		var dead []int
+		for id := range c.register {
+			if c.deadClients[id] {
+				continue
+			}
+			last, ok := c.lastHeard[id]
+			if !ok {
+				last = time.Now()
+				c.lastHeard[id] = last
+			}
+			if time.Since(last) > failureTimeout {
+				dead = append(dead, id)
+			} else {
+				// don't wait for the last ping, which may just
+				// be slow
+				go c.ping(id)
+			}
+		}
+		c.mu.Unlock()
+		for _, id := range dead {
+			c.declareDead(id)
+		}
+	}
+}
+
+// ClientDead tells a client whether another has been declared dead.
+func (c *Central) ClientDead(args *DeadArgs, reply *DeadReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Dead = c.isDead(args.ClientID)
+	reply.Err = OK
+	return nil
+}
+
+// whether the central that keeps the intervals has declared client
+// id dead.
+func (c *Client) isDead(id int) bool {
+	reply := &DeadReply{}
+	c.callManagerAt(c.syncManager(0), "Central.ClientDead", &DeadArgs{ClientID: id}, reply)
+	return reply.Dead
+}
+
+func (c *Central) ping(clientID int) {
+	reply := &Reply{}
+	ok := c.transport.Call(c.clientAddr(clientID), "Client.Heartbeat", &Args{}, reply)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok && reply.Err == OK {
+		c.lastHeard[clientID] = time.Now()
+	}
+}
+
+// declare a client dead, and release the faults it left half done.
+func (c *Central) declareDead(clientID int) {
+	log.Println("client", clientID, "is dead")
+	c.mu.Lock()
+	var held []uintptr
+	for addr, f := range c.inflight {
+		if f.clientID != clientID && f.access == 2 {
+			held = append(held, addr)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+	if err := c.commit(Op{Type: opClientDead, ClientID: clientID, Pages: c.checkpointedPages(clientID), Held: held}); err != OK {
+		return
+	}
+	c.mu.Lock()
+	fs := make(map[uintptr]*inflight)
+	for addr, f := range c.inflight {
+		if f.clientID == clientID {
+			fs[addr] = f
+		}
+	}
+	c.mu.Unlock()
+	for addr, f := range fs {
+		c.release(addr, f)
+	}
+}
+
+// the last checkpoint's copies of the pages that clientID owns.
+func (c *Central) checkpointedPages(clientID int) map[uintptr][]byte {
+	c.mu.Lock()
+	path := c.checkpointPath
+	me := c.clients[clientID]
+	var owned []uintptr
+	for addr, o := range c.owner {
+		if o.OwnerAddr == me {
+			owned = append(owned, addr)
+		}
+	}
+	c.mu.Unlock()
+	if path == "" || len(owned) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("could not read checkpoint:", err)
+		return nil
+	}
+	var cp Checkpoint
+	if err := labgob.NewDecoder(bytes.NewBuffer(data)).Decode(&cp); err != nil {
+		log.Println("could not decode checkpoint:", err)
+		return nil
+	}
+	pages := make(map[uintptr][]byte)
+	for _, addr := range owned {
+		if page, ok := cp.Pages[addr]; ok {
+			pages[addr] = page
+		}
+	}
+	return pages
+}
+
+// take a dead or departing client out of the page tables and
+// everything it was waiting on, recovering its pages from op.Pages
+// where no reader has a copy. c.mu must be held.
+func (c *Central) applyClientDead(op Op) {
+	id := op.ClientID
+	if _, ok := c.clients[id]; !ok || c.deadClients[id] {
+		return
+	}
+	c.deadClients[id] = true
+	me := c.clients[id]
+	held := make(map[uintptr]bool)
+	for _, addr := range op.Held {
+		held[addr] = true
+	}
+
+	for _, set := range c.copyset {
+		delete(set, id)
+	}
+	for addr, o := range c.owner {
+		if o.OwnerAddr != me {
+			continue
+		}
+		if o.AccessType == 0 && held[addr] {
+			// a writer has the page's data already, and becomes
+			// its owner when it confirms
+			continue
+		}
+		var readers []int
+		for reader := range c.copyset[addr] {
+			readers = append(readers, reader)
+		}
+		if len(readers) > 0 {
+			sort.Ints(readers)
+			c.owner[addr] = Owner{OwnerAddr: c.clients[readers[0]], AccessType: 1}
+			delete(c.copyset[addr], readers[0])
+			continue
+		}
+		delete(c.owner, addr)
+		if page, ok := op.Pages[addr]; ok {
+			c.pages[addr] = page
+		} else {
+			log.Println("lost page", addr, "with client", id)
+		}
+	}
+
+	for _, l := range c.lockTable {
+		queue := l.Queue[:0]
+		for _, waiter := range l.Queue {
+			if waiter != id {
+				queue = append(queue, waiter)
+			}
+		}
+		l.Queue = queue
+		if l.Holder == id {
+			l.Holder = -1
+			if len(l.Queue) > 0 {
+				l.Holder = l.Queue[0]
+				l.Queue = l.Queue[1:]
+			}
+		}
+	}
+	for _, l := range c.rwlocks {
+		l.drop(id)
+		l.grant()
+	}
+	for _, cv := range c.conds {
+		cv.Waiting = dropWaiters(cv.Waiting, id)
+	}
+	for _, s := range c.sems {
+		s.Waiting = dropWaiters(s.Waiting, id)
+	}
+	for _, b := range c.barriers {
+		delete(b.Arrived, id)
+		if len(b.Arrived) > 0 && len(b.Arrived) >= c.liveClients() {
+			c.passBarrier(b)
+		}
+	}
+	for _, s := range c.segments {
+		delete(s.Openers, id)
+		c.maybeFreeSegment(s)
+	}
+}
@@ -0,0 +1,342 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Lazy release consistency, after TreadMarks. Each client's execution
+// is divided into intervals at its acquires and releases, and the
+// vector clock of an interval says which intervals of every client
+// came before it. At the end of an interval in which a client wrote,
+// it diffs each page it wrote against the twin it made at its first
+// write, and keeps the diffs itself.
+//
+// Write notices, which name the pages an interval wrote, go to the
+// central with lock releases and barrier arrivals, and come back with
+// lock grants and barrier departures: an acquirer gets the notices of
+// every interval before the release it acquires that it hasn't seen,
+// and invalidates the pages they name. No other client hears of the
+// acquire. When the acquirer next faults on such a page, handleRead
+// or handleWrite fetches the diffs it lacks from their writers and
+// applies them to its copy in an order consistent with their vector
+// clocks. The diffs of a writer that has died are lost.
+//
+// Every lock, reader-writer lock, semaphore and barrier is kept by
+// the central, or by client 0 under distributed managers, so that one
+// place has every interval. On their own, dsm_acquire and dsm_release
+// only end an interval, whose notices go out with the next lock
+// release, semaphore post or barrier.
+//
+// Intervals and diffs are garbage collected at barriers. Every
+// lrcCollectEvery barriers, a client leaving one brings every page it
+// has notices for up to date, after which it needs no diffs of the
+// intervals it has seen. It says so when it next arrives at a barrier,
+// and once every client has, that barrier's departure lets the
+// central drop those intervals and the writers their diffs.
+
+// how many barriers a client passes between bringing all its pages up
+// to date, so that older diffs can be collected.
+const lrcCollectEvery = 4
+
+// The number of intervals of each client that came before, by client
+// id.
+type VectorClock map[int]int
+
+func (vc VectorClock) copy() VectorClock {
+	c := make(VectorClock)
+	for id, n := range vc {
+		c[id] = n
+	}
+	return c
+}
+
+// merge other into vc, keeping the later of each entry.
+func (vc VectorClock) merge(other VectorClock) {
+	for id, n := range other {
+		if n > vc[id] {
+			vc[id] = n
+		}
+	}
+}
+
+// if a came before b, a.sum() < b.sum(), so sorting by sum orders
+// intervals consistently with their clocks.
+func (vc VectorClock) sum() int {
+	s := 0
+	for _, n := range vc {
+		s += n
+	}
+	return s
+}
+
+// meet keeps the earlier of each entry of vc and other, as a clock
+// that came before both.
+func (vc VectorClock) meet(other VectorClock) {
+	for id, n := range vc {
+		if other[id] < n {
+			vc[id] = other[id]
+		}
+	}
+}
+
+// An interval in which a client wrote.
+type Interval struct {
+	Client int
+	Seq    int         // a client's intervals are numbered from 1
+	VC     VectorClock // at the end of the interval
+	Pages  []uintptr   // its write notices: the pages it wrote
+	Addr   string      // the client's, filled in by the central
+}
+
+// record the intervals a client published, unless they are retries.
+// c.mu must be held.
+func (c *Central) addIntervals(intervals []Interval) {
+	for _, iv := range intervals {
+		if iv.Seq != c.collected[iv.Client]+len(c.intervals[iv.Client])+1 {
+			continue
+		}
+		iv.Addr = c.clients[iv.Client]
+		c.intervals[iv.Client] = append(c.intervals[iv.Client], iv)
+	}
+}
+
+// the intervals before vc that a client, whose clock is known, hasn't
+// seen. c.mu must be held.
+func (c *Central) intervalsSince(vc VectorClock, known VectorClock) []Interval {
+	var intervals []Interval
+	for id, n := range vc {
+		base := c.collected[id]
+		from := known[id] + 1
+		if from <= base {
+			// every client has seen these
+			from = base + 1
+		}
+		for s := from; s <= n && s <= base+len(c.intervals[id]); s++ {
+			intervals = append(intervals, c.intervals[id][s-base-1])
+		}
+	}
+	return intervals
+}
+
+// drop the intervals up to vc, which every client has brought its
+// pages up to date with. c.mu must be held.
+func (c *Central) collectIntervals(vc VectorClock) {
+	for id, n := range vc {
+		drop := n - c.collected[id]
+		if drop <= 0 {
+			continue
+		}
+		if drop > len(c.intervals[id]) {
+			drop = len(c.intervals[id])
+		}
+		c.intervals[id] = append([]Interval(nil), c.intervals[id][drop:]...)
+		c.collected[id] += drop
+	}
+}
+
+// end this client's current interval, if it wrote: diff and keep the
+// pages it wrote, and make them read-only so that the next interval
+// twins them afresh. c.rc must be held.
+func (c *Client) endInterval() {
+	if len(c.twins) == 0 {
+		return
+	}
+	diffs := make(map[uintptr][]DiffRun)
+	for addr, twin := range c.twins {
+		c.mem.ChangeAccess(addr, 1)
+		if diff := makeDiff(twin, c.mem.GetPage(addr)); len(diff) > 0 {
+			diffs[addr] = diff
+		}
+		delete(c.twins, addr)
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	c.vc[c.id]++
+	iv := Interval{Client: c.id, Seq: c.vc[c.id], VC: c.vc.copy()}
+	c.mu.Lock()
+	for addr, diff := range diffs {
+		if c.lrcDiffs[addr] == nil {
+			c.lrcDiffs[addr] = make(map[int][]DiffRun)
+		}
+		c.lrcDiffs[addr][iv.Seq] = diff
+		iv.Pages = append(iv.Pages, addr)
+	}
+	c.mu.Unlock()
+	sort.Slice(iv.Pages, func(i, j int) bool { return iv.Pages[i] < iv.Pages[j] })
+	log.Println("ending interval", iv.Seq, "with", len(iv.Pages), "write notices")
+	c.intervals = append(c.intervals, iv)
+}
+
+// this client's clock, to send with an acquire. Under other
+// protocols, nil.
+func (c *Client) clock() VectorClock {
+	if c.protocol != LazyReleaseConsistency {
+		return nil
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	return c.vc.copy()
+}
+
+// the intervals of this client that the central hasn't got, and its
+// clock, to publish with a release. Under other protocols, nil.
+func (c *Client) lrcPublish() ([]Interval, VectorClock) {
+	if c.protocol != LazyReleaseConsistency {
+		return nil, nil
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	c.endInterval()
+	return append([]Interval(nil), c.intervals...), c.vc.copy()
+}
+
+// the central has published intervals, so we needn't keep them.
+func (c *Client) lrcPublished(intervals []Interval) {
+	if len(intervals) == 0 {
+		return
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	n := intervals[len(intervals)-1].Seq
+	kept := c.intervals[:0]
+	for _, iv := range c.intervals {
+		if iv.Seq > n {
+			kept = append(kept, iv)
+		}
+	}
+	c.intervals = kept
+}
+
+// take in the intervals that came with a lock or barrier, whose
+// releases had clock vc, and invalidate the pages they wrote.
+func (c *Client) lrcAcquire(intervals []Interval, vc VectorClock) {
+	if c.protocol != LazyReleaseConsistency {
+		return
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	c.endInterval()
+	for _, iv := range intervals {
+		if iv.Client == c.id || iv.Seq <= c.vc[iv.Client] {
+			continue
+		}
+		for _, pg := range iv.Pages {
+			c.notices[pg] = append(c.notices[pg], iv)
+			c.mem.ChangeAccess(pg, 0)
+		}
+	}
+	c.vc.merge(vc)
+}
+
+// fetch the diffs of addr that the write notices we have for it name,
+// with one request to each writer, and apply them. c.rc must be held.
+func (c *Client) lrcUpdate(addr uintptr) {
+	notices := c.notices[addr]
+	if len(notices) == 0 {
+		return
+	}
+	byWriter := make(map[int][]int)
+	addrs := make(map[int]string)
+	for _, iv := range notices {
+		byWriter[iv.Client] = append(byWriter[iv.Client], iv.Seq)
+		addrs[iv.Client] = iv.Addr
+	}
+	type diffKey struct{ client, seq int }
+	diffs := make(map[diffKey][]DiffRun)
+	for w, seqs := range byWriter {
+		args := &DiffsArgs{Addr: addr, Seqs: seqs}
+		reply := &DiffsReply{}
+		ok := c.transport.Call(addrs[w], "Client.FetchDiffs", args, reply)
+		for !ok && !c.killed() {
+			if c.isDead(w) {
+				log.Println("lost the diffs of", addr, "with client", w)
+				break
+			}
+			log.Println("error could not get diffs from", w)
+			time.Sleep(pollInterval)
+			ok = c.transport.Call(addrs[w], "Client.FetchDiffs", args, reply)
+		}
+		for i, s := range seqs {
+			if i < len(reply.Diffs) {
+				diffs[diffKey{w, s}] = reply.Diffs[i]
+			}
+		}
+	}
+	sort.Slice(notices, func(i, j int) bool {
+		si, sj := notices[i].VC.sum(), notices[j].VC.sum()
+		if si != sj {
+			return si < sj
+		}
+		return notices[i].Client < notices[j].Client
+	})
+	page := c.mem.GetPage(addr)
+	for _, iv := range notices {
+		applyDiff(page, diffs[diffKey{iv.Client, iv.Seq}])
+	}
+	log.Println("applied", len(notices), "diffs to", addr)
+	c.setPage(addr, page)
+	delete(c.notices, addr)
+}
+
+// the clock up to which every page of ours is up to date, to send
+// when arriving at a barrier. Under other protocols, nil.
+func (c *Client) lrcValidated() VectorClock {
+	if c.protocol != LazyReleaseConsistency {
+		return nil
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	return c.validated.copy()
+}
+
+// bring every page we have write notices for up to date, so that we
+// need no diffs of the intervals we have seen. c.rc must be held.
+func (c *Client) lrcValidate() {
+	for addr := range c.notices {
+		c.lrcUpdate(addr)
+		c.mem.ChangeAccess(addr, 1)
+	}
+	c.validated = c.vc.copy()
+}
+
+// after a barrier: drop our diffs of the intervals up to collected,
+// which no client needs any more, and every lrcCollectEvery barriers,
+// bring our pages up to date so that later ones can go too.
+func (c *Client) lrcCollect(collected VectorClock) {
+	if c.protocol != LazyReleaseConsistency {
+		return
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	c.mu.Lock()
+	for addr, diffs := range c.lrcDiffs {
+		for s := range diffs {
+			if s <= collected[c.id] {
+				delete(diffs, s)
+			}
+		}
+		if len(diffs) == 0 {
+			delete(c.lrcDiffs, addr)
+		}
+	}
+	c.mu.Unlock()
+	c.passed++
+	if c.passed%lrcCollectEvery == 0 {
+		c.lrcValidate()
+	}
+}
+
+// FetchDiffs hands another client this client's diffs of a page from
+// the intervals it asks for.
+func (c *Client) FetchDiffs(args *DiffsArgs, reply *DiffsReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range args.Seqs {
+		reply.Diffs = append(reply.Diffs, c.lrcDiffs[args.Addr][s])
+	}
+	reply.Err = OK
+	return nil
+}
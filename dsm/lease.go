@@ -0,0 +1,76 @@
+package dsm
+
+import (
+	"log"
+	"time"
+)
+
+// Leases on read-only copies, under the central manager. A client
+// that reads a page from its owner holds its copy for leaseDuration
+// and then drops it, whether or not it hears from the central. So a
+// writer that can't invalidate a slow or partitioned reader only has
+// to wait for the reader's lease to run out, and not for the failure
+// detector to declare the reader dead.
+//
+// The reader times its lease from before it asks for the page, and
+// the central from when it grants it, so the reader's lease always
+// runs out first. A new leader doesn't know the leases that the old
+// one granted, and takes every one to run until leaseDuration after
+// it took over.
+
+const leaseDuration = 2 * time.Second
+
+type Lease struct {
+	Duration time.Duration
+}
+
+// grant clientID a lease on its copy of addr.
+func (c *Central) grantLease(addr uintptr, clientID int) Lease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leases[addr] == nil {
+		c.leases[addr] = make(map[int]time.Time)
+	}
+	c.leases[addr][clientID] = time.Now().Add(leaseDuration)
+	return Lease{Duration: leaseDuration}
+}
+
+// when clientID's lease on its copy of addr runs out.
+func (c *Central) leaseExpiry(addr uintptr, clientID int) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.leases[addr][clientID]; ok {
+		return t
+	}
+	return c.leaderSince.Add(leaseDuration)
+}
+
+func (c *Central) dropLease(addr uintptr, clientID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.leases[addr], clientID)
+}
+
+// hold a read-only copy of addr until the lease that was asked for at
+// start runs out.
+func (c *Client) holdLease(addr uintptr, start time.Time, lease Lease) {
+	c.mu.Lock()
+	c.leaseGen[addr]++
+	gen := c.leaseGen[addr]
+	c.mu.Unlock()
+	time.AfterFunc(time.Until(start.Add(lease.Duration)), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.leaseGen[addr] == gen && c.mem.Access(addr) == 1 {
+			log.Println("lease ran out on", addr)
+			c.mem.ChangeAccess(addr, 0)
+		}
+	})
+}
+
+// forget the lease on addr, which is now this client's to write.
+func (c *Client) cancelLease(addr uintptr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leaseGen[addr]++
+}
@@ -0,0 +1,162 @@
+package dsm
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A lock service for DSM programs. The central keeps each lock's
+// holder and a FIFO queue of the clients waiting for it, and an
+// acquire RPC doesn't return until its client holds the lock. Under
+// the fixed distributed managers, lock id is managed by client id
+// modulo the number of clients.
+//
+// Clients number their lock requests, so a request that is retried,
+// or delivered late, is applied only once.
+
+// A lock, as the central keeps it.
+type LockState struct {
+	Holder int // -1 if the lock is free
+	Queue  []int
+	Seq    map[int]int64 // the last request applied for each client
+	VC     VectorClock   // of the last release
+}
+
+// how often a blocked lock or barrier request checks whether it can
+// return.
+const pollInterval = 10 * time.Millisecond
+
+func (c *Central) LockAcquire(args *LockArgs, reply *LockReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opLockAcquire, ClientID: args.ClientID, ID: args.LockID, ReqSeq: args.Seq}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	for !c.killed() {
+		c.mu.Lock()
+		held := c.lockTable[args.LockID].Holder == args.ClientID
+		if held {
+			l := c.lockTable[args.LockID]
+			reply.Bound = c.boundPages(args.LockID, args.Versions)
+			reply.VC = l.VC.copy()
+			reply.Intervals = c.intervalsSince(l.VC, args.VC)
+		}
+		c.mu.Unlock()
+		if held {
+			reply.Err = OK
+			return nil
+		}
+		if !c.isLeader() {
+			// the client will wait at the new leader
+			reply.Err = ErrWrongLeader
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+	reply.Err = ErrWrongLeader
+	return nil
+}
+
+func (c *Central) LockRelease(args *LockArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	pages := c.invalidateBoundReaders(args.Diffs)
+	reply.Err = c.commit(Op{Type: opLockRelease, ClientID: args.ClientID, ID: args.LockID, ReqSeq: args.Seq, Diffs: args.Diffs, VC: args.VC, Intervals: args.Intervals})
+	for _, pg := range pages {
+		c.locks[pg].Unlock()
+	}
+	return nil
+}
+
+// apply a lock request, queueing an acquire behind the holder and
+// handing a released lock to the next in line. c.mu must be held.
+func (c *Central) applyLock(op Op) {
+	l, ok := c.lockTable[op.ID]
+	if !ok {
+		l = &LockState{Holder: -1, Seq: make(map[int]int64)}
+		c.lockTable[op.ID] = l
+	}
+	if op.ReqSeq <= l.Seq[op.ClientID] {
+		return
+	}
+	l.Seq[op.ClientID] = op.ReqSeq
+	switch op.Type {
+	case opLockAcquire:
+		if l.Holder == -1 {
+			l.Holder = op.ClientID
+		} else {
+			l.Queue = append(l.Queue, op.ClientID)
+		}
+	case opLockRelease:
+		if l.Holder != op.ClientID {
+			return
+		}
+		c.applyBoundDiffs(op)
+		c.addIntervals(op.Intervals)
+		if l.VC == nil {
+			l.VC = make(VectorClock)
+		}
+		l.VC.merge(op.VC)
+		l.Holder = -1
+		if len(l.Queue) > 0 {
+			l.Holder = l.Queue[0]
+			l.Queue = l.Queue[1:]
+		}
+	}
+}
+
+// the manager that keeps lock, barrier, condition variable or semaphore
+// id.
+func (c *Client) syncManager(id int) int {
+	if c.manager == FixedManager && c.protocol != LazyReleaseConsistency {
+		return id % len(c.peers)
+	}
+	return 0
+}
+
+// the local mutex for lock id, which keeps this client's threads
+// from acquiring the lock together.
+func (c *Client) localLock(id int) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[id] = l
+	}
+	return l
+}
+
+// LockAcquire blocks until this client holds lock id. Under release
+// consistency, it then sees every write released before, and it can
+// write the pages bound to the lock.
+func (c *Client) LockAcquire(id int) {
+	c.localLock(id).Lock()
+	log.Println("acquiring lock", id)
+	args := &LockArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Versions: c.boundVersions(), VC: c.clock()}
+	reply := &LockReply{}
+	c.callManagerAt(c.syncManager(id), "Central.LockAcquire", args, reply)
+	c.installBound(id, reply.Bound)
+	c.lrcAcquire(reply.Intervals, reply.VC)
+	c.Acquire()
+}
+
+// LockRelease releases lock id, after releasing this client's writes
+// under release consistency, and its writes to the pages bound to the
+// lock.
+func (c *Client) LockRelease(id int) {
+	c.Release()
+	log.Println("releasing lock", id)
+	args := &LockArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Diffs: c.releaseBound(id)}
+	args.Intervals, args.VC = c.lrcPublish()
+	c.callManagerAt(c.syncManager(id), "Central.LockRelease", args, &Reply{})
+	c.lrcPublished(args.Intervals)
+	c.localLock(id).Unlock()
+}
@@ -21,6 +21,18 @@ int* matrixA;
 int* matrixB;
 int* matrixC;
 
+// every client gets the same matrices by name. each is page aligned,
+// so clients writing matrixC don't share pages with readers of A and B.
+void alloc_matrices() {
+    matrixA = dsm_malloc("matrixA", sizeof(int) * ROW_A * COL_A, DSM_PAGE_ALIGNED);
+    matrixB = dsm_malloc("matrixB", sizeof(int) * ROW_B * COL_B, DSM_PAGE_ALIGNED);
+    matrixC = dsm_malloc("matrixC", sizeof(int) * ROW_A * COL_B, DSM_PAGE_ALIGNED);
+    if (matrixA == NULL || matrixB == NULL || matrixC == NULL) {
+        fprintf(stderr, "Couldn't allocate the matrices\n");
+        exit(EXIT_FAILURE);
+    }
+}
+
 void setup_matmul(int num_pages, int index, int total_servers) {
     setup_handler();
 
@@ -29,9 +41,7 @@ void setup_matmul(int num_pages, int index, int total_servers) {
         printf("Mapping all pages as PROT_READ | PROT_WRITE\n");
         create_pages(num_pages);
 
-        matrixA = (int *)p;
-        matrixB = (int *)(p + PAGE_SIZE * 4);
-        matrixC = (int *)(p + PAGE_SIZE * 8);
+        alloc_matrices();
         for (int i = 0; i < ROW_A * COL_A; i++) {
             matrixA[i] = 1;
         }
@@ -49,9 +59,7 @@ void setup_matmul(int num_pages, int index, int total_servers) {
     } else {
         printf("Mapping all pages as PROT_NONE\n");
         create_pages(num_pages);
-        matrixA = (int *)p;
-        matrixB = (int *)(p + PAGE_SIZE * 4);
-        matrixC = (int *)(p + PAGE_SIZE * 8);
+        alloc_matrices();
         if (p == MAP_FAILED) {
             fprintf(stderr, "Couldn't mmap memory; %s\n", strerror(errno));
             exit(EXIT_FAILURE);
@@ -59,6 +67,17 @@ void setup_matmul(int num_pages, int index, int total_servers) {
     }
 }
 
+// every entry of the product of matrices of ones is COL_A.
+int verify_matmul() {
+    for (int i = 0; i < ROW_A * COL_B; i++) {
+        if (matrixC[i] != COL_A) {
+            printf("matrixC[%d] is %d; expected %d\n", i, matrixC[i], COL_A);
+            return 0;
+        }
+    }
+    return 1;
+}
+
 void print_matrix(int rows, int cols, int *matrix) {
     int i, j;
     for (i = 0; i < rows; i++) {
@@ -74,6 +93,9 @@ void multiply_matrices(int index, int total_servers) {
     int start = (int)floor((index / (double)total_servers) * ROW_A);
     int end = (int)floor(((index + 1) / (double)total_servers) * ROW_A);
 
+    // wait for client 0 to fill in the matrices
+    dsm_barrier(0);
+    dsm_advise(matrixB, sizeof(int) * ROW_B * COL_B, DSM_ADV_SEQUENTIAL);
     for (i =start; i < end; i++) {
         for (j = 0; j < COL_B; j++) {
             int val = 0;
@@ -83,6 +105,8 @@ void multiply_matrices(int index, int total_servers) {
             matrixC[i * COL_B + j] = val;
         }
     }
+    // wait for every client's rows of matrixC
+    dsm_barrier(1);
     printf("Matrix C:\n");
     print_matrix(ROW_A, COL_B, matrixC);
 }
\ No newline at end of file
@@ -0,0 +1,148 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Clients joining and leaving a running DSM with a central manager.
+// A joining client gets the next unused id, and is ready at once.
+// A leaving client gives the central the pages it owns, and is then
+// taken out of the page tables like a dead client, with the central
+// home to those of its pages that no other client has a copy of.
+// Ids are never reused.
+
+// a named segment, as a joining client sees it.
+type SegmentInfo struct {
+	Name string
+	Base uintptr
+	Size uintptr
+}
+
+func (c *Central) Join(args *JoinArgs, reply *JoinReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opJoin, Name: args.Address}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply.ClientID = c.liveClientAt(args.Address)
+	reply.NumClients = c.liveClients()
+	for _, s := range c.segments {
+		if !s.Destroyed {
+			reply.Segments = append(reply.Segments, SegmentInfo{Name: s.Name, Base: s.Offset, Size: s.Length})
+		}
+	}
+	sort.Slice(reply.Segments, func(i, j int) bool { return reply.Segments[i].Base < reply.Segments[j].Base })
+	reply.Err = OK
+	return nil
+}
+
+// the id of the live client at addr, or -1. c.mu must be held.
+func (c *Central) liveClientAt(addr string) int {
+	for id, a := range c.clients {
+		if a == addr && !c.deadClients[id] {
+			return id
+		}
+	}
+	return -1
+}
+
+// add a client at the address op.Name, unless it has already joined.
+// c.mu must be held.
+func (c *Central) applyJoin(op Op) {
+	if c.liveClientAt(op.Name) != -1 {
+		return
+	}
+	id := 0
+	for other := range c.clients {
+		if other >= id {
+			id = other + 1
+		}
+	}
+	c.clients[id] = op.Name
+	c.register[id] = true
+	c.num_clients++
+	log.Println("client", id, "joined at", op.Name)
+}
+
+func (c *Central) Leave(args *LeaveArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	c.mu.Lock()
+	me := c.clients[args.ClientID]
+	var owned []uintptr
+	for addr, o := range c.owner {
+		if o.OwnerAddr == me {
+			owned = append(owned, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	// no fault on the pages while we take them
+	sort.Slice(owned, func(i, j int) bool { return owned[i] < owned[j] })
+	for _, addr := range owned {
+		c.locks[addr].Lock()
+		defer c.locks[addr].Unlock()
+	}
+	pages := make(map[uintptr][]byte)
+	for _, addr := range owned {
+		if o, _ := c.getOwner(addr); o.OwnerAddr != me {
+			continue
+		}
+		args := InvalidateArgs{Addr: addr, NewAccess: 0, ReturnPage: true}
+		r := InvalidateReply{}
+		if !c.changeAccess(me, &args, &r, time.Time{}) {
+			// it died instead
+			reply.Err = OK
+			return nil
+		}
+		pages[addr] = r.Data
+	}
+	reply.Err = c.commit(Op{Type: opLeave, ClientID: args.ClientID, Pages: pages})
+	return nil
+}
+
+// MakeJoiningClient starts a client at addr and adds it to the
+// running DSM whose central's replicas are at centrals.
+func MakeJoiningClient(centrals []string, addr string, protocol Protocol, transport Transport, mem Memory) (*Client, *JoinReply) {
+	c := &Client{}
+	c.protocol = protocol
+	c.initialize(centrals, -1, transport, mem)
+	reply := &JoinReply{}
+	c.callCentral("Central.Join", &JoinArgs{Address: addr}, reply)
+	c.id = reply.ClientID
+	c.ready = true
+	log.Println("joined as client", c.id, "with segments", reply.Segments)
+	return c, reply
+}
+
+// Leave hands this client's pages to the central and leaves the DSM,
+// which runs on without it. It needs a central manager.
+func (c *Client) Leave() {
+	c.Release()
+	log.Println("leaving")
+	c.callCentral("Central.Leave", &LeaveArgs{ClientID: c.id}, &Reply{})
+	c.Kill()
+}
+
+func (c *Client) ID() int {
+	return c.id
+}
+
+// JoinSetup runs a client at address that joins the running DSM
+// whose central is at central.
+func JoinSetup(numpages int, central string, address string, protocol Protocol, workload string) {
+	w := mustLookupWorkload(workload)
+	var reply *JoinReply
+	client, reply = MakeJoiningClient(strings.Split(central, ","), address, protocol, MakeNetTransport(ListenAddr(address)), makeCgoMemory())
+	run(w, numpages, client.id, reply.NumClients)
+}
@@ -0,0 +1,204 @@
+package dsm
+
+/*
+#include <stdlib.h>
+#include "dsm.h"
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// A Memory holds a client's copy of the shared pages. Addresses are
+// page offsets from the start of the shared region, and access
+// values are the same PROT_* values the C side passes to mprotect:
+// 0 for none, 1 for read-only and 2 for read-write.
+type Memory interface {
+	GetPage(addr uintptr) []byte
+	SetPage(addr uintptr, data []byte)
+	ChangeAccess(addr uintptr, access int)
+	Access(addr uintptr) int
+	// Load and Store copy bytes from and to addr, within one page.
+	// They report false if the page's access doesn't allow it, and
+	// the caller should take the fault and try again.
+	Load(addr uintptr, buf []byte) bool
+	Store(addr uintptr, buf []byte) bool
+	// Atomic does op on the size-byte word at addr, atomically with
+	// respect to this process, and returns the word's old value. It
+	// reports false if the page isn't writable.
+	Atomic(addr uintptr, size int, op AtomicOp, operand uint64, expected uint64) (uint64, bool)
+}
+
+// cgoMemory is the mmapped region p set up by dsm.c, where invalid
+// accesses fault into HandleRead and HandleWrite. Its loads and
+// stores are done in C, so they fault the same way, and always
+// succeed.
+type cgoMemory struct {
+	mu     sync.Mutex
+	access map[uintptr]int
+}
+
+func makeCgoMemory() *cgoMemory {
+	m := &cgoMemory{}
+	m.access = make(map[uintptr]int)
+	return m
+}
+
+// MapPages sets up the shared region of numpages pages and the fault
+// handler, for a Go program that runs no C workload.
+func MapPages(numpages int) {
+	C.setup_handler()
+	C.create_pages(C.int(numpages))
+}
+
+// GetPage reads the page through a second mapping of the region, so
+// it works on a page with no access, such as a copy whose lease ran
+// out, without letting local threads read it meanwhile.
+func (m *cgoMemory) GetPage(addr uintptr) []byte {
+	page := C.get_page(C.uintptr_t(addr))
+	defer C.free(page)
+	return C.GoBytes(page, C.int(PageSize))
+}
+
+func (m *cgoMemory) SetPage(addr uintptr, data []byte) {
+	page := make([]byte, PageSize)
+	copy(page, data)
+	cpage := C.CBytes(page)
+	defer C.free(cpage)
+	C.set_page(C.uintptr_t(addr), cpage)
+}
+
+func (m *cgoMemory) ChangeAccess(addr uintptr, access int) {
+	m.mu.Lock()
+	m.access[addr] = access
+	m.mu.Unlock()
+	C.change_access(C.uintptr_t(addr), C.int(access))
+}
+
+func (m *cgoMemory) Access(addr uintptr) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.access[addr]
+}
+
+func (m *cgoMemory) Load(addr uintptr, buf []byte) bool {
+	if len(buf) > 0 {
+		C.dsm_read(C.uintptr_t(addr), unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	}
+	return true
+}
+
+func (m *cgoMemory) Store(addr uintptr, buf []byte) bool {
+	if len(buf) > 0 {
+		C.dsm_write(C.uintptr_t(addr), unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	}
+	return true
+}
+
+func (m *cgoMemory) Atomic(addr uintptr, size int, op AtomicOp, operand uint64, expected uint64) (uint64, bool) {
+	if m.Access(pageOf(addr)) != 2 {
+		return 0, false
+	}
+	old := C.local_atomic(C.uintptr_t(addr), C.int(size), C.int(op), C.uint64_t(operand), C.uint64_t(expected))
+	return uint64(old), true
+}
+
+// view returns the region's memory from addr on, to be used like C
+// uses it.
+func (m *cgoMemory) view(addr uintptr, size int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(C.p))+addr)), size)
+}
+
+// localMemory keeps pages in Go memory and tracks access by hand,
+// for running several clients in one process. Loads and stores
+// fail instead of faulting, and the caller is expected to take the
+// fault through the client and retry.
+type localMemory struct {
+	mu     sync.Mutex
+	pages  map[uintptr][]byte
+	access map[uintptr]int
+}
+
+func makeLocalMemory() *localMemory {
+	m := &localMemory{}
+	m.pages = make(map[uintptr][]byte)
+	m.access = make(map[uintptr]int)
+	return m
+}
+
+func pageOf(addr uintptr) uintptr {
+	return addr &^ uintptr(PageSize-1)
+}
+
+func (m *localMemory) page(addr uintptr) []byte {
+	page, ok := m.pages[addr]
+	if !ok {
+		page = make([]byte, PageSize)
+		m.pages[addr] = page
+	}
+	return page
+}
+
+func (m *localMemory) GetPage(addr uintptr) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := make([]byte, PageSize)
+	copy(data, m.page(addr))
+	return data
+}
+
+func (m *localMemory) SetPage(addr uintptr, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	page := m.page(addr)
+	copy(page, data)
+	for i := len(data); i < PageSize; i++ {
+		page[i] = 0
+	}
+}
+
+func (m *localMemory) ChangeAccess(addr uintptr, access int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.access[addr] = access
+}
+
+func (m *localMemory) Access(addr uintptr) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.access[addr]
+}
+
+func (m *localMemory) Load(addr uintptr, buf []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pg := pageOf(addr)
+	if m.access[pg] < 1 {
+		return false
+	}
+	copy(buf, m.page(pg)[addr-pg:])
+	return true
+}
+
+func (m *localMemory) Store(addr uintptr, buf []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pg := pageOf(addr)
+	if m.access[pg] < 2 {
+		return false
+	}
+	copy(m.page(pg)[addr-pg:], buf)
+	return true
+}
+
+func (m *localMemory) Atomic(addr uintptr, size int, op AtomicOp, operand uint64, expected uint64) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pg := pageOf(addr)
+	if m.access[pg] < 2 {
+		return 0, false
+	}
+	return doAtomic(m.page(pg)[addr-pg:], size, op, operand, expected), true
+}
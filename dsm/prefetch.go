@@ -0,0 +1,231 @@
+package dsm
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Prefetching under sequential consistency with a central or fixed
+// manager. When a client's read faults step through the region by a
+// steady stride, or it has advised that a range is read sequentially,
+// it asks each manager for read-only copies of the next few pages in
+// one Prefetch RPC, after the fault that spotted the pattern. The
+// manager fetches each page from its owner itself, and skips any page
+// that another fault holds, so a prefetch never waits for a fault.
+//
+// A prefetched copy is installed only if this client has heard
+// nothing about the page since it asked: no fault of its own and no
+// invalidation, each of which moves the page's epoch on.
+
+// how many pages ahead to prefetch.
+const prefetchDepth = 4
+
+// How a client expects to read a range, like madvise's advice.
+type Advice int
+
+const (
+	// prefetch when read faults look sequential or strided.
+	AdviceNormal Advice = iota
+	// prefetch the pages after each read fault.
+	AdviceSequential
+	// never prefetch.
+	AdviceRandom
+	// prefetch the whole range now.
+	AdviceWillNeed
+)
+
+type adviceRange struct {
+	start  uintptr
+	end    uintptr
+	advice Advice
+}
+
+type PrefetchedPage struct {
+	Addr  uintptr
+	Data  []byte
+	Lease Lease
+}
+
+// Advise gives advice about how this client will read the length
+// bytes at addr. Later advice overrides earlier advice for the same
+// pages.
+func (c *Client) Advise(addr uintptr, length int, advice Advice) {
+	start := pageOf(addr)
+	end := addr + uintptr(length)
+	if advice == AdviceWillNeed {
+		var pages []uintptr
+		for pg := start; pg < end; pg += uintptr(PageSize) {
+			pages = append(pages, pg)
+		}
+		c.prefetch(pages)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.advice[:0]
+	for _, r := range c.advice {
+		if r.start < start || r.end > end {
+			kept = append(kept, r)
+		}
+	}
+	c.advice = append(kept, adviceRange{start: start, end: end, advice: advice})
+}
+
+// the advice for the page at addr. c.mu must be held.
+func (c *Client) adviceFor(addr uintptr) Advice {
+	for i := len(c.advice) - 1; i >= 0; i-- {
+		if r := c.advice[i]; r.start <= addr && addr < r.end {
+			return r.advice
+		}
+	}
+	return AdviceNormal
+}
+
+// the client heard about the page at addr from elsewhere than a
+// prefetch. c.mu must be held.
+func (c *Client) bumpEpoch(addr uintptr) {
+	c.epochs[addr]++
+}
+
+// note a read fault on addr, and prefetch the pages after it if the
+// faults so far, or the advice, say they will be read next.
+func (c *Client) notePrefetch(addr uintptr) {
+	if c.protocol != SequentialConsistency || c.manager == DynamicManager {
+		return
+	}
+	c.mu.Lock()
+	stride := int64(addr) - int64(c.lastFault)
+	strided := c.faulted && stride != 0 && stride == c.lastStride
+	c.faulted = true
+	c.lastFault = addr
+	c.lastStride = stride
+	switch c.adviceFor(addr) {
+	case AdviceSequential:
+		stride = int64(PageSize)
+		strided = true
+	case AdviceRandom:
+		strided = false
+	}
+	if !strided || c.prefetching {
+		c.mu.Unlock()
+		return
+	}
+	c.prefetching = true
+	c.mu.Unlock()
+
+	var pages []uintptr
+	for k := int64(1); k <= prefetchDepth; k++ {
+		pg := int64(addr) + k*stride
+		if pg < 0 {
+			break
+		}
+		pages = append(pages, uintptr(pg))
+	}
+	go func() {
+		c.prefetch(pages)
+		c.mu.Lock()
+		c.prefetching = false
+		c.mu.Unlock()
+	}()
+}
+
+// prefetch read-only copies of those of pages that this client has
+// no copy of, with one RPC to each of their managers.
+func (c *Client) prefetch(pages []uintptr) {
+	if c.protocol != SequentialConsistency || c.manager == DynamicManager {
+		return
+	}
+	c.mu.Lock()
+	epochs := make(map[uintptr]int64)
+	byManager := make(map[int][]uintptr)
+	for _, pg := range pages {
+		if c.mem.Access(pg) != 0 {
+			continue
+		}
+		if _, ok := epochs[pg]; ok {
+			continue
+		}
+		epochs[pg] = c.epochs[pg]
+		m := c.managerOf(pg)
+		byManager[m] = append(byManager[m], pg)
+	}
+	c.mu.Unlock()
+
+	start := time.Now()
+	for m, addrs := range byManager {
+		reply := &PrefetchReply{}
+		c.callManagerAt(m, "Central.Prefetch", &PrefetchArgs{ClientID: c.id, Addrs: addrs}, reply)
+		if !c.faultOK(reply.Err) {
+			return
+		}
+		for _, p := range reply.Pages {
+			c.mu.Lock()
+			installed := c.epochs[p.Addr] == epochs[p.Addr] && c.mem.Access(p.Addr) == 0
+			if installed {
+				c.mem.SetPage(p.Addr, p.Data)
+				c.mem.ChangeAccess(p.Addr, 1)
+			}
+			c.mu.Unlock()
+			if installed && p.Lease.Duration > 0 {
+				c.holdLease(p.Addr, start, p.Lease)
+			}
+		}
+		log.Println("prefetched", len(reply.Pages), "of", len(addrs), "pages")
+	}
+}
+
+// Prefetch gives the client read-only copies of those of args.Addrs
+// that another client owns and that no other fault holds.
+func (c *Central) Prefetch(args *PrefetchArgs, reply *PrefetchReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if c.isDead(args.ClientID) {
+		reply.Err = ErrClientDead
+		return nil
+	}
+	me := c.clientAddr(args.ClientID)
+	addrs := append([]uintptr(nil), args.Addrs...)
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		l, ok := c.locks[addr]
+		if !ok || !l.TryLock() {
+			continue
+		}
+		page, err := c.prefetchPage(addr, args.ClientID, me)
+		l.Unlock()
+		if err != OK {
+			reply.Err = err
+			return nil
+		}
+		if page != nil {
+			reply.Pages = append(reply.Pages, *page)
+		}
+	}
+	reply.Err = OK
+	return nil
+}
+
+// serve one page of a prefetch, with its lock held, or nil if the
+// page has no owner to copy, or the owner can't be reached.
+func (c *Central) prefetchPage(addr uintptr, clientID int, clientAddr string) (*PrefetchedPage, Err) {
+	owner, found := c.getOwner(addr)
+	if !found || owner.OwnerAddr == clientAddr || owner.AccessType == 0 || c.isDeadAddr(owner.OwnerAddr) {
+		return nil, OK
+	}
+	if owner.AccessType == 2 {
+		if err := c.makeReadonlyOwner(addr, owner.OwnerAddr); err != OK {
+			return nil, OK
+		}
+	}
+	pageReply := &PageRequestReply{}
+	if !c.transport.Call(owner.OwnerAddr, "Client.HandlePageRequest", &PageRequestArgs{Addr: addr, RequestType: 1}, pageReply) {
+		return nil, OK
+	}
+	if err := c.commit(Op{Type: opAddCopyset, ClientID: clientID, Addr: addr}); err != OK {
+		return nil, err
+	}
+	return &PrefetchedPage{Addr: addr, Data: pageReply.Data, Lease: c.grantLease(addr, clientID)}, OK
+}
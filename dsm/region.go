@@ -0,0 +1,157 @@
+package dsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// A Go interface to the shared region, for programs with no C code.
+// A Region is a run of the region's bytes; its reads and writes take
+// the same faults as C code's loads and stores, one page at a time,
+// so Go and C clients can share data. Int64At and SetInt64At use
+// little-endian order, as C does on the machines we run on.
+type Region struct {
+	c    *Client
+	base uintptr
+	size int
+}
+
+// the error from a Region whose client has been killed, or declared
+// dead by the central, so that its faults can't be served.
+var ErrClientKilled = errors.New("dsm: the client is dead")
+
+// OpenClient maps numpages pages and starts client index of the DSM
+// whose central is at central, listening on listen, for a Go program
+// to use through Regions.
+func OpenClient(numpages int, index int, central string, listen string, protocol Protocol) *Client {
+	MapPages(numpages)
+	client = MakeClient(strings.Split(central, ","), index, protocol, MakeNetTransport(listen), makeCgoMemory())
+	return client
+}
+
+// Region returns the size bytes of the shared region at offset base.
+func (c *Client) Region(base uintptr, size int) *Region {
+	return &Region{c: c, base: base, size: size}
+}
+
+// SegmentRegion opens the named segment, as SegmentOpen does, and
+// returns its bytes.
+func (c *Client) SegmentRegion(name string, size int) (*Region, bool) {
+	base, size, ok := c.SegmentOpen(name, size)
+	if !ok {
+		return nil, false
+	}
+	return c.Region(base, size), true
+}
+
+func (r *Region) Base() uintptr {
+	return r.base
+}
+
+func (r *Region) Size() int {
+	return r.size
+}
+
+// ReadAt reads len(buf) bytes at offset off in the region.
+func (r *Region) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := r.span(len(buf), off)
+	if done, ferr := r.each(buf[:n], off, r.c.mem.Load); ferr != nil {
+		return done, ferr
+	}
+	if err == nil && n < len(buf) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt writes buf at offset off in the region.
+func (r *Region) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := r.span(len(buf), off)
+	if done, ferr := r.each(buf[:n], off, r.c.mem.Store); ferr != nil {
+		return done, ferr
+	}
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Int64At returns the int64 at offset off, or an error if the region
+// doesn't hold all of it, or the read can't be done. It is not atomic
+// if the int64 spans two pages.
+func (r *Region) Int64At(off int64) (int64, error) {
+	var buf [8]byte
+	if _, err := r.ReadAt(buf[:], off); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+// SetInt64At writes v at offset off, or returns an error as Int64At
+// does.
+func (r *Region) SetInt64At(off int64, v int64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	_, err := r.WriteAt(buf[:], off)
+	return err
+}
+
+// UnsafeBytes faults in the whole region, writable if write is set,
+// and returns it as a slice, or false if this client's memory isn't
+// the mmapped region. Go code can't take the faults itself, so the
+// slice may only be used while the pages stay valid: under release
+// consistency, until this client's next acquire or release.
+func (r *Region) UnsafeBytes(write bool) ([]byte, bool) {
+	m, ok := r.c.mem.(*cgoMemory)
+	if !ok {
+		return nil, false
+	}
+	access := 1
+	if write {
+		access = 2
+	}
+	for pg := pageOf(r.base); pg < r.base+uintptr(r.size); pg += uintptr(PageSize) {
+		for m.Access(pg) < access {
+			r.c.fault(pg)
+		}
+	}
+	return m.view(r.base, r.size), true
+}
+
+// how many of n bytes at off lie in the region.
+func (r *Region) span(n int, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if off >= int64(r.size) {
+		return 0, io.EOF
+	}
+	if rest := int64(r.size) - off; int64(n) > rest {
+		n = int(rest)
+	}
+	return n, nil
+}
+
+// each runs op on the part of buf in each page, taking faults until
+// it succeeds, and returns how many bytes it did.
+func (r *Region) each(buf []byte, off int64, op func(uintptr, []byte) bool) (int, error) {
+	addr := r.base + uintptr(off)
+	done := 0
+	for done < len(buf) {
+		n := int(pageOf(addr) + uintptr(PageSize) - addr)
+		if n > len(buf)-done {
+			n = len(buf) - done
+		}
+		for !op(addr, buf[done:done+n]) {
+			if r.c.killed() {
+				return done, ErrClientKilled
+			}
+			r.c.fault(addr)
+		}
+		addr += uintptr(n)
+		done += n
+	}
+	return done, nil
+}
@@ -0,0 +1,220 @@
+package dsm
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Release consistency, after TreadMarks, with the central as the home
+// of every page. Any number of clients may write a page at once: a
+// client's writes stay in its own copy until it releases, when it
+// sends the home a diff of the page against the twin it made at its
+// first write, and the home merges the diffs into its master copy.
+// At an acquire, a client drops the copies that the home has newer
+// versions of.
+
+// A run of bytes that a writer changed, at offset Off in the page.
+type DiffRun struct {
+	Off  int
+	Data []byte
+}
+
+func makeDiff(twin []byte, page []byte) []DiffRun {
+	var diff []DiffRun
+	for i := 0; i < len(page); {
+		if page[i] == twin[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(page) && page[j] != twin[j] {
+			j++
+		}
+		diff = append(diff, DiffRun{Off: i, Data: append([]byte(nil), page[i:j]...)})
+		i = j
+	}
+	return diff
+}
+
+func applyDiff(page []byte, diff []DiffRun) {
+	for _, run := range diff {
+		copy(page[run.Off:], run.Data)
+	}
+}
+
+func (c *Central) FetchPage(args *PageRequestArgs, reply *PageRequestReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page, ok := c.pages[args.Addr]; ok {
+		reply.Data = append([]byte(nil), page...)
+	}
+	reply.Version = c.versions[args.Addr]
+	reply.Err = OK
+	return nil
+}
+
+func (c *Central) ApplyDiff(args *DiffArgs, reply *DiffReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opApplyDiff, ClientID: args.ClientID, ReqSeq: args.Seq, Addr: args.Addr, Diff: args.Diff})
+	c.mu.Lock()
+	reply.Version = c.versions[args.Addr]
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Central) PageVersions(args *VersionsArgs, reply *VersionsReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply.Versions = make([]int, len(args.Addrs))
+	for i, addr := range args.Addrs {
+		reply.Versions[i] = c.versions[addr]
+	}
+	reply.Err = OK
+	return nil
+}
+
+// merge a diff into the home's copy, unless it is a retry of one that
+// was already merged. c.mu must be held.
+func (c *Central) applyDiff(op Op) {
+	if op.ReqSeq <= c.diffSeq[op.ClientID] {
+		return
+	}
+	c.diffSeq[op.ClientID] = op.ReqSeq
+	page, ok := c.pages[op.Addr]
+	if !ok {
+		page = make([]byte, PageSize)
+		c.pages[op.Addr] = page
+	}
+	applyDiff(page, op.Diff)
+	c.versions[op.Addr]++
+}
+
+// releaseFault takes a fault under release consistency, eager or
+// lazy. If our copy of addr is invalid, it brings it up to date: from
+// the home's copy, or under lazy release consistency, by fetching the
+// diffs that our write notices for it name. Before the first write
+// since the last release, it makes a twin of the page.
+func (c *Client) releaseFault(addr uintptr, access int) {
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	if c.protocol == LazyReleaseConsistency {
+		if c.mem.Access(addr) == 0 {
+			c.lrcUpdate(addr)
+			c.mem.ChangeAccess(addr, 1)
+		}
+	} else if _, ok := c.versions[addr]; !ok {
+		reply := &PageRequestReply{}
+		c.callManager(addr, "Central.FetchPage", &PageRequestArgs{Addr: addr}, reply)
+		c.mem.SetPage(addr, reply.Data)
+		c.versions[addr] = reply.Version
+		c.mem.ChangeAccess(addr, 1)
+	}
+	if access == 2 {
+		if _, ok := c.twins[addr]; !ok {
+			c.twins[addr] = c.mem.GetPage(addr)
+		}
+		c.mem.ChangeAccess(addr, 2)
+	}
+}
+
+func (c *Client) rcInvalidate(addr uintptr) {
+	c.mem.ChangeAccess(addr, 0)
+	delete(c.versions, addr)
+}
+
+// Release makes this client's writes visible to the next client to
+// acquire. Under sequential consistency, it only flushes writes to
+// write-update segments, and under lazy release consistency, it only
+// ends this client's interval.
+func (c *Client) Release() {
+	if c.protocol == LazyReleaseConsistency {
+		c.rc.Lock()
+		c.endInterval()
+		c.rc.Unlock()
+		return
+	}
+	if c.protocol != ReleaseConsistency {
+		c.Flush()
+		return
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	for addr, twin := range c.twins {
+		c.mem.ChangeAccess(addr, 1)
+		diff := makeDiff(twin, c.mem.GetPage(addr))
+		delete(c.twins, addr)
+		if len(diff) == 0 {
+			continue
+		}
+		log.Println("releasing", len(diff), "runs of", addr)
+		reply := &DiffReply{}
+		args := &DiffArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), Addr: addr, Diff: diff}
+		c.callManager(addr, "Central.ApplyDiff", args, reply)
+		if reply.Version == c.versions[addr]+1 {
+			c.versions[addr] = reply.Version
+		} else {
+			// another writer's diff got in too, and our copy
+			// doesn't have it
+			c.rcInvalidate(addr)
+		}
+	}
+}
+
+// Acquire brings this client's copies up to date with every release
+// that came before. It does nothing unless the DSM runs release
+// consistency, and under lazy release consistency, it only ends this
+// client's interval: the lock or barrier brings the write notices.
+func (c *Client) Acquire() {
+	if c.protocol == LazyReleaseConsistency {
+		c.rc.Lock()
+		c.endInterval()
+		c.rc.Unlock()
+		return
+	}
+	if c.protocol != ReleaseConsistency {
+		return
+	}
+	c.rc.Lock()
+	defer c.rc.Unlock()
+	byManager := make(map[int][]uintptr)
+	for addr := range c.versions {
+		m := c.managerOf(addr)
+		byManager[m] = append(byManager[m], addr)
+	}
+	for m, addrs := range byManager {
+		reply := &VersionsReply{}
+		c.callManagerAt(m, "Central.PageVersions", &VersionsArgs{Addrs: addrs}, reply)
+		for i, addr := range addrs {
+			if reply.Versions[i] == c.versions[addr] {
+				continue
+			}
+			twin, dirty := c.twins[addr]
+			if !dirty {
+				c.rcInvalidate(addr)
+				continue
+			}
+			// keep our unreleased writes on top of the newer copy
+			diff := makeDiff(twin, c.mem.GetPage(addr))
+			fetched := &PageRequestReply{}
+			c.callManager(addr, "Central.FetchPage", &PageRequestArgs{Addr: addr}, fetched)
+			page := make([]byte, PageSize)
+			copy(page, fetched.Data)
+			c.twins[addr] = append([]byte(nil), page...)
+			applyDiff(page, diff)
+			c.mem.SetPage(addr, page)
+			c.mem.ChangeAccess(addr, 2)
+			c.versions[addr] = fetched.Version
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package dsm
+
+import (
+	"bytes"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/6.5840-dsm/labgob"
+	"github.com/6.5840-dsm/raft"
+)
+
+// Every change to the central's page tables is an Op. A replicated
+// central agrees on the order of Ops through Raft and applies them
+// as they commit; an unreplicated one applies them directly.
+type Op struct {
+	Type     string
+	Node     int   // replica that proposed the op
+	Seq      int64 // with Node, identifies the op
+	ClientID int
+	Addr     uintptr
+	Owner    Owner
+	Access   int
+	ReqSeq   int64 // numbers the client's requests, to spot retries
+	Diff     []DiffRun
+	ID       int // of a lock or barrier
+	Gen      int // of a barrier
+	Value    int // a semaphore's initial count
+
+	// an atomic operation, on the Size bytes at Addr
+	AtomicOp AtomicOp
+	Operand  uint64
+	Expected uint64
+	Done     bool // by the page's owner, which found Old
+	Old      uint64
+
+	Name        string
+	Size        uintptr
+	PageAligned bool
+	BlockSize   uintptr
+	Update      bool
+
+	Pages map[uintptr][]byte    // recovered from a checkpoint, or bound
+	Held  []uintptr             // with a dead client, pages other clients are writing
+	Diffs map[uintptr][]DiffRun // to bound pages, with a lock release
+
+	// lazy release consistency, with a lock release or barrier
+	VC        VectorClock
+	Intervals []Interval
+	Validated VectorClock // with a barrier arrival
+}
+
+const (
+	opRegister       = "Register"
+	opSetOwner       = "SetOwner"
+	opAddCopyset     = "AddCopyset"
+	opRemoveCopyset  = "RemoveCopyset"
+	opConfirm        = "Confirm"
+	opApplyDiff      = "ApplyDiff"
+	opLockAcquire    = "LockAcquire"
+	opLockRelease    = "LockRelease"
+	opBarrier        = "Barrier"
+	opMalloc         = "Malloc"
+	opFree           = "Free"
+	opSegmentOpen    = "SegmentOpen"
+	opSegmentClose   = "SegmentClose"
+	opSegmentDestroy = "SegmentDestroy"
+	opClientDead     = "ClientDead"
+	opJoin           = "Join"
+	opLeave          = "Leave"
+	opBind           = "Bind"
+	opCondWait       = "CondWait"
+	opCondSignal     = "CondSignal"
+	opCondBroadcast  = "CondBroadcast"
+	opSemInit        = "SemInit"
+	opSemWait        = "SemWait"
+	opSemPost        = "SemPost"
+	opAtomic         = "Atomic"
+	opRWAcquire      = "RWAcquire"
+	opRWRelease      = "RWRelease"
+	opRWProtect      = "RWProtect"
+	opNoop           = "Noop"
+)
+
+// how long a replica waits for one of its ops to commit before
+// deciding that it has lost leadership.
+const commitTimeout = 2 * time.Second
+
+// the outcome of applying an op, handed to the replica waiting for it.
+type applied struct {
+	node int
+	seq  int64
+	err  Err
+}
+
+func init() {
+	labgob.Register(Op{})
+}
+
+// raftPeer sends one replica's Raft RPCs over the DSM's transport.
+type raftPeer struct {
+	transport Transport
+	addr      string
+}
+
+func (p raftPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return p.transport.Call(p.addr, svcMeth, args, reply)
+}
+
+// getState returns the current term, and whether this replica is a
+// leader that has caught up with the log, so that its page tables
+// are current and it may serve clients.
+func (c *Central) getState() (int, bool) {
+	if c.rf == nil {
+		// a replica that isn't running Raft yet leads nothing
+		return 0, !c.replicated
+	}
+	term, isLeader := c.rf.GetState()
+	return term, isLeader && atomic.LoadInt64(&c.readyTerm) == int64(term)
+}
+
+func (c *Central) isLeader() bool {
+	_, isLeader := c.getState()
+	return isLeader
+}
+
+// commit op and wait for it to be applied, returning the result of
+// applying it, or ErrWrongLeader if this replica can't get it
+// committed.
+func (c *Central) commit(op Op) Err {
+	c.mu.Lock()
+	if c.rf == nil {
+		defer c.mu.Unlock()
+		if c.replicated {
+			return ErrWrongLeader
+		}
+		return c.apply(op)
+	}
+	c.seq++
+	op.Node = c.me
+	op.Seq = c.seq
+	index, _, isLeader := c.rf.Start(op)
+	if !isLeader {
+		c.mu.Unlock()
+		return ErrWrongLeader
+	}
+	ch := make(chan applied, 1)
+	c.waiters[index] = ch
+	c.mu.Unlock()
+
+	select {
+	case res := <-ch:
+		if res.node != op.Node || res.seq != op.Seq {
+			// another leader's op was committed at our index
+			return ErrWrongLeader
+		}
+		return res.err
+	case <-time.After(commitTimeout):
+		c.mu.Lock()
+		delete(c.waiters, index)
+		c.mu.Unlock()
+		return ErrWrongLeader
+	}
+}
+
+// apply op to the page tables. c.mu must be held.
+func (c *Central) apply(op Op) Err {
+	switch op.Type {
+	case opRegister:
+		if !c.register[op.ClientID] {
+			c.register[op.ClientID] = true
+			c.num_clients++
+			leader := true
+			if c.rf != nil {
+				_, leader = c.rf.GetState()
+			}
+			if c.num_clients == len(c.clients) && leader {
+				// all clients have registered
+				go c.allClientsRegistered()
+			}
+		}
+	case opSetOwner:
+		c.owner[op.Addr] = op.Owner
+		delete(c.pages, op.Addr)
+	case opAddCopyset:
+		if _, ok := c.copyset[op.Addr]; !ok {
+			c.copyset[op.Addr] = make(map[int]int)
+		}
+		c.copyset[op.Addr][op.ClientID] = 1
+	case opRemoveCopyset:
+		delete(c.copyset[op.Addr], op.ClientID)
+	case opConfirm:
+		return c.applyConfirm(op)
+	case opApplyDiff:
+		c.applyDiff(op)
+	case opLockAcquire, opLockRelease:
+		c.applyLock(op)
+	case opBarrier:
+		c.applyBarrier(op)
+	case opMalloc, opFree, opSegmentOpen, opSegmentClose, opSegmentDestroy:
+		c.applyAlloc(op)
+	case opClientDead, opLeave:
+		c.applyClientDead(op)
+	case opJoin:
+		c.applyJoin(op)
+	case opBind:
+		c.applyBind(op)
+	case opCondWait, opCondSignal, opCondBroadcast:
+		c.applyCond(op)
+	case opSemInit, opSemWait, opSemPost:
+		c.applySem(op)
+	case opAtomic:
+		c.applyAtomic(op)
+	case opRWAcquire, opRWRelease, opRWProtect:
+		c.applyRWLock(op)
+	}
+	return OK
+}
+
+// check that the fault being confirmed still holds, and hand the
+// page to a writer. a confirmation can go stale if the fault was
+// served by a leader that crashed before the client confirmed,
+// and the new leader let another client at the page in between.
+// c.mu must be held.
+func (c *Central) applyConfirm(op Op) Err {
+	me := c.clients[op.ClientID]
+	cur, found := c.owner[op.Addr]
+	if op.Access == 1 {
+		if _, ok := c.copyset[op.Addr][op.ClientID]; ok || (found && cur.OwnerAddr == me) {
+			return OK
+		}
+		return ErrStale
+	}
+	if found && cur == (Owner{OwnerAddr: me, AccessType: 2}) {
+		// already confirmed
+		return OK
+	}
+	if c.updatePage(op.Addr) {
+		// the readers keep their copies
+		if found != (op.Owner.OwnerAddr != "") || cur.OwnerAddr != op.Owner.OwnerAddr {
+			return ErrStale
+		}
+		delete(c.copyset[op.Addr], op.ClientID)
+		c.owner[op.Addr] = Owner{OwnerAddr: me, AccessType: 2}
+		delete(c.pages, op.Addr)
+		return OK
+	}
+	for clientID, _ := range c.copyset[op.Addr] {
+		if clientID != op.ClientID {
+			return ErrStale
+		}
+	}
+	if found != (op.Owner.OwnerAddr != "") || cur.OwnerAddr != op.Owner.OwnerAddr {
+		return ErrStale
+	}
+	if found && cur.OwnerAddr != me && cur.AccessType != 0 {
+		return ErrStale
+	}
+	delete(c.copyset[op.Addr], op.ClientID)
+	c.owner[op.Addr] = Owner{OwnerAddr: me, AccessType: 2}
+	delete(c.pages, op.Addr)
+	return OK
+}
+
+func (c *Central) encodeState() []byte {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(c.clients)
+	e.Encode(c.register)
+	e.Encode(c.num_clients)
+	e.Encode(c.owner)
+	e.Encode(c.copyset)
+	e.Encode(c.pages)
+	e.Encode(c.versions)
+	e.Encode(c.diffSeq)
+	e.Encode(c.lockTable)
+	e.Encode(c.barriers)
+	e.Encode(c.allocs)
+	e.Encode(c.named)
+	e.Encode(c.freeExtents)
+	e.Encode(c.allocResults)
+	e.Encode(c.segments)
+	e.Encode(c.deadClients)
+	e.Encode(c.bound)
+	e.Encode(c.binds)
+	e.Encode(c.intervals)
+	e.Encode(c.collected)
+	e.Encode(c.conds)
+	e.Encode(c.sems)
+	e.Encode(c.atomicSeq)
+	e.Encode(c.atomicOld)
+	e.Encode(c.rwlocks)
+	return w.Bytes()
+}
+
+func (c *Central) readSnapshot(data []byte) {
+	if data == nil || len(data) < 1 {
+		return
+	}
+	r := bytes.NewBuffer(data)
+	d := labgob.NewDecoder(r)
+	var clients map[int]string
+	var register map[int]bool
+	var num_clients int
+	var owner map[uintptr]Owner
+	var copyset map[uintptr]map[int]int
+	var pages map[uintptr][]byte
+	var versions map[uintptr]int
+	var diffSeq map[int]int64
+	var lockTable map[int]*LockState
+	var barriers map[int]*BarrierState
+	var allocs map[uintptr]Allocation
+	var named map[string]uintptr
+	var freeExtents []Extent
+	var allocResults map[int]AllocResult
+	var segments map[uintptr]*Segment
+	var deadClients map[int]bool
+	var bound map[uintptr]int
+	var binds map[int]*AppliedSeqs
+	var intervals map[int][]Interval
+	var collected VectorClock
+	var conds map[int]*CondState
+	var sems map[int]*SemState
+	var atomicSeq map[int]int64
+	var atomicOld map[int]uint64
+	var rwlocks map[int]*RWLockState
+	if d.Decode(&clients) != nil ||
+		d.Decode(&register) != nil ||
+		d.Decode(&num_clients) != nil ||
+		d.Decode(&owner) != nil ||
+		d.Decode(&copyset) != nil ||
+		d.Decode(&pages) != nil ||
+		d.Decode(&versions) != nil ||
+		d.Decode(&diffSeq) != nil ||
+		d.Decode(&lockTable) != nil ||
+		d.Decode(&barriers) != nil ||
+		d.Decode(&allocs) != nil ||
+		d.Decode(&named) != nil ||
+		d.Decode(&freeExtents) != nil ||
+		d.Decode(&allocResults) != nil ||
+		d.Decode(&segments) != nil ||
+		d.Decode(&deadClients) != nil ||
+		d.Decode(&bound) != nil ||
+		d.Decode(&binds) != nil ||
+		d.Decode(&intervals) != nil ||
+		d.Decode(&collected) != nil ||
+		d.Decode(&conds) != nil ||
+		d.Decode(&sems) != nil ||
+		d.Decode(&atomicSeq) != nil ||
+		d.Decode(&atomicOld) != nil ||
+		d.Decode(&rwlocks) != nil {
+		log.Fatal("could not decode central snapshot")
+	}
+	c.clients = clients
+	c.register = register
+	c.num_clients = num_clients
+	c.owner = owner
+	c.copyset = copyset
+	c.pages = pages
+	c.versions = versions
+	c.diffSeq = diffSeq
+	c.lockTable = lockTable
+	c.barriers = barriers
+	c.allocs = allocs
+	c.named = named
+	c.freeExtents = freeExtents
+	c.allocResults = allocResults
+	c.segments = segments
+	c.deadClients = deadClients
+	c.bound = bound
+	c.binds = binds
+	c.intervals = intervals
+	c.collected = collected
+	c.conds = conds
+	c.sems = sems
+	c.atomicSeq = atomicSeq
+	c.atomicOld = atomicOld
+	c.rwlocks = rwlocks
+}
+
+func (c *Central) applyLoop() {
+	for c.killed() == false {
+		msg := <-c.applyCh
+		c.mu.Lock()
+		if msg.SnapshotValid {
+			if msg.SnapshotIndex > c.lastApplied {
+				c.readSnapshot(msg.Snapshot)
+				c.lastApplied = msg.SnapshotIndex
+			}
+			c.mu.Unlock()
+			continue
+		}
+		if !msg.CommandValid || msg.CommandIndex <= c.lastApplied {
+			c.mu.Unlock()
+			continue
+		}
+		op := msg.Command.(Op)
+		err := c.apply(op)
+		c.lastApplied = msg.CommandIndex
+		if ch, ok := c.waiters[msg.CommandIndex]; ok {
+			ch <- applied{node: op.Node, seq: op.Seq, err: err}
+			delete(c.waiters, msg.CommandIndex)
+		}
+		if c.maxraftstate != -1 && c.persister.RaftStateSize() > c.maxraftstate {
+			c.rf.Snapshot(msg.CommandIndex, c.encodeState())
+		}
+		c.mu.Unlock()
+	}
+}
+
+// a new leader commits an op of its own before serving clients, which
+// brings its page tables up to date with everything committed before
+// it took over.
+//
+// a replica that loses leadership can't expect the confirmations for
+// the faults it served, since clients retry them at the new leader,
+// so it gives up the page locks those faults hold.
+func (c *Central) leadershipWatcher() {
+	for c.killed() == false {
+		time.Sleep(20 * time.Millisecond)
+		term, isLeader := c.rf.GetState()
+		if isLeader && atomic.LoadInt64(&c.readyTerm) != int64(term) {
+			if c.commit(Op{Type: opNoop}) == OK {
+				c.mu.Lock()
+				c.leaderSince = time.Now()
+				c.mu.Unlock()
+				atomic.StoreInt64(&c.readyTerm, int64(term))
+			}
+		}
+		c.mu.Lock()
+		var stale []uintptr
+		for addr, f := range c.inflight {
+			select {
+			case <-f.done:
+				if f.term != term || !isLeader {
+					stale = append(stale, addr)
+				}
+			default:
+			}
+		}
+		for _, addr := range stale {
+			delete(c.inflight, addr)
+		}
+		c.mu.Unlock()
+		for _, addr := range stale {
+			c.locks[addr].Unlock()
+		}
+	}
+}
+
+// MakeReplicatedCentral starts replica me of a central server that is
+// replicated with Raft across peers, the addresses of all replicas.
+// persister holds the replica's Raft state and snapshots; the log is
+// snapshotted whenever it grows past maxraftstate bytes, or never if
+// maxraftstate is -1.
+func MakeReplicatedCentral(clients map[int]string, numpages int, peers []string, me int, transport Transport, persister *raft.Persister, maxraftstate int) *Central {
+	c := Central{replicated: true}
+	c.initialize(clients, numpages, transport)
+	c.me = me
+	c.persister = persister
+	c.maxraftstate = maxraftstate
+	c.readSnapshot(persister.ReadSnapshot())
+
+	ends := make([]raft.Peer, len(peers))
+	for i, addr := range peers {
+		ends[i] = raftPeer{transport: transport, addr: addr}
+	}
+	c.applyCh = make(chan raft.ApplyMsg)
+	c.rf = raft.Make(ends, me, persister, c.applyCh)
+
+	go c.applyLoop()
+	go c.leadershipWatcher()
+	c.transport.Serve(c.rf)
+	c.transport.Serve(&c)
+	go c.failureDetector()
+	return &c
+}
@@ -0,0 +1,346 @@
+package dsm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reader-writer locks for read-mostly data. Any number of clients may
+// hold a reader-writer lock in shared mode at once, or one client in
+// exclusive mode. The central keeps them like locks, and the policy
+// it starts with decides who goes next when both readers and writers
+// wait: writers first, readers first, or whoever asked first.
+//
+// A program may tell a lock which pages it protects. When a client
+// gets the lock in shared mode under sequential consistency, it
+// prefetches those of the pages it lacks: a writable owner is made
+// read-only, and the reader joins the copyset. So readers of a table
+// that changes rarely share it in read-only copysets, and don't fault
+// on it one by one after every write.
+//
+// The threads of a client share its hold on a lock in shared mode.
+
+// Who goes first at a reader-writer lock.
+type RWPolicy int
+
+const (
+	// a waiting writer holds back new readers.
+	RWWriterPreference RWPolicy = iota
+	// readers join the readers that hold the lock, even past
+	// waiting writers, which may starve.
+	RWReaderPreference
+	// requests are granted in the order they came, readers that
+	// are next to each other together.
+	RWFair
+)
+
+// the policy for the central's reader-writer locks.
+var RWLockPolicy = RWWriterPreference
+
+// ParseRWPolicy parses writer, reader or fair.
+func ParseRWPolicy(s string) (RWPolicy, error) {
+	switch s {
+	case "writer":
+		return RWWriterPreference, nil
+	case "reader":
+		return RWReaderPreference, nil
+	case "fair":
+		return RWFair, nil
+	}
+	return 0, fmt.Errorf("reader-writer lock policy must be writer, reader or fair, not %q", s)
+}
+
+type RWRequest struct {
+	ClientID int
+	Write    bool
+}
+
+// A reader-writer lock, as the central keeps it.
+type RWLockState struct {
+	Policy    RWPolicy
+	Writer    int // -1 if no client holds the lock exclusive
+	Readers   map[int]bool
+	Queue     []RWRequest
+	Seq       map[int]int64 // the last request applied for each client
+	VC        VectorClock   // of the last exclusive release
+	Protected []uintptr     // the pages the lock protects, in order
+}
+
+// grant the lock to the requests at the front of the queue that the
+// policy lets in.
+func (l *RWLockState) grant() {
+	free := func() bool { return l.Writer == -1 && len(l.Readers) == 0 }
+	readers := func() {
+		queue := l.Queue[:0]
+		for _, r := range l.Queue {
+			if r.Write {
+				queue = append(queue, r)
+			} else {
+				l.Readers[r.ClientID] = true
+			}
+		}
+		l.Queue = queue
+	}
+	switch l.Policy {
+	case RWFair:
+		for len(l.Queue) > 0 {
+			r := l.Queue[0]
+			if r.Write && free() {
+				l.Writer = r.ClientID
+			} else if !r.Write && l.Writer == -1 {
+				l.Readers[r.ClientID] = true
+			} else {
+				return
+			}
+			l.Queue = l.Queue[1:]
+		}
+	case RWWriterPreference:
+		for i, r := range l.Queue {
+			if r.Write {
+				if free() {
+					l.Writer = r.ClientID
+					l.Queue = append(l.Queue[:i], l.Queue[i+1:]...)
+				}
+				return
+			}
+		}
+		if l.Writer == -1 {
+			readers()
+		}
+	case RWReaderPreference:
+		if l.Writer != -1 {
+			return
+		}
+		readers()
+		if len(l.Queue) > 0 && free() {
+			l.Writer = l.Queue[0].ClientID
+			l.Queue = l.Queue[1:]
+		}
+	}
+}
+
+// whether client id holds the lock in the mode it asked for.
+func (l *RWLockState) holds(id int, write bool) bool {
+	if write {
+		return l.Writer == id
+	}
+	return l.Readers[id]
+}
+
+// drop client id from the lock, as a holder or a waiter.
+func (l *RWLockState) drop(id int) {
+	if l.Writer == id {
+		l.Writer = -1
+	}
+	delete(l.Readers, id)
+	queue := l.Queue[:0]
+	for _, r := range l.Queue {
+		if r.ClientID != id {
+			queue = append(queue, r)
+		}
+	}
+	l.Queue = queue
+}
+
+// the reader-writer lock id, made with the central's policy if it is
+// new. c.mu must be held.
+func (c *Central) rwLock(id int) *RWLockState {
+	l, ok := c.rwlocks[id]
+	if !ok {
+		l = &RWLockState{Policy: c.rwPolicy, Writer: -1, Readers: make(map[int]bool), Seq: make(map[int]int64)}
+		c.rwlocks[id] = l
+	}
+	return l
+}
+
+func (c *Central) RWLockAcquire(args *RWLockArgs, reply *RWLockReply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	if err := c.commit(Op{Type: opRWAcquire, ClientID: args.ClientID, ID: args.LockID, ReqSeq: args.Seq, Access: args.Access}); err != OK {
+		reply.Err = err
+		return nil
+	}
+	for !c.killed() {
+		c.mu.Lock()
+		l := c.rwLock(args.LockID)
+		held := l.holds(args.ClientID, args.Access == 2)
+		if held {
+			reply.VC = l.VC.copy()
+			reply.Intervals = c.intervalsSince(l.VC, args.VC)
+			reply.Protected = append(reply.Protected, l.Protected...)
+		}
+		c.mu.Unlock()
+		if held {
+			reply.Err = OK
+			return nil
+		}
+		if !c.isLeader() {
+			// the client will wait at the new leader
+			reply.Err = ErrWrongLeader
+			return nil
+		}
+		time.Sleep(pollInterval)
+	}
+	reply.Err = ErrWrongLeader
+	return nil
+}
+
+func (c *Central) RWLockRelease(args *RWLockArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opRWRelease, ClientID: args.ClientID, ID: args.LockID, ReqSeq: args.Seq, Access: args.Access, VC: args.VC, Intervals: args.Intervals})
+	return nil
+}
+
+func (c *Central) RWLockProtect(args *RWLockArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	reply.Err = c.commit(Op{Type: opRWProtect, ClientID: args.ClientID, ID: args.LockID, ReqSeq: args.Seq, Addr: args.Addr, Size: args.Size})
+	return nil
+}
+
+// apply a reader-writer lock request. c.mu must be held.
+func (c *Central) applyRWLock(op Op) {
+	l := c.rwLock(op.ID)
+	if op.Type == opRWProtect {
+		// which may be applied more than once
+		seen := make(map[uintptr]bool)
+		for _, pg := range l.Protected {
+			seen[pg] = true
+		}
+		for pg := pageOf(op.Addr); pg < op.Addr+op.Size; pg += uintptr(PageSize) {
+			if !seen[pg] {
+				l.Protected = append(l.Protected, pg)
+			}
+		}
+		sort.Slice(l.Protected, func(i, j int) bool { return l.Protected[i] < l.Protected[j] })
+		return
+	}
+	if op.ReqSeq <= l.Seq[op.ClientID] {
+		return
+	}
+	l.Seq[op.ClientID] = op.ReqSeq
+	switch op.Type {
+	case opRWAcquire:
+		l.Queue = append(l.Queue, RWRequest{ClientID: op.ClientID, Write: op.Access == 2})
+	case opRWRelease:
+		if !l.holds(op.ClientID, op.Access == 2) {
+			return
+		}
+		if op.Access == 2 {
+			l.Writer = -1
+			c.addIntervals(op.Intervals)
+			if l.VC == nil {
+				l.VC = make(VectorClock)
+			}
+			l.VC.merge(op.VC)
+		} else {
+			delete(l.Readers, op.ClientID)
+		}
+	}
+	l.grant()
+}
+
+// this client's side of reader-writer lock id: its threads take rw
+// in the mode they want, and the first reader among them takes the
+// lock from the central for all of them.
+type localRWLock struct {
+	rw      sync.RWMutex
+	mu      sync.Mutex
+	readers int
+}
+
+func (c *Client) localRWLock(id int) *localRWLock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.rwlocks[id]
+	if !ok {
+		l = &localRWLock{}
+		c.rwlocks[id] = l
+	}
+	return l
+}
+
+// ask the central for reader-writer lock id in access mode 1 (shared)
+// or 2 (exclusive).
+func (c *Client) rwAcquire(id int, access int) {
+	log.Println("acquiring reader-writer lock", id, "with access", access)
+	args := &RWLockArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Access: access, VC: c.clock()}
+	reply := &RWLockReply{}
+	c.callManagerAt(c.syncManager(id), "Central.RWLockAcquire", args, reply)
+	if access == 1 {
+		c.prefetch(reply.Protected)
+	}
+	c.lrcAcquire(reply.Intervals, reply.VC)
+	c.Acquire()
+}
+
+func (c *Client) rwRelease(id int, access int) {
+	log.Println("releasing reader-writer lock", id, "with access", access)
+	args := &RWLockArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Access: access}
+	if access == 2 {
+		c.Release()
+		args.Intervals, args.VC = c.lrcPublish()
+	}
+	c.callManagerAt(c.syncManager(id), "Central.RWLockRelease", args, &Reply{})
+	c.lrcPublished(args.Intervals)
+}
+
+// ReadLock blocks until this client holds reader-writer lock id in
+// shared mode, along with any other readers. Under sequential
+// consistency, the pages the lock protects come with it, read-only.
+func (c *Client) ReadLock(id int) {
+	l := c.localRWLock(id)
+	l.rw.RLock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers == 0 {
+		c.rwAcquire(id, 1)
+	}
+	l.readers++
+}
+
+// ReadUnlock gives up this thread's shared hold on lock id. The
+// client releases the lock when its last reader does.
+func (c *Client) ReadUnlock(id int) {
+	l := c.localRWLock(id)
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		c.rwRelease(id, 1)
+	}
+	l.mu.Unlock()
+	l.rw.RUnlock()
+}
+
+// WriteLock blocks until this client holds reader-writer lock id
+// exclusive. Under release consistency, it then sees every write
+// released before.
+func (c *Client) WriteLock(id int) {
+	c.localRWLock(id).rw.Lock()
+	c.rwAcquire(id, 2)
+}
+
+// WriteUnlock releases lock id, after releasing this client's writes
+// under release consistency.
+func (c *Client) WriteUnlock(id int) {
+	c.rwRelease(id, 2)
+	c.localRWLock(id).rw.Unlock()
+}
+
+// RWLockProtect tells reader-writer lock id that it protects the size
+// bytes at addr.
+func (c *Client) RWLockProtect(id int, addr uintptr, size int) {
+	args := &RWLockArgs{ClientID: c.id, Seq: atomic.AddInt64(&c.seq, 1), LockID: id, Addr: addr, Size: uintptr(size)}
+	c.callManagerAt(c.syncManager(id), "Central.RWLockProtect", args, &Reply{})
+}
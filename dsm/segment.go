@@ -0,0 +1,172 @@
+package dsm
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Named segments of the shared region. The central keeps a registry
+// of segments, each a run of whole pages carved out of the region
+// like a page-aligned allocation, so that independent programs can
+// find the same data by name. A destroyed segment loses its name at
+// once, but keeps its pages until every client that opened it has
+// closed it. Like an allocation, a new segment may hold whatever its
+// pages last held.
+
+// A segment, as the central keeps it.
+type Segment struct {
+	Name      string
+	Extent            // in whole pages
+	Length    uintptr // the size it was created with
+	BlockSize uintptr // 0 for the central's
+	Update    bool    // write-update instead of write-invalidate
+	Creator   int
+	Openers   map[int]bool
+	Destroyed bool
+}
+
+// the segment called name, or nil. c.mu must be held.
+func (c *Central) segmentNamed(name string) *Segment {
+	for _, s := range c.segments {
+		if s.Name == name && !s.Destroyed {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *Central) segmentOpen(clientID int, name string, size uintptr, blockSize uintptr, update bool) (uintptr, uintptr, Err) {
+	s := c.segmentNamed(name)
+	if s == nil {
+		if size == 0 {
+			return 0, 0, ErrNoSegment
+		}
+		e, err := c.carve(size, uintptr(PageSize))
+		if err != OK {
+			return 0, 0, err
+		}
+		s = &Segment{Name: name, Extent: e, Length: size, BlockSize: blockSize, Update: update, Creator: clientID}
+		c.segments[e.Offset] = s
+	} else if size > s.Length {
+		return 0, 0, ErrSegmentSize
+	}
+	if s.Openers == nil {
+		s.Openers = make(map[int]bool)
+	}
+	s.Openers[clientID] = true
+	return s.Offset, s.Length, OK
+}
+
+func (c *Central) segmentClose(clientID int, base uintptr) Err {
+	s, ok := c.segments[base]
+	if !ok || !s.Openers[clientID] {
+		return ErrNoSegment
+	}
+	delete(s.Openers, clientID)
+	c.maybeFreeSegment(s)
+	return OK
+}
+
+func (c *Central) segmentDestroy(name string) Err {
+	s := c.segmentNamed(name)
+	if s == nil {
+		return ErrNoSegment
+	}
+	s.Destroyed = true
+	c.maybeFreeSegment(s)
+	return OK
+}
+
+func (c *Central) maybeFreeSegment(s *Segment) {
+	if s.Destroyed && len(s.Openers) == 0 {
+		delete(c.segments, s.Offset)
+		c.uncarve(s.Extent)
+	}
+}
+
+func (c *Central) SegmentOpen(args *SegmentArgs, reply *SegmentReply) error {
+	blockSize := c.segmentBlockSize(args.Name, args.BlockSize)
+	c.segmentRequest(Op{Type: opSegmentOpen, ClientID: args.ClientID, ReqSeq: args.Seq, Name: args.Name, Size: args.Size, BlockSize: blockSize, Update: args.Update || UpdateSegments[args.Name]}, reply)
+	return nil
+}
+
+func (c *Central) SegmentClose(args *SegmentArgs, reply *SegmentReply) error {
+	c.segmentRequest(Op{Type: opSegmentClose, ClientID: args.ClientID, ReqSeq: args.Seq, Addr: args.Base}, reply)
+	return nil
+}
+
+func (c *Central) SegmentDestroy(args *SegmentArgs, reply *SegmentReply) error {
+	c.segmentRequest(Op{Type: opSegmentDestroy, ClientID: args.ClientID, ReqSeq: args.Seq, Name: args.Name}, reply)
+	return nil
+}
+
+func (c *Central) segmentRequest(op Op, reply *SegmentReply) {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return
+	}
+	if err := c.commit(op); err != OK {
+		reply.Err = err
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := c.allocResults[op.ClientID]
+	reply.Base = res.Offset
+	reply.Size = res.Size
+	reply.Err = res.Err
+}
+
+func (c *Client) segmentRequest(rpcname string, args *SegmentArgs) *SegmentReply {
+	c.alloc.Lock()
+	defer c.alloc.Unlock()
+	args.ClientID = c.id
+	args.Seq = atomic.AddInt64(&c.seq, 1)
+	reply := &SegmentReply{}
+	c.callManagerAt(0, rpcname, args, reply)
+	if reply.Err != OK {
+		log.Println(rpcname, args.Name, args.Base, "failed:", reply.Err)
+	}
+	return reply
+}
+
+// SegmentOpen opens the segment called name, creating it with size
+// bytes if it doesn't exist, and returns its offset in the shared
+// region and its size. A size of 0 only opens an existing segment.
+// It fails if there is no such segment, or it has fewer than size
+// bytes, or there is no room to create it.
+func (c *Client) SegmentOpen(name string, size int) (uintptr, int, bool) {
+	return c.SegmentOpenWith(name, size, SegmentOptions{})
+}
+
+// How to create a segment, if SegmentOpenWith creates it.
+type SegmentOptions struct {
+	BlockSize int  // bytes in a block; 0 for the central's
+	Update    bool // write-update instead of write-invalidate
+}
+
+// SegmentOpenBlocks is SegmentOpen, asking for blocks of blockSize
+// bytes if it creates the segment. The central's configuration for
+// the segment's name, if any, overrides blockSize.
+func (c *Client) SegmentOpenBlocks(name string, size int, blockSize int) (uintptr, int, bool) {
+	return c.SegmentOpenWith(name, size, SegmentOptions{BlockSize: blockSize})
+}
+
+// SegmentOpenWith is SegmentOpen, creating the segment with opts if
+// it creates it. The central's configuration for the segment's name
+// overrides opts.
+func (c *Client) SegmentOpenWith(name string, size int, opts SegmentOptions) (uintptr, int, bool) {
+	reply := c.segmentRequest("Central.SegmentOpen", &SegmentArgs{Name: name, Size: uintptr(size), BlockSize: uintptr(opts.BlockSize), Update: opts.Update})
+	return reply.Base, int(reply.Size), reply.Err == OK
+}
+
+// SegmentClose closes the segment at base.
+func (c *Client) SegmentClose(base uintptr) {
+	c.segmentRequest("Central.SegmentClose", &SegmentArgs{Base: base})
+}
+
+// SegmentDestroy removes the segment called name, reporting false if
+// there is none. Its pages are freed once no client has it open.
+func (c *Client) SegmentDestroy(name string) bool {
+	return c.segmentRequest("Central.SegmentDestroy", &SegmentArgs{Name: name}).Err == OK
+}
@@ -0,0 +1,1854 @@
+package dsm
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBasic(t *testing.T) {
+	cfg := make_config(t, 2, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: one writer, one reader")
+
+	cfg.write(0, 10, 42)
+	if v := cfg.read(1, 10); v != 42 {
+		t.Fatalf("client 1 read %v; expected 42", v)
+	}
+
+	// the reader's copy is now valid, so reading it again is local.
+	nrpc := cfg.rpcTotal()
+	cfg.read(1, 11)
+	if cfg.rpcTotal() != nrpc {
+		t.Fatalf("read of a valid page sent %v RPCs", cfg.rpcTotal()-nrpc)
+	}
+
+	cfg.write(1, 10, 43)
+	cfg.checkAll(10, 43)
+
+	cfg.end()
+}
+
+func TestReadSharing(t *testing.T) {
+	cfg := make_config(t, 4, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: readers share a page, then a writer invalidates them")
+
+	addr := uintptr(PageSize + 7)
+	cfg.write(0, addr, 1)
+
+	var wg sync.WaitGroup
+	for i := 1; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if v := cfg.read(i, addr); v != 1 {
+				t.Errorf("client %v read %v; expected 1", i, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cfg.write(2, addr, 2)
+	cfg.checkAll(addr, 2)
+
+	cfg.end()
+}
+
+// each client writes its own bytes of the same pages, so every
+// write ping-pongs the page between clients.
+func concurrentWriters(t *testing.T, cfg *config, iters int) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for it := 0; it < iters; it++ {
+				for pg := 0; pg < cfg.npages; pg++ {
+					addr := uintptr(pg*PageSize + i)
+					cfg.write(i, addr, byte(it+1))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for pg := 0; pg < cfg.npages; pg++ {
+		for i := 0; i < cfg.n; i++ {
+			cfg.checkAll(uintptr(pg*PageSize+i), byte(iters))
+		}
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	cfg := make_config(t, 3, 2, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: concurrent writers to shared pages")
+	concurrentWriters(t, cfg, 20)
+	cfg.end()
+}
+
+func TestUnreliable(t *testing.T) {
+	cfg := make_config(t, 3, 2, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: concurrent writers, unreliable network")
+	concurrentWriters(t, cfg, 10)
+	cfg.end()
+}
+
+func TestReordering(t *testing.T) {
+	cfg := make_config(t, 2, 1, false)
+	defer cfg.cleanup()
+
+	cfg.net.LongReordering(true)
+
+	cfg.begin("Test: concurrent writers, reordered replies")
+	concurrentWriters(t, cfg, 2)
+	cfg.end()
+}
+
+func TestReplicatedBasic(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 2, 2, false, -1, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: replicated central")
+
+	cfg.write(0, 10, 42)
+	cfg.checkAll(10, 42)
+	cfg.write(1, uintptr(PageSize), 7)
+	cfg.checkAll(uintptr(PageSize), 7)
+
+	cfg.end()
+}
+
+func TestReplicatedLeaderFailure(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 3, 2, false, -1, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: central leader fails")
+
+	cfg.write(0, 10, 1)
+	cfg.checkAll(10, 1)
+
+	leader1 := cfg.leader()
+	cfg.crashReplica(leader1)
+
+	// the surviving replicas know who owns the page.
+	cfg.write(1, 10, 2)
+	cfg.checkAll(10, 2)
+	concurrentWriters(t, cfg, 3)
+
+	// bring the old leader back and fail the new one.
+	cfg.startReplica(leader1, -1)
+	leader2 := cfg.leader()
+	cfg.crashReplica(leader2)
+
+	cfg.write(2, 10, 3)
+	cfg.checkAll(10, 3)
+
+	cfg.end()
+}
+
+func TestReplicatedSnapshot(t *testing.T) {
+	maxraftstate := 2000
+	cfg := make_replicated_config(t, 3, 2, 2, false, maxraftstate, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: replicated central snapshots its log")
+
+	for it := 0; it < 30; it++ {
+		cfg.write(it%2, 10, byte(it))
+	}
+	for i := range cfg.replicas {
+		if sz := cfg.persisters[i].RaftStateSize(); sz > 2*maxraftstate {
+			t.Fatalf("replica %v has a %v-byte log; expected at most %v", i, sz, 2*maxraftstate)
+		}
+		if cfg.persisters[i].SnapshotSize() == 0 {
+			t.Fatalf("replica %v never snapshotted", i)
+		}
+	}
+
+	// a restarted replica recovers the page tables from its snapshot.
+	leader1 := cfg.leader()
+	cfg.crashReplica(leader1)
+	cfg.startReplica(leader1, maxraftstate)
+	cfg.crashReplica((leader1 + 1) % len(cfg.replicas))
+	cfg.write(0, 10, 99)
+	cfg.checkAll(10, 99)
+
+	cfg.end()
+}
+
+func TestFixedManager(t *testing.T) {
+	cfg := make_distributed_config(t, 4, 4, false, FixedManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: fixed distributed managers")
+
+	cfg.write(0, 10, 42)
+	cfg.checkAll(10, 42)
+	cfg.write(3, uintptr(3*PageSize), 7)
+	cfg.checkAll(uintptr(3*PageSize), 7)
+	concurrentWriters(t, cfg, 10)
+
+	cfg.end()
+}
+
+func TestFixedManagerUnreliable(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 3, true, FixedManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: fixed distributed managers, unreliable network")
+	concurrentWriters(t, cfg, 5)
+	cfg.end()
+}
+
+func TestDynamicManager(t *testing.T) {
+	cfg := make_distributed_config(t, 4, 4, false, DynamicManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: dynamic distributed manager")
+
+	// pass the page around, so that the probable owners form
+	// a chain.
+	for i := 0; i < cfg.n; i++ {
+		cfg.write(i, 10, byte(i+1))
+	}
+	cfg.checkAll(10, byte(cfg.n))
+	cfg.write(0, 10, 42)
+	cfg.checkAll(10, 42)
+	concurrentWriters(t, cfg, 10)
+
+	cfg.end()
+}
+
+func TestDynamicManagerUnreliable(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 3, true, DynamicManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: dynamic distributed manager, unreliable network")
+	concurrentWriters(t, cfg, 5)
+	cfg.end()
+}
+
+func TestDynamicManagerReordering(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 1, false, DynamicManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.net.LongReordering(true)
+
+	cfg.begin("Test: dynamic distributed manager, reordered replies")
+	concurrentWriters(t, cfg, 2)
+	cfg.end()
+}
+
+func TestReleaseConsistency(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 2, 1, false, -1, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: release consistency")
+
+	// both clients write the same page, without taking it
+	// from each other.
+	cfg.write(0, 0, 1)
+	cfg.write(1, 1, 2)
+	nrpc := cfg.rpcTotal()
+	cfg.write(0, 2, 3)
+	cfg.write(1, 3, 4)
+	if cfg.rpcTotal() != nrpc {
+		t.Fatalf("writes to a twinned page sent %v RPCs", cfg.rpcTotal()-nrpc)
+	}
+	// neither sees the other's writes until they release and
+	// acquire.
+	if v := cfg.read(1, 0); v != 0 {
+		t.Fatalf("client 1 read %v before client 0 released; expected 0", v)
+	}
+
+	cfg.clients[0].Release()
+	cfg.clients[1].Release()
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].Acquire()
+	}
+	for addr := uintptr(0); addr < 4; addr++ {
+		cfg.checkAll(addr, byte(addr+1))
+	}
+
+	cfg.end()
+}
+
+// each client writes its own bytes of the same pages between an
+// acquire and a release.
+func releaseWriters(t *testing.T, cfg *config, iters int) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for it := 0; it < iters; it++ {
+				cfg.clients[i].Acquire()
+				for pg := 0; pg < cfg.npages; pg++ {
+					addr := uintptr(pg*PageSize + i)
+					if v := cfg.read(i, addr); it > 0 && v != byte(it) {
+						t.Errorf("client %v read %v at %v; expected %v", i, v, addr, it)
+					}
+					cfg.write(i, addr, byte(it+1))
+				}
+				cfg.clients[i].Release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].Acquire()
+	}
+	for pg := 0; pg < cfg.npages; pg++ {
+		for i := 0; i < cfg.n; i++ {
+			cfg.checkAll(uintptr(pg*PageSize+i), byte(iters))
+		}
+	}
+}
+
+func TestReleaseFalseSharing(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 4, 2, false, -1, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: release consistency, false sharing")
+	releaseWriters(t, cfg, 20)
+	cfg.end()
+}
+
+func TestReleaseUnreliable(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 3, true, FixedManager, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: release consistency, fixed managers, unreliable network")
+	releaseWriters(t, cfg, 5)
+	cfg.end()
+}
+
+func TestReleaseReplicated(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 3, 2, false, 2000, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: release consistency, replicated central")
+	releaseWriters(t, cfg, 5)
+
+	// the diffs survive the leader.
+	cfg.crashReplica(cfg.leader())
+	releaseWriters(t, cfg, 10)
+	cfg.end()
+}
+
+// each client writes its own bytes of the same pages, with a barrier
+// between rounds.
+func barrierWriters(t *testing.T, cfg *config, iters int) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for it := 0; it < iters; it++ {
+				for pg := 0; pg < cfg.npages; pg++ {
+					cfg.write(i, uintptr(pg*PageSize+i), byte(it+1))
+				}
+				cfg.clients[i].Barrier(1)
+				for pg := 0; pg < cfg.npages; pg++ {
+					for j := 0; j < cfg.n; j++ {
+						if v := cfg.read(i, uintptr(pg*PageSize+j)); v != byte(it+1) {
+							t.Errorf("client %v read %v from client %v; expected %v", i, v, j, it+1)
+						}
+					}
+				}
+				cfg.clients[i].Barrier(2)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestLazyRelease(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 3, 2, false, -1, LazyReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: lazy release consistency")
+
+	cfg.read(2, 0)
+	cfg.clients[0].LockAcquire(1)
+	cfg.write(0, 0, 1)
+	cfg.clients[0].LockRelease(1)
+
+	// only the acquirer invalidates, and it fetches the diff when
+	// it faults.
+	cfg.clients[1].LockAcquire(1)
+	if a := cfg.mems[2].Access(0); a != 1 {
+		t.Fatalf("client 2's copy has access %v after another client's acquire", a)
+	}
+	if v := cfg.read(1, 0); v != 1 {
+		t.Fatalf("client 1 read %v; expected 1", v)
+	}
+	cfg.write(1, 1, 2)
+	cfg.clients[1].LockRelease(1)
+	if v := cfg.read(2, 0); v != 0 {
+		t.Fatalf("client 2 read %v before acquiring; expected 0", v)
+	}
+
+	// an acquirer gets the write notices of every interval before
+	// the release, whoever wrote them.
+	cfg.clients[2].LockAcquire(1)
+	if v := cfg.read(2, 0); v != 1 {
+		t.Fatalf("client 2 read %v; expected 1", v)
+	}
+	if v := cfg.read(2, 1); v != 2 {
+		t.Fatalf("client 2 read %v; expected 2", v)
+	}
+	cfg.clients[2].LockRelease(1)
+
+	lockedCounter(t, cfg, 10)
+	barrierWriters(t, cfg, 5)
+
+	// barriers collect every interval and diff that all clients
+	// have brought their pages up to date with.
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < 2*lrcCollectEvery; k++ {
+				cfg.clients[i].Barrier(3)
+			}
+		}(i)
+	}
+	wg.Wait()
+	cfg.central.mu.Lock()
+	for id, intervals := range cfg.central.intervals {
+		if len(intervals) > 0 {
+			t.Fatalf("the central still has %v intervals of client %v", len(intervals), id)
+		}
+	}
+	cfg.central.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].mu.Lock()
+		if n := len(cfg.clients[i].lrcDiffs); n > 0 {
+			t.Fatalf("client %v still has diffs of %v pages", i, n)
+		}
+		cfg.clients[i].mu.Unlock()
+	}
+	for pg := 0; pg < cfg.npages; pg++ {
+		for j := 0; j < cfg.n; j++ {
+			cfg.checkAll(uintptr(pg*PageSize+j), 5)
+		}
+	}
+	cfg.end()
+}
+
+func TestLazyReleaseDistributed(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 2, false, FixedManager, LazyReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: lazy release consistency, fixed managers")
+	lockedCounter(t, cfg, 10)
+	barrierWriters(t, cfg, 5)
+	cfg.end()
+}
+
+// each client adds 1 to a shared counter iters times, holding lock 0.
+func lockedCounter(t *testing.T, cfg *config, iters int) {
+	cfg.clients[0].LockAcquire(0)
+	start := cfg.read(0, 0)
+	cfg.clients[0].LockRelease(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for it := 0; it < iters; it++ {
+				cfg.clients[i].LockAcquire(0)
+				v := cfg.read(i, 0)
+				cfg.write(i, 0, v+1)
+				cfg.clients[i].LockRelease(0)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cfg.clients[0].LockAcquire(0)
+	if v := cfg.read(0, 0); v != start+byte(cfg.n*iters) {
+		t.Fatalf("counter is %v; expected %v", v, start+byte(cfg.n*iters))
+	}
+	cfg.clients[0].LockRelease(0)
+}
+
+func TestLock(t *testing.T) {
+	cfg := make_config(t, 3, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: clients increment a counter under a lock")
+	lockedCounter(t, cfg, 20)
+	cfg.end()
+}
+
+func TestLockFIFO(t *testing.T) {
+	cfg := make_config(t, 4, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a lock is granted in the order it was asked for")
+
+	cfg.clients[0].LockAcquire(7)
+	granted := make(chan int, cfg.n)
+	for i := 1; i < cfg.n; i++ {
+		go func(i int) {
+			cfg.clients[i].LockAcquire(7)
+			granted <- i
+			cfg.clients[i].LockRelease(7)
+		}(i)
+		// wait for client i to queue up
+		for {
+			cfg.central.mu.Lock()
+			n := len(cfg.central.lockTable[7].Queue)
+			cfg.central.mu.Unlock()
+			if n == i {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cfg.clients[0].LockRelease(7)
+	for i := 1; i < cfg.n; i++ {
+		if j := <-granted; j != i {
+			t.Fatalf("client %v got the lock; expected client %v", j, i)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestLockRelease(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 3, 1, false, -1, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a lock orders release consistent writes")
+	lockedCounter(t, cfg, 20)
+	cfg.end()
+}
+
+func TestLockUnreliable(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 1, true, FixedManager, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: locks at fixed managers, unreliable network")
+	lockedCounter(t, cfg, 5)
+	cfg.end()
+}
+
+func TestLockReplicated(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 3, 1, false, -1, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: locks at a replicated central")
+	lockedCounter(t, cfg, 5)
+	cfg.crashReplica(cfg.leader())
+	lockedCounter(t, cfg, 5)
+	cfg.end()
+}
+
+// in each phase, every client writes its own byte, waits at the
+// barrier, and then reads everyone else's.
+func barrierPhases(t *testing.T, cfg *config, phases int) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for ph := 0; ph < phases; ph++ {
+				cfg.write(i, uintptr(i), byte(ph+1))
+				cfg.clients[i].Barrier(3)
+				for j := 0; j < cfg.n; j++ {
+					if v := cfg.read(i, uintptr(j)); v != byte(ph+1) {
+						t.Errorf("client %v read %v from client %v in phase %v", i, v, j, ph)
+					}
+				}
+				// nobody writes the next phase until
+				// everyone has read this one.
+				cfg.clients[i].Barrier(4)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCondition(t *testing.T) {
+	cfg := make_config(t, 3, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: producer and consumers on condition variables")
+
+	// a one-slot buffer: byte 0 says whether it is full, byte 1
+	// holds the value. lock 0 guards it; condition 1 is "full" and
+	// condition 2 is "empty".
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for v := 1; v <= n; v++ {
+			cfg.clients[0].LockAcquire(0)
+			for cfg.read(0, 0) != 0 {
+				cfg.clients[0].CondWait(2, 0)
+			}
+			cfg.write(0, 1, byte(v))
+			cfg.write(0, 0, 1)
+			cfg.clients[0].CondSignal(1)
+			cfg.clients[0].LockRelease(0)
+		}
+	}()
+	sums := make([]int, cfg.n)
+	for i := 1; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < n/2; k++ {
+				cfg.clients[i].LockAcquire(0)
+				for cfg.read(i, 0) != 1 {
+					cfg.clients[i].CondWait(1, 0)
+				}
+				sums[i] += int(cfg.read(i, 1))
+				cfg.write(i, 0, 0)
+				cfg.clients[i].CondSignal(2)
+				cfg.clients[i].LockRelease(0)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if sum := sums[1] + sums[2]; sum != n*(n+1)/2 {
+		t.Fatalf("consumers took %v in all; expected %v", sum, n*(n+1)/2)
+	}
+
+	// a broadcast wakes every waiter.
+	woken := make(chan int, cfg.n)
+	for i := 1; i < cfg.n; i++ {
+		go func(i int) {
+			cfg.clients[i].LockAcquire(0)
+			cfg.clients[i].CondWait(3, 0)
+			cfg.clients[i].LockRelease(0)
+			woken <- i
+		}(i)
+	}
+	for {
+		cfg.central.mu.Lock()
+		waiting := 0
+		if cv, ok := cfg.central.conds[3]; ok {
+			waiting = len(cv.Waiting)
+		}
+		cfg.central.mu.Unlock()
+		if waiting == cfg.n-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case i := <-woken:
+		t.Fatalf("client %v woke before the broadcast", i)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cfg.clients[0].CondBroadcast(3)
+	for i := 1; i < cfg.n; i++ {
+		<-woken
+	}
+
+	cfg.end()
+}
+
+func TestSemaphore(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 3, 1, false, -1, LazyReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: counting semaphores")
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].SemInit(1, 2)
+	}
+	passed := make(chan int, cfg.n)
+	for i := 0; i < cfg.n; i++ {
+		go func(i int) {
+			cfg.clients[i].SemWait(1)
+			passed <- i
+		}(i)
+	}
+	<-passed
+	<-passed
+	select {
+	case i := <-passed:
+		t.Fatalf("client %v took from an empty semaphore", i)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cfg.clients[0].SemPost(1)
+	<-passed
+
+	// a post carries the poster's writes to the next waiter.
+	for v := 1; v <= 5; v++ {
+		cfg.write(0, 0, byte(v))
+		cfg.clients[0].SemPost(2)
+		cfg.clients[1].SemWait(2)
+		if x := cfg.read(1, 0); x != byte(v) {
+			t.Fatalf("client 1 read %v after the post; expected %v", x, v)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestSemaphoreOneClient(t *testing.T) {
+	cfg := make_config(t, 2, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: semaphore requests from threads of one client")
+
+	// a post that overtakes an earlier wait doesn't make the wait
+	// look like a retry.
+	cfg.central.SemPost(&SemArgs{ClientID: 0, Seq: 1<<40 + 11, SemID: 1}, &Reply{})
+	reply := &SemReply{}
+	cfg.central.SemWait(&SemArgs{ClientID: 0, Seq: 1<<40 + 10, SemID: 1}, reply)
+	if reply.Err != OK {
+		t.Fatalf("wait failed: %v", reply.Err)
+	}
+	cfg.central.mu.Lock()
+	if n := cfg.central.sems[1].Count; n != 0 {
+		t.Fatalf("semaphore count is %v after a post and a wait; expected 0", n)
+	}
+	cfg.central.mu.Unlock()
+
+	// one thread waits while another posts.
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for k := 0; k < n; k++ {
+			cfg.clients[1].SemWait(2)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for k := 0; k < n; k++ {
+			cfg.clients[1].SemPost(2)
+		}
+	}()
+	wg.Wait()
+	cfg.central.mu.Lock()
+	s := cfg.central.sems[2]
+	if s.Count != 0 || len(s.Waiting) != 0 {
+		t.Fatalf("semaphore count %v with %v waiting after %v posts and waits", s.Count, len(s.Waiting), n)
+	}
+	cfg.central.mu.Unlock()
+
+	cfg.end()
+}
+
+// wait until n requests are queued at reader-writer lock id.
+func waitRWQueue(cfg *config, id int, n int) {
+	for {
+		cfg.central.mu.Lock()
+		queued := 0
+		if l, ok := cfg.central.rwlocks[id]; ok {
+			queued = len(l.Queue)
+		}
+		cfg.central.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRWLock(t *testing.T) {
+	cfg := make_config(t, 3, 2, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: reader-writer locks")
+
+	cfg.write(0, 0, 1)
+	cfg.clients[0].RWLockProtect(1, 0, PageSize)
+
+	// readers share the lock, and the protected page comes with it,
+	// read-only, from the writable owner.
+	cfg.clients[1].ReadLock(1)
+	cfg.clients[2].ReadLock(1)
+	buf := make([]byte, 1)
+	for i := 1; i < cfg.n; i++ {
+		if !cfg.mems[i].Load(0, buf) || buf[0] != 1 {
+			t.Fatalf("client %v has no copy of the protected page, or it is stale", i)
+		}
+		if a := cfg.mems[i].Access(0); a != 1 {
+			t.Fatalf("client %v has access %v to the protected page; expected 1", i, a)
+		}
+	}
+	if owner, _ := cfg.central.getOwner(0); owner.AccessType != 1 {
+		t.Fatalf("the owner has access %v with readers holding the lock; expected 1", owner.AccessType)
+	}
+
+	// a waiting writer holds back a new reader.
+	written := make(chan bool)
+	go func() {
+		cfg.clients[0].WriteLock(1)
+		cfg.write(0, 0, 7)
+		cfg.clients[0].WriteUnlock(1)
+		written <- true
+	}()
+	waitRWQueue(cfg, 1, 1)
+	cfg.clients[1].ReadUnlock(1)
+	read := make(chan byte)
+	go func() {
+		cfg.clients[1].ReadLock(1)
+		if !cfg.mems[1].Load(0, buf) {
+			t.Errorf("client 1 has no copy of the protected page after the write")
+		}
+		read <- buf[0]
+	}()
+	waitRWQueue(cfg, 1, 2)
+	select {
+	case <-written:
+		t.Fatalf("the writer got the lock while a reader held it")
+	case <-read:
+		t.Fatalf("a reader got the lock ahead of a waiting writer")
+	case <-time.After(100 * time.Millisecond):
+	}
+	cfg.clients[2].ReadUnlock(1)
+	<-written
+	if v := <-read; v != 7 {
+		t.Fatalf("client 1 read %v after the writer released; expected 7", v)
+	}
+
+	// a client's threads share its hold in shared mode.
+	cfg.clients[1].ReadLock(1)
+	cfg.clients[1].ReadUnlock(1)
+	cfg.clients[1].ReadUnlock(1)
+	cfg.central.mu.Lock()
+	if l := cfg.central.rwlocks[1]; len(l.Readers) != 0 || l.Writer != -1 {
+		t.Fatalf("the lock is still held after every reader released it")
+	}
+	cfg.central.mu.Unlock()
+
+	// the other policies, with client 1 reading, and client 0 then
+	// client 2 asking to write and to read.
+	queued := func(policy RWPolicy) *RWLockState {
+		l := &RWLockState{Policy: policy, Writer: -1, Readers: map[int]bool{1: true}}
+		l.Queue = []RWRequest{{ClientID: 0, Write: true}, {ClientID: 2}}
+		l.grant()
+		return l
+	}
+	if l := queued(RWReaderPreference); !l.Readers[2] || len(l.Queue) != 1 {
+		t.Fatalf("under reader preference, a reader waited behind a writer")
+	}
+	l := queued(RWFair)
+	if l.Readers[2] || len(l.Queue) != 2 {
+		t.Fatalf("under the fair policy, a reader went ahead of a writer")
+	}
+	l.drop(1)
+	l.grant()
+	if l.Writer != 0 || l.Readers[2] {
+		t.Fatalf("under the fair policy, the writer didn't go next")
+	}
+
+	cfg.end()
+}
+
+// each client adds 1 to the 64-bit word at addr iters times, and
+// the word ends up with all of them.
+func atomicCounter(t *testing.T, cfg *config, addr uintptr, iters int) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for it := 0; it < iters; it++ {
+				cfg.clients[i].FetchAdd(addr, 8, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if v := cfg.clients[0].FetchAdd(addr, 8, 0); v != uint64(cfg.n*iters) {
+		t.Fatalf("counter is %v; expected %v", v, cfg.n*iters)
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	cfg := make_config(t, 3, 2, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: atomic operations on shared words")
+
+	atomicCounter(t, cfg, 8, 20)
+	cfg.checkAll(8, 60)
+
+	// at the owner of a writable page, which keeps it.
+	cfg.write(0, 0, 1)
+	if old := cfg.clients[1].FetchAdd(16, 4, 5); old != 0 {
+		t.Fatalf("fetch-add found %v; expected 0", old)
+	}
+	if a := cfg.mems[0].Access(0); a != 2 {
+		t.Fatalf("the owner has access %v after an atomic operation; expected 2", a)
+	}
+	cfg.checkAll(16, 5)
+
+	// compare-and-swap succeeds only on the expected value.
+	if old := cfg.clients[2].CompareAndSwap(16, 4, 4, 9); old != 5 {
+		t.Fatalf("compare-and-swap found %v; expected 5", old)
+	}
+	if old := cfg.clients[2].CompareAndSwap(16, 4, 5, 9); old != 5 {
+		t.Fatalf("compare-and-swap found %v; expected 5", old)
+	}
+	if old := cfg.clients[0].Swap(16, 4, 0xffffffff); old != 9 {
+		t.Fatalf("swap found %v; expected 9", old)
+	}
+	// a 32-bit add wraps without touching the next word.
+	if old := cfg.clients[1].FetchAdd(16, 4, 1); old != 0xffffffff {
+		t.Fatalf("fetch-add found %v; expected %v", old, uint32(0xffffffff))
+	}
+	cfg.checkAll(16, 0)
+	cfg.checkAll(20, 0)
+
+	cfg.end()
+}
+
+func TestAtomicUnreliable(t *testing.T) {
+	cfg := make_config(t, 3, 1, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: atomic operations, unreliable network")
+	atomicCounter(t, cfg, 0, 10)
+	cfg.end()
+}
+
+func TestAtomicRelease(t *testing.T) {
+	cfg := make_distributed_config(t, 3, 2, false, FixedManager, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: atomic operations, release consistency")
+	atomicCounter(t, cfg, uintptr(PageSize)+8, 10)
+	for i := 0; i < cfg.n; i++ {
+		cfg.clients[i].Acquire()
+	}
+	cfg.checkAll(uintptr(PageSize)+8, 30)
+	cfg.end()
+}
+
+func TestBarrier(t *testing.T) {
+	cfg := make_config(t, 4, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: clients wait for each other at barriers")
+	barrierPhases(t, cfg, 5)
+	cfg.end()
+}
+
+func TestBarrierRelease(t *testing.T) {
+	cfg := make_replicated_config(t, 0, 4, 1, false, -1, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: barriers order release consistent writes")
+	barrierPhases(t, cfg, 5)
+	cfg.end()
+}
+
+func TestBarrierUnreliable(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 3, 1, true, -1, ReleaseConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: barriers at a replicated central, unreliable network")
+	barrierPhases(t, cfg, 3)
+	cfg.end()
+}
+
+func TestMalloc(t *testing.T) {
+	cfg := make_config(t, 3, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: allocate the shared region")
+
+	// every client gets the same named allocation.
+	offsets := make([]uintptr, cfg.n)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offset, ok := cfg.clients[i].Malloc("table", 100, false)
+			if !ok {
+				t.Errorf("client %v could not allocate the table", i)
+			}
+			offsets[i] = offset
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i < cfg.n; i++ {
+		if offsets[i] != offsets[0] {
+			t.Fatalf("client %v got the table at %v; client 0 got it at %v", i, offsets[i], offsets[0])
+		}
+	}
+	cfg.write(0, offsets[0]+99, 5)
+	cfg.checkAll(offsets[0]+99, 5)
+
+	// a named allocation can't grow, or become page-aligned.
+	if _, ok := cfg.clients[1].Malloc("table", 10000, true); ok {
+		t.Fatalf("got a bigger, page-aligned table")
+	}
+	if _, ok := cfg.clients[1].Malloc("table", 200, false); ok {
+		t.Fatalf("got a bigger table")
+	}
+	if _, ok := cfg.clients[1].Malloc("table", 100, true); ok {
+		t.Fatalf("got a page-aligned table")
+	}
+
+	// anonymous allocations don't overlap.
+	a, _ := cfg.clients[1].Malloc("", 10, false)
+	b, _ := cfg.clients[2].Malloc("", 10, false)
+	if a == b || a < offsets[0]+100 || b < offsets[0]+100 {
+		t.Fatalf("allocations overlap: table at %v, then %v and %v", offsets[0], a, b)
+	}
+
+	// a page-aligned allocation gets pages of its own.
+	pg, ok := cfg.clients[0].Malloc("", 1, true)
+	if !ok || pg%uintptr(PageSize) != 0 {
+		t.Fatalf("page-aligned allocation at %v", pg)
+	}
+	if _, ok := cfg.clients[0].Malloc("", 2*PageSize, true); !ok {
+		t.Fatalf("could not allocate two pages")
+	}
+	// the region is full of pages now.
+	if _, ok := cfg.clients[0].Malloc("", PageSize, true); ok {
+		t.Fatalf("allocated a page past the end of the region")
+	}
+	cfg.clients[0].Free(pg)
+	if again, ok := cfg.clients[1].Malloc("", PageSize, true); !ok || again != pg {
+		t.Fatalf("freed page at %v was not reused; got %v", pg, again)
+	}
+
+	cfg.end()
+}
+
+func TestMallocReplicated(t *testing.T) {
+	cfg := make_replicated_config(t, 3, 2, 2, true, -1, SequentialConsistency)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: allocate at a replicated central, unreliable network")
+
+	a, _ := cfg.clients[0].Malloc("a", 8, false)
+	cfg.crashReplica(cfg.leader())
+	if b, _ := cfg.clients[1].Malloc("a", 8, false); b != a {
+		t.Fatalf("client 1 got a at %v; client 0 got it at %v", b, a)
+	}
+	var offsets []uintptr
+	for i := 0; i < 10; i++ {
+		offset, ok := cfg.clients[i%2].Malloc("", 8, false)
+		if !ok {
+			t.Fatalf("could not allocate")
+		}
+		for _, o := range append(offsets, a) {
+			if o == offset {
+				t.Fatalf("%v allocated twice", offset)
+			}
+		}
+		offsets = append(offsets, offset)
+	}
+
+	cfg.end()
+}
+
+func TestSegments(t *testing.T) {
+	cfg := make_config(t, 3, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: named segments")
+
+	base, size, ok := cfg.clients[0].SegmentOpen("grid", 100)
+	if !ok || size != 100 || base%uintptr(PageSize) != 0 {
+		t.Fatalf("opened grid at %v with %v bytes", base, size)
+	}
+	cfg.write(0, base+5, 9)
+
+	// another client finds it by name.
+	base1, size1, ok := cfg.clients[1].SegmentOpen("grid", 0)
+	if !ok || base1 != base || size1 != 100 {
+		t.Fatalf("client 1 opened grid at %v with %v bytes; expected %v with 100", base1, size1, base)
+	}
+	if v := cfg.read(1, base1+5); v != 9 {
+		t.Fatalf("client 1 read %v; expected 9", v)
+	}
+	if _, _, ok := cfg.clients[2].SegmentOpen("grid", 200); ok {
+		t.Fatalf("opened grid with more bytes than it has")
+	}
+	if _, _, ok := cfg.clients[2].SegmentOpen("nothing", 0); ok {
+		t.Fatalf("opened a segment that doesn't exist")
+	}
+
+	// a destroyed segment loses its name, but keeps its pages
+	// while it is open.
+	if !cfg.clients[2].SegmentDestroy("grid") {
+		t.Fatalf("could not destroy grid")
+	}
+	if _, _, ok := cfg.clients[2].SegmentOpen("grid", 0); ok {
+		t.Fatalf("opened a destroyed segment")
+	}
+	other, _, ok := cfg.clients[2].SegmentOpen("grid", 3*PageSize)
+	if !ok || other == base {
+		t.Fatalf("new grid at %v; old one at %v", other, base)
+	}
+	if _, _, ok := cfg.clients[2].SegmentOpen("more", PageSize); ok {
+		t.Fatalf("opened a segment in pages that are still in use")
+	}
+
+	// once the last client closes the old segment, its page is free.
+	cfg.clients[0].SegmentClose(base)
+	cfg.clients[1].SegmentClose(base)
+	if more, _, ok := cfg.clients[2].SegmentOpen("more", PageSize); !ok || more != base {
+		t.Fatalf("opened more at %v; expected %v", more, base)
+	}
+
+	cfg.end()
+}
+
+// each client adds its index+1 to a shared counter.
+func TestRegion(t *testing.T) {
+	cfg := make_config(t, 2, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: Go regions")
+
+	r0 := cfg.clients[0].Region(0, 3*PageSize)
+	r1 := cfg.clients[1].Region(0, 3*PageSize)
+
+	// a write that spans a page boundary.
+	data := []byte("across the page boundary")
+	off := int64(PageSize - 6)
+	if n, err := r0.WriteAt(data, off); n != len(data) || err != nil {
+		t.Fatalf("wrote %v bytes: %v", n, err)
+	}
+	buf := make([]byte, len(data))
+	if n, err := r1.ReadAt(buf, off); n != len(data) || err != nil || string(buf) != string(data) {
+		t.Fatalf("client 1 read %q (%v bytes, %v); expected %q", buf[:n], n, err, data)
+	}
+
+	// ints go both ways, including one split across pages.
+	if err := r1.SetInt64At(16, -42); err != nil {
+		t.Fatalf("could not write an int: %v", err)
+	}
+	if err := r1.SetInt64At(int64(2*PageSize-4), 1<<40); err != nil {
+		t.Fatalf("could not write an int across pages: %v", err)
+	}
+	if v, err := r0.Int64At(16); v != -42 || err != nil {
+		t.Fatalf("client 0 read %v (%v); expected -42", v, err)
+	}
+	if v, err := r0.Int64At(int64(2*PageSize - 4)); v != 1<<40 || err != nil {
+		t.Fatalf("client 0 read %v (%v); expected %v", v, err, int64(1<<40))
+	}
+
+	// ints out of the region are errors.
+	if _, err := r0.Int64At(int64(3*PageSize - 4)); err == nil {
+		t.Fatalf("read an int past the end")
+	}
+	if err := r0.SetInt64At(-1, 1); err == nil {
+		t.Fatalf("wrote an int before the start")
+	}
+
+	// reads past the end are short.
+	if n, err := r0.ReadAt(buf, int64(3*PageSize-4)); n != 4 || err == nil {
+		t.Fatalf("read %v bytes at the end with error %v", n, err)
+	}
+
+	// only the mmapped region has a view.
+	if _, ok := r0.UnsafeBytes(false); ok {
+		t.Fatalf("got a view of local memory")
+	}
+
+	// a dead client can't fault.
+	cfg.crashClient(1)
+	if _, err := cfg.clients[1].Region(uintptr(3*PageSize), PageSize).Int64At(0); err != ErrClientKilled {
+		t.Fatalf("a dead client read with error %v", err)
+	}
+
+	cfg.end()
+}
+
+func TestCheckpoint(t *testing.T) {
+	cfg := make_config(t, 3, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: checkpoint and restore")
+
+	a, ok := cfg.clients[0].Malloc("table", 100, true)
+	if !ok {
+		t.Fatalf("could not allocate")
+	}
+	page := uintptr(PageSize)
+	cfg.write(0, a, 1)      // owned for writing
+	cfg.write(1, a+page, 2) // and shared
+	cfg.read(2, a+page)
+
+	path := filepath.Join(t.TempDir(), "dsm.checkpoint")
+	reply := &Reply{}
+	cfg.central.Checkpoint(&CheckpointArgs{Path: path}, reply)
+	if reply.Err != OK {
+		t.Fatalf("checkpoint failed: %v", reply.Err)
+	}
+
+	// the owner can still write, but the checkpoint has the old value.
+	cfg.write(0, a, 3)
+	cfg.checkAll(a, 3)
+
+	cfg.restart(path)
+	cfg.checkAll(a, 1)
+	cfg.checkAll(a+page, 2)
+	cfg.checkAll(a+2*page, 0)
+	cfg.write(2, a, 4)
+	cfg.checkAll(a, 4)
+	if b, ok := cfg.clients[1].Malloc("table", 100, true); !ok || b != a {
+		t.Fatalf("table at %v after restore; was at %v", b, a)
+	}
+
+	cfg.end()
+}
+
+func TestClientFailure(t *testing.T) {
+	cfg := make_config(t, 4, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: client failure")
+
+	page := uintptr(PageSize)
+	cfg.write(0, 0, 1)
+	cfg.write(1, page, 2)
+	cfg.read(2, page) // a read-only copy at client 2
+	path := filepath.Join(t.TempDir(), "dsm.checkpoint")
+	reply := &Reply{}
+	cfg.central.Checkpoint(&CheckpointArgs{Path: path}, reply)
+	if reply.Err != OK {
+		t.Fatalf("checkpoint failed: %v", reply.Err)
+	}
+	cfg.write(0, 0, 3) // lost with client 0
+	cfg.clients[1].LockAcquire(7)
+
+	cfg.crashClient(0)
+	cfg.crashClient(1)
+
+	// client 1's page survives at client 2, and client 0's in the
+	// checkpoint.
+	if v := cfg.read(3, page); v != 2 {
+		t.Fatalf("client 3 read %v; expected 2", v)
+	}
+	if v := cfg.read(3, 0); v != 1 {
+		t.Fatalf("client 3 read %v; expected 1 from the checkpoint", v)
+	}
+	cfg.write(2, page, 4)
+	if v := cfg.read(3, page); v != 4 {
+		t.Fatalf("client 3 read %v; expected 4", v)
+	}
+
+	// the dead clients let go of their lock, and don't hold up
+	// barriers.
+	cfg.clients[2].LockAcquire(7)
+	cfg.clients[2].LockRelease(7)
+	var wg sync.WaitGroup
+	for _, i := range []int{2, 3} {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cfg.clients[i].Barrier(0)
+		}(i)
+	}
+	wg.Wait()
+
+	cfg.end()
+}
+
+func TestClientFailureMidWrite(t *testing.T) {
+	cfg := make_config(t, 2, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: owner dies during another client's write fault")
+
+	cfg.write(0, 0, 1)
+
+	// client 1's write takes the page from client 0, which dies
+	// before client 1 confirms.
+	args := &ReadWriteArgs{ClientID: 1, Seq: 1 << 40, Addr: 0, Access: 2}
+	reply := &ReadWriteReply{}
+	cfg.central.HandleReadWrite(args, reply)
+	if reply.Err != OK {
+		t.Fatalf("write fault failed: %v", reply.Err)
+	}
+	if len(reply.Pages) != 1 || reply.Pages[0].Data[0] != 1 {
+		t.Fatalf("write fault did not get client 0's page")
+	}
+	cfg.crashClient(0)
+	for !cfg.central.isDead(0) {
+		time.Sleep(heartbeatInterval)
+	}
+
+	confirm := &Reply{}
+	cfg.central.HandleConfirmation(&ConfirmationArgs{ClientID: 1, Addr: 0, Access: 2, Owners: map[uintptr]string{0: reply.Pages[0].Owner}}, confirm)
+	if confirm.Err != OK {
+		t.Fatalf("confirmation failed: %v", confirm.Err)
+	}
+	if o, _ := cfg.central.getOwner(0); o != (Owner{OwnerAddr: cfg.addrs[1], AccessType: 2}) {
+		t.Fatalf("owner is %v; expected client 1", o)
+	}
+
+	cfg.end()
+}
+
+func TestLeases(t *testing.T) {
+	cfg := make_config(t, 2, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: leases on read-only copies")
+
+	cfg.write(0, 0, 1)
+	if v := cfg.read(1, 0); v != 1 {
+		t.Fatalf("client 1 read %v; expected 1", v)
+	}
+
+	// the writer waits out the lease of a reader it can't reach,
+	// without waiting for the reader to be declared dead.
+	cfg.net.DeleteServer(clientName(1))
+	t0 := time.Now()
+	cfg.write(0, 0, 2)
+	if d := time.Since(t0); d > failureTimeout {
+		t.Fatalf("write took %v", d)
+	}
+	if cfg.central.isDead(1) {
+		t.Fatalf("client 1 declared dead")
+	}
+	if a := cfg.mems[1].Access(0); a != 0 {
+		t.Fatalf("client 1 still has access %v after its lease ran out", a)
+	}
+
+	cfg.end()
+}
+
+// a service for testing the TCP transport.
+type EchoServer struct{}
+
+func (e *EchoServer) Echo(args *Args, reply *Reply) error {
+	reply.Err = OK
+	return nil
+}
+
+func (e *EchoServer) Sleep(args *Args, reply *Reply) error {
+	time.Sleep(time.Second)
+	reply.Err = OK
+	return nil
+}
+
+func TestNetTransport(t *testing.T) {
+	fmt.Printf("Test: TCP connections ...\n")
+
+	addr := "127.0.0.1:47000"
+	transport := MakeNetTransportTimeouts(addr, time.Second, 200*time.Millisecond)
+	transport.Serve(&EchoServer{})
+	tr := transport.(*netTransport)
+
+	call := func(rpcname string) bool {
+		reply := &Reply{}
+		return transport.Call(addr, rpcname, &Args{}, reply) && reply.Err == OK
+	}
+	ok := call("EchoServer.Echo")
+	for i := 0; !ok && i < 50; i++ {
+		// the listener may not be up yet
+		time.Sleep(10 * time.Millisecond)
+		ok = call("EchoServer.Echo")
+	}
+	if !ok {
+		t.Fatalf("could not call the echo server")
+	}
+	conn := tr.conns[addr]
+	if !call("EchoServer.Echo") || tr.conns[addr] != conn {
+		t.Fatalf("did not reuse the connection")
+	}
+
+	// a call that times out leaves the connection to the others.
+	if call("EchoServer.Sleep") {
+		t.Fatalf("slow call did not time out")
+	}
+	if !call("EchoServer.Echo") || tr.conns[addr] != conn {
+		t.Fatalf("did not keep the connection of a call that timed out")
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestNetCluster(t *testing.T) {
+	fmt.Printf("Test: a cluster on one host over TCP ...\n")
+
+	central := "127.0.0.1:47001"
+	addrs := map[int]string{0: "127.0.0.1:47002", 1: "127.0.0.1:47003"}
+	c := MakeCentral(addrs, 2, MakeNetTransport(central))
+	defer c.Kill()
+	clients := make([]*Client, len(addrs))
+	mems := make([]*localMemory, len(addrs))
+	for i := range clients {
+		mems[i] = makeLocalMemory()
+		clients[i] = MakeClient([]string{central}, i, SequentialConsistency, MakeNetTransport(addrs[i]), mems[i])
+		defer clients[i].Kill()
+	}
+	for i := range clients {
+		for !clients[i].isReady() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	clients[0].Region(0, PageSize).SetInt64At(8, 42)
+	if v, _ := clients[1].Region(0, PageSize).Int64At(8); v != 42 {
+		t.Fatalf("client 1 read %v; expected 42", v)
+	}
+	clients[1].Region(0, PageSize).SetInt64At(8, 43)
+	if v, _ := clients[0].Region(0, PageSize).Int64At(8); v != 43 {
+		t.Fatalf("client 0 read %v; expected 43", v)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestClusterConfig(t *testing.T) {
+	fmt.Printf("Test: cluster configuration ...\n")
+
+	good := `{
+		"central": "10.0.0.1:7000",
+		"clients": [{"id": 1, "address": "10.0.0.3"}, {"id": 0, "address": "10.0.0.2:7000"}],
+		"num_pages": 16,
+		"protocol": "release"
+	}`
+	cfg, err := ParseClusterConfig([]byte(good))
+	if err != nil {
+		t.Fatalf("good configuration: %v", err)
+	}
+	if p, _ := cfg.protocol(); p != ReleaseConsistency || cfg.Workload != "matmul" {
+		t.Fatalf("protocol %v, workload %v", p, cfg.Workload)
+	}
+	if peers := cfg.peers(); peers[0] != "10.0.0.2:7000" || peers[1] != "10.0.0.3" {
+		t.Fatalf("peers %v", peers)
+	}
+	for s, want := range map[string]int{"65536": 65536, "64K": 64 << 10, "2MiB": 2 << 20} {
+		if n, err := ParseBlockSize(s); err != nil || n != want {
+			t.Fatalf("block size %v parsed as %v, %v", s, n, err)
+		}
+	}
+
+	bad := []string{
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}]}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "protocol": "eventual"}`,
+		`{"central": "a", "clients": [{"id": 1, "address": "b"}], "num_pages": 1}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}, {"id": 0, "address": "c"}], "num_pages": 1}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "a:1234"}], "num_pages": 1}`,
+		`{"clients": [{"id": 0, "address": "b"}], "num_pages": 1}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "manager": "dynamic"}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "workload": "nothing"}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "page_size": 3}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "call_timeout": "soon"}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "block_size": "100"}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "segment_block_sizes": {"s": "big"}}`,
+		`{"central": "a", "clients": [{"id": 0, "address": "b"}], "num_pages": 1, "rwlock_policy": "strict"}`,
+	}
+	for _, b := range bad {
+		if _, err := ParseClusterConfig([]byte(b)); err == nil {
+			t.Fatalf("accepted %v", b)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestJoinLeave(t *testing.T) {
+	cfg := make_config(t, 2, 4, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: clients join and leave")
+
+	base, _, ok := cfg.clients[0].SegmentOpen("data", 10)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	cfg.write(0, base, 5)
+
+	i, reply := cfg.join()
+	if reply.ClientID != 2 || reply.NumClients != 3 {
+		t.Fatalf("joined as client %v of %v", reply.ClientID, reply.NumClients)
+	}
+	if len(reply.Segments) != 1 || reply.Segments[0] != (SegmentInfo{Name: "data", Base: base, Size: 10}) {
+		t.Fatalf("joined with segments %v", reply.Segments)
+	}
+	if v := cfg.read(i, base); v != 5 {
+		t.Fatalf("new client read %v; expected 5", v)
+	}
+	page := uintptr(PageSize)
+	cfg.write(i, 2*page, 7) // only the new client has it
+	cfg.write(i, base, 6)
+
+	// a client that leaves hands back its pages.
+	cfg.clients[i].Leave()
+	if v := cfg.read(1, 2*page); v != 7 {
+		t.Fatalf("client 1 read %v; expected 7", v)
+	}
+	if v := cfg.read(0, base); v != 6 {
+		t.Fatalf("client 0 read %v; expected 6", v)
+	}
+
+	// barriers wait only for the clients that are left.
+	var wg sync.WaitGroup
+	for j := 0; j < 2; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			cfg.clients[j].Barrier(0)
+		}(j)
+	}
+	wg.Wait()
+
+	// ids aren't reused.
+	if _, reply := cfg.join(); reply.ClientID != 3 {
+		t.Fatalf("joined as client %v; expected 3", reply.ClientID)
+	}
+
+	cfg.end()
+}
+
+func TestPrefetch(t *testing.T) {
+	cfg := make_config(t, 2, 16, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: prefetching strided and advised reads")
+
+	page := uintptr(PageSize)
+	for pg := uintptr(0); pg < 16; pg++ {
+		cfg.write(0, pg*page, byte(pg+1))
+	}
+
+	// reads two pages apart prefetch the next few pages at that
+	// stride, and no others.
+	for pg := uintptr(0); pg <= 4; pg += 2 {
+		cfg.read(1, pg*page)
+	}
+	t0 := time.Now()
+	for cfg.mems[1].Access(6*page) == 0 {
+		if time.Since(t0) > time.Second {
+			t.Fatalf("page 6 was not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a := cfg.mems[1].Access(5 * page); a != 0 {
+		t.Fatalf("page 5 has access %v; expected 0", a)
+	}
+	for pg := uintptr(6); pg <= 12; pg += 2 {
+		if v := cfg.read(1, pg*page); v != byte(pg+1) {
+			t.Fatalf("client 1 read %v from page %v; expected %v", v, pg, pg+1)
+		}
+	}
+
+	// a prefetched copy is invalidated like any other.
+	cfg.write(0, 8*page, 20)
+	if v := cfg.read(1, 8*page); v != 20 {
+		t.Fatalf("client 1 read %v; expected 20", v)
+	}
+
+	// advice to prefetch now.
+	cfg.clients[1].Advise(13*page, 3*PageSize, AdviceWillNeed)
+	for pg := uintptr(13); pg < 16; pg++ {
+		if a := cfg.mems[1].Access(pg * page); a != 1 {
+			t.Fatalf("page %v has access %v after AdviceWillNeed", pg, a)
+		}
+	}
+
+	// advice not to.
+	cfg.clients[1].Advise(0, 16*PageSize, AdviceRandom)
+	for pg := uintptr(1); pg <= 5; pg += 2 {
+		cfg.read(1, pg*page)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if a := cfg.mems[1].Access(7 * page); a != 0 {
+		t.Fatalf("page 7 was prefetched after AdviceRandom")
+	}
+
+	cfg.end()
+}
+
+func TestBlocks(t *testing.T) {
+	BlockSize = 4 * PageSize
+	SegmentBlockSizes = map[string]int{"big": 8 * PageSize}
+	defer func() {
+		BlockSize = 0
+		SegmentBlockSizes = map[string]int{}
+	}()
+	cfg := make_config(t, 2, 32, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: blocks of several pages")
+
+	page := uintptr(PageSize)
+	access := func(i int, from uintptr, to uintptr, want int) {
+		for pg := from; pg < to; pg++ {
+			if a := cfg.mems[i].Access(pg * page); a != want {
+				t.Fatalf("client %v has access %v to page %v; expected %v", i, a, pg, want)
+			}
+		}
+	}
+
+	// a fault brings in the faulting page's whole block.
+	cfg.write(0, 2*page, 1)
+	access(0, 0, 4, 2)
+	access(0, 4, 5, 0)
+	if v := cfg.read(1, 1*page); v != 0 {
+		t.Fatalf("client 1 read %v; expected 0", v)
+	}
+	access(0, 0, 4, 1)
+	access(1, 0, 4, 1)
+	cfg.checkAll(2*page, 1)
+
+	// a segment's blocks are its own size, and start at its base.
+	big, _, ok := cfg.clients[0].SegmentOpen("big", 10*PageSize)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	small, _, ok := cfg.clients[0].SegmentOpenBlocks("small", 2*PageSize, PageSize)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	cfg.write(0, big+9*page, 2)
+	access(0, big/page+8, big/page+10, 2)
+	cfg.write(0, big, 3)
+	access(0, big/page, big/page+8, 2)
+	cfg.write(0, small, 4)
+	access(0, small/page, small/page+1, 2)
+	access(0, small/page+1, small/page+2, 0)
+	cfg.checkAll(big+9*page, 2)
+	cfg.checkAll(big, 3)
+	cfg.checkAll(small, 4)
+
+	// blocks never overlap, even where they are cut short after a
+	// segment that isn't a whole number of blocks.
+	if _, _, ok := cfg.clients[0].SegmentOpenBlocks("tiny", PageSize, PageSize); !ok {
+		t.Fatalf("could not open a segment")
+	}
+	first := make(map[uintptr]uintptr) // the first page of each page's block
+	for pg := uintptr(0); pg < 32; pg++ {
+		block := cfg.central.blockOf(pg * page)
+		for _, p := range block {
+			if f, ok := first[p]; ok && f != block[0] {
+				t.Fatalf("page %v is in the blocks at pages %v and %v", p/page, f/page, block[0]/page)
+			}
+			first[p] = block[0]
+		}
+	}
+
+	// writers of different pages of a block take turns with it.
+	concurrentWriters(t, cfg, 3)
+
+	cfg.end()
+}
+
+func TestWriteUpdate(t *testing.T) {
+	cfg := make_config(t, 3, 8, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: write-update segments")
+
+	base, _, ok := cfg.clients[0].SegmentOpenWith("feed", PageSize, SegmentOptions{Update: true})
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	// what client i's copy holds at addr, without faulting.
+	peek := func(i int, addr uintptr) byte {
+		buf := make([]byte, 1)
+		if !cfg.mems[i].Load(addr, buf) {
+			t.Fatalf("client %v has no copy of %v", i, addr)
+		}
+		return buf[0]
+	}
+
+	cfg.write(0, base, 1)
+	cfg.checkAll(base, 1)
+
+	// readers keep their copies through a write, and see it once
+	// the writer flushes.
+	cfg.write(0, base, 2)
+	if v := peek(1, base); v != 1 {
+		t.Fatalf("client 1 saw %v before the flush", v)
+	}
+	cfg.clients[0].Flush()
+	for i := 1; i < 3; i++ {
+		if v := peek(i, base); v != 2 {
+			t.Fatalf("client %v saw %v after the flush; expected 2", i, v)
+		}
+	}
+
+	// a new writer leaves the old one a copy.
+	cfg.write(1, base+1, 3)
+	cfg.clients[1].Release()
+	if v := peek(0, base+1); v != 3 {
+		t.Fatalf("client 0 saw %v; expected 3", v)
+	}
+
+	// writes that weren't flushed go out when the page moves on.
+	cfg.write(2, base+2, 4)
+	cfg.write(0, base+3, 5)
+	if v := peek(1, base+2); v != 4 {
+		t.Fatalf("client 1 saw %v; expected 4", v)
+	}
+	cfg.clients[0].Flush()
+	cfg.checkAll(base+2, 4)
+	cfg.checkAll(base+3, 5)
+
+	// other segments are still write-invalidate.
+	other, _, ok := cfg.clients[0].SegmentOpen("other", PageSize)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	cfg.write(0, other, 6)
+	cfg.checkAll(other, 6)
+	cfg.write(1, other, 7)
+	if a := cfg.mems[0].Access(other); a != 0 {
+		t.Fatalf("client 0 has access %v after a write-invalidate", a)
+	}
+
+	cfg.end()
+}
+
+func TestEntryConsistency(t *testing.T) {
+	cfg := make_config(t, 3, 8, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: entry consistency")
+
+	base, _, ok := cfg.clients[0].SegmentOpen("entry", 2*PageSize)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	cfg.write(0, base, 1)
+	cfg.checkAll(base, 1)
+	if !cfg.clients[1].Bind(5, base, 2*PageSize) {
+		t.Fatalf("could not bind the segment")
+	}
+	for i := 0; i < 3; i++ {
+		if a := cfg.mems[i].Access(base); a != 0 {
+			t.Fatalf("client %v has access %v to a page it just bound", i, a)
+		}
+	}
+
+	// the lock brings in the pages, writable, with no faults.
+	cfg.clients[0].LockAcquire(5)
+	buf := make([]byte, 1)
+	if !cfg.mems[0].Load(base, buf) || buf[0] != 1 {
+		t.Fatalf("client 0 has no copy of the bound page, or it is stale")
+	}
+	if !cfg.mems[0].Store(base+uintptr(PageSize), []byte{2}) {
+		t.Fatalf("client 0 can't write a bound page while holding its lock")
+	}
+	cfg.clients[0].LockRelease(5)
+	if a := cfg.mems[0].Access(base); a != 0 {
+		t.Fatalf("client 0 has access %v after releasing", a)
+	}
+
+	cfg.clients[1].LockAcquire(5)
+	if !cfg.mems[1].Load(base+uintptr(PageSize), buf) || buf[0] != 2 {
+		t.Fatalf("client 1 didn't get client 0's write with the lock")
+	}
+	cfg.mems[1].Store(base, []byte{3})
+	cfg.clients[1].LockRelease(5)
+
+	// a read without the lock sees the last release.
+	if v := cfg.read(2, base); v != 3 {
+		t.Fatalf("client 2 read %v; expected 3", v)
+	}
+	if v := cfg.read(2, base+uintptr(PageSize)); v != 2 {
+		t.Fatalf("client 2 read %v; expected 2", v)
+	}
+
+	// a client that held the lock before gets the writes since.
+	cfg.clients[0].LockAcquire(5)
+	if !cfg.mems[0].Load(base, buf) || buf[0] != 3 {
+		t.Fatalf("client 0 didn't get client 1's write with the lock")
+	}
+	cfg.mems[0].Store(base, []byte{4})
+	cfg.clients[0].LockRelease(5)
+
+	// the release took away client 2's stale copy.
+	if v := cfg.read(2, base); v != 4 {
+		t.Fatalf("client 2 read %v after the release; expected 4", v)
+	}
+	if v := cfg.read(2, base+uintptr(PageSize)); v != 2 {
+		t.Fatalf("client 2 read %v; expected 2", v)
+	}
+
+	// a retried bind is applied once.
+	other, _, ok := cfg.clients[0].SegmentOpen("entry2", PageSize)
+	if !ok {
+		t.Fatalf("could not open a segment")
+	}
+	args := &BindArgs{ClientID: 0, Seq: 1 << 40, LockID: 6, Addr: other, Size: uintptr(PageSize)}
+	for k := 0; k < 2; k++ {
+		reply := &Reply{}
+		cfg.central.Bind(args, reply)
+		if reply.Err != OK {
+			t.Fatalf("bind failed: %v", reply.Err)
+		}
+	}
+	cfg.central.mu.Lock()
+	if v := cfg.central.versions[other]; v != 1 {
+		t.Fatalf("page bound twice has version %v; expected 1", v)
+	}
+	cfg.central.mu.Unlock()
+
+	cfg.end()
+}
+
+type counterWorkload struct {
+	cfg *config
+}
+
+func (w *counterWorkload) Setup(c *Client, numpages int, index int, numservers int) {
+}
+
+func (w *counterWorkload) Run(c *Client, index int, numservers int) {
+	c.LockAcquire(0)
+	w.cfg.write(index, 0, w.cfg.read(index, 0)+byte(index+1))
+	c.LockRelease(0)
+	c.Barrier(0)
+}
+
+func (w *counterWorkload) Verify(c *Client, index int, numservers int) bool {
+	return w.cfg.read(index, 0) == byte(numservers*(numservers+1)/2)
+}
+
+func TestWorkload(t *testing.T) {
+	cfg := make_config(t, 3, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: run a workload on every client")
+
+	for _, name := range []string{"matmul", "test_one_client", "test_concurrent_clients"} {
+		if _, ok := lookupWorkload(name); !ok {
+			t.Fatalf("no %v workload", name)
+		}
+	}
+
+	w := &counterWorkload{cfg: cfg}
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !runWorkload(w, cfg.clients[i], cfg.npages, i, cfg.n) {
+				t.Errorf("workload did not verify on client %v", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cfg.end()
+}
@@ -0,0 +1,250 @@
+package dsm
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/6.5840-dsm/labrpc"
+)
+
+// A Transport carries the DSM's RPCs between the central server and
+// the clients. Peers are named by the same address strings that the
+// central keeps in its clients map and hands out as page owners.
+type Transport interface {
+	// Call sends an RPC to the peer at addr and waits for the reply.
+	// It returns false if no reply was received.
+	Call(addr string, rpcname string, args interface{}, reply interface{}) bool
+	// Serve starts handling incoming RPCs for rcvr's methods.
+	Serve(rcvr interface{})
+}
+
+// The timeouts for connecting to a peer and for a reply to an RPC,
+// for transports made by MakeNetTransport. A call that times out
+// returns false, and the caller retries it like any other failed
+// call; the connection, which other calls may be using, stays open.
+var (
+	DialTimeout = 2 * time.Second
+	CallTimeout = 10 * time.Second
+)
+
+// RPCs that wait at the central for other clients, for as long as
+// they take, and so have no call timeout: a checkpoint waits for
+// every page from its owner, and the rest for a lock, semaphore,
+// condition variable or barrier. Retrying one would only leave
+// another running at the central. A peer that is gone still fails
+// them, once TCP keepalives find the connection dead.
+var blockingRPCs = map[string]bool{
+	"Central.Checkpoint":    true,
+	"Central.LockAcquire":   true,
+	"Central.RWLockAcquire": true,
+	"Central.Barrier":       true,
+	"Central.SemWait":       true,
+	"Central.CondSleep":     true,
+}
+
+// the port of an address that doesn't name one.
+const defaultPort = "1234"
+
+// WithPort returns addr, with the default port if it has none.
+func WithPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, defaultPort)
+}
+
+// ListenAddr returns the address to listen on for the peer address
+// addr: its port, on every interface.
+func ListenAddr(addr string) string {
+	_, port, _ := net.SplitHostPort(WithPort(addr))
+	return ":" + port
+}
+
+// netTransport speaks net/rpc over TCP, serving on its listen address
+// with a server of its own, so that several nodes can share a
+// process. Peers are host:port addresses, or hosts on the default
+// port. It keeps one connection to each peer, and redials when a
+// connection fails.
+type netTransport struct {
+	once        sync.Once
+	listenAddr  string
+	server      *rpc.Server
+	mu          sync.Mutex
+	conns       map[string]*rpc.Client
+	dialTimeout time.Duration
+	callTimeout time.Duration
+}
+
+// MakeNetTransport makes a transport that listens on listen, a
+// host:port or :port address.
+func MakeNetTransport(listen string) Transport {
+	return MakeNetTransportTimeouts(listen, DialTimeout, CallTimeout)
+}
+
+func MakeNetTransportTimeouts(listen string, dialTimeout time.Duration, callTimeout time.Duration) Transport {
+	t := &netTransport{listenAddr: listen, dialTimeout: dialTimeout, callTimeout: callTimeout}
+	t.server = rpc.NewServer()
+	t.conns = make(map[string]*rpc.Client)
+	return t
+}
+
+// the connection to addr, dialing it if there is none.
+func (t *netTransport) conn(addr string) (*rpc.Client, error) {
+	t.mu.Lock()
+	client, ok := t.conns[addr]
+	t.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	log.Println("dialing", addr)
+	c, err := net.DialTimeout("tcp", WithPort(addr), t.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(c)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if other, ok := t.conns[addr]; ok {
+		// another call dialed too
+		client.Close()
+		return other, nil
+	}
+	t.conns[addr] = client
+	return client, nil
+}
+
+// drop the connection to addr, if it is still client.
+func (t *netTransport) drop(addr string, client *rpc.Client) {
+	t.mu.Lock()
+	if t.conns[addr] == client {
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+	client.Close()
+}
+
+func (t *netTransport) Call(addr string, rpcname string, args interface{}, reply interface{}) bool {
+	if addr == "" {
+		log.Println("invalid address")
+		return false
+	}
+	client, err := t.conn(addr)
+	if err != nil {
+		log.Println(fmt.Sprintf("could not connect to %v:", addr), err)
+		return false
+	}
+	// decode into a reply of our own, since a reply that comes
+	// after we time out would race with the caller's next use.
+	fresh := reflect.New(reflect.TypeOf(reply).Elem())
+	call := client.Go(rpcname, args, fresh.Interface(), make(chan *rpc.Call, 1))
+	var timeout <-chan time.Time
+	if !blockingRPCs[rpcname] {
+		timer := time.NewTimer(t.callTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-call.Done:
+	case <-timeout:
+		// the peer may just be slow to answer this call, so keep the
+		// connection for the others
+		log.Println(rpcname, "to", addr, "timed out")
+		return false
+	}
+	if call.Error != nil {
+		if _, ok := call.Error.(rpc.ServerError); !ok {
+			// the connection is broken
+			t.drop(addr, client)
+		}
+		return false
+	}
+	reflect.ValueOf(reply).Elem().Set(fresh.Elem())
+	return true
+}
+
+func (t *netTransport) Serve(rcvr interface{}) {
+	t.server.Register(rcvr)
+	t.once.Do(func() { go t.listen() })
+}
+
+func (t *netTransport) listen() {
+	l, err := net.Listen("tcp", t.listenAddr)
+	if err != nil {
+		log.Fatal("listen error:", err)
+	}
+	defer l.Close()
+	log.Println("listening on", t.listenAddr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal("accept error:", err)
+		}
+		go t.server.ServeConn(conn)
+	}
+}
+
+// labrpcTransport runs a node on a simulated labrpc network, so
+// that a whole cluster can live in one process. me is the node's
+// server name on the network; ends to other nodes are created on
+// first use, with names unique to this transport so that a node
+// restarted under the same name gets its own.
+type labrpcTransport struct {
+	mu   sync.Mutex
+	net  *labrpc.Network
+	me   string
+	id   int64
+	svcs []*labrpc.Service
+	ends map[string]*labrpc.ClientEnd
+}
+
+var nextTransportID int64
+
+func MakeLabrpcTransport(net *labrpc.Network, me string) Transport {
+	t := &labrpcTransport{net: net, me: me}
+	t.id = atomic.AddInt64(&nextTransportID, 1)
+	t.ends = make(map[string]*labrpc.ClientEnd)
+	return t
+}
+
+func (t *labrpcTransport) endName(addr string) string {
+	return fmt.Sprintf("%v#%v->%v", t.me, t.id, addr)
+}
+
+func (t *labrpcTransport) end(addr string) *labrpc.ClientEnd {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.ends[addr]
+	if !ok {
+		name := t.endName(addr)
+		e = t.net.MakeEnd(name)
+		t.net.Connect(name, addr)
+		t.net.Enable(name, true)
+		t.ends[addr] = e
+	}
+	return e
+}
+
+func (t *labrpcTransport) Call(addr string, rpcname string, args interface{}, reply interface{}) bool {
+	return t.end(addr).Call(rpcname, args, reply)
+}
+
+// Serve puts up a new server with all the services so far, since
+// labrpc won't tolerate a call to a service that a server is still
+// waiting to have added.
+func (t *labrpcTransport) Serve(rcvr interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.svcs = append(t.svcs, labrpc.MakeService(rcvr))
+	srv := labrpc.MakeServer()
+	for _, svc := range t.svcs {
+		srv.AddService(svc)
+	}
+	t.net.AddServer(t.me, srv)
+}
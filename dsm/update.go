@@ -0,0 +1,211 @@
+package dsm
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Write-update segments, under sequential consistency with the
+// central manager. A write to a page of a write-update segment leaves
+// the other clients' copies in place: the writer takes the page, and
+// the old owner keeps a read-only copy. The writer twins the page, and
+// at each release or Flush the central takes a diff of the page from
+// it and patches every copy with it. The central also takes the diff
+// whenever the page leaves the writer, so that no write is lost to the
+// readers. So readers see a writer's writes once it releases, as under
+// release consistency, without faulting the page in again.
+//
+// A segment is write-update if the client that creates it asks, or if
+// UpdateSegments names it.
+
+// names of segments that are write-update, whatever the program asks.
+var UpdateSegments = map[string]bool{}
+
+// whether the page at addr is in a write-update segment. c.mu must be
+// held.
+func (c *Central) updatePage(addr uintptr) bool {
+	for _, s := range c.segments {
+		if s.Offset <= addr && addr < s.Offset+s.Size {
+			return s.Update
+		}
+	}
+	return false
+}
+
+func (c *Central) isUpdatePage(addr uintptr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updatePage(addr)
+}
+
+// the id of the client at addr, or -1.
+func (c *Central) clientID(addr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, a := range c.clients {
+		if a == addr {
+			return id
+		}
+	}
+	return -1
+}
+
+// a write to a page of a write-update segment: the old owner keeps a
+// read-only copy, and so does every other reader.
+func (c *Central) handleUpdateWrite(args *ReadWriteArgs, reply *PageGrant) Err {
+	pageOwner, found := c.getOwner(args.Addr)
+	me := c.clientAddr(args.ClientID)
+	reply.Update = true
+	reply.Owner = pageOwner.OwnerAddr
+	if !found {
+		reply.Data = c.homePage(args.Addr)
+		return c.commit(Op{Type: opRemoveCopyset, ClientID: args.ClientID, Addr: args.Addr})
+	}
+	if pageOwner.OwnerAddr == me {
+		return OK
+	}
+	invArgs := InvalidateArgs{Addr: args.Addr, NewAccess: 1, ReturnPage: true}
+	invReply := InvalidateReply{}
+	if !c.changeAccess(pageOwner.OwnerAddr, &invArgs, &invReply, time.Time{}) {
+		return ErrOwnerDead
+	}
+	old := c.clientID(pageOwner.OwnerAddr)
+	c.pushUpdate(args.Addr, invReply.Diff, old)
+	if err := c.commit(Op{Type: opSetOwner, Addr: args.Addr, Owner: Owner{OwnerAddr: pageOwner.OwnerAddr, AccessType: 1}}); err != OK {
+		return err
+	}
+	if err := c.commit(Op{Type: opAddCopyset, ClientID: old, Addr: args.Addr}); err != OK {
+		return err
+	}
+	if err := c.commit(Op{Type: opRemoveCopyset, ClientID: args.ClientID, Addr: args.Addr}); err != OK {
+		return err
+	}
+	reply.Data = invReply.Data
+	return OK
+}
+
+// patch every copy of addr but from's with diff. A reader that can't
+// be reached is dropped from the copyset once its lease runs out, as
+// it would be for an invalidation.
+func (c *Central) pushUpdate(addr uintptr, diff []DiffRun, from int) {
+	if len(diff) == 0 {
+		return
+	}
+	c.mu.Lock()
+	var readers []int
+	for id := range c.copyset[addr] {
+		if id != from {
+			readers = append(readers, id)
+		}
+	}
+	c.mu.Unlock()
+	log.Println("pushing", len(diff), "runs of", addr, "to", readers)
+	var wg sync.WaitGroup
+	for _, id := range readers {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			args := &UpdateArgs{Addr: addr, Diff: diff}
+			if c.callClient(c.clientAddr(id), "Client.ApplyUpdate", args, &Reply{}, c.leaseExpiry(addr, id)) {
+				return
+			}
+			c.dropLease(addr, id)
+			c.commit(Op{Type: opRemoveCopyset, ClientID: id, Addr: addr})
+		}(id)
+	}
+	wg.Wait()
+}
+
+// FlushUpdate takes the client's writes to addr since its last flush,
+// and patches every other copy of the page with them.
+func (c *Central) FlushUpdate(args *UpdateArgs, reply *Reply) error {
+	if !c.isLeader() {
+		reply.Err = ErrWrongLeader
+		return nil
+	}
+	l, ok := c.locks[args.Addr]
+	if !ok {
+		reply.Err = OK
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	me := c.clientAddr(args.ClientID)
+	if owner, _ := c.getOwner(args.Addr); owner.OwnerAddr != me {
+		// the page moved on, and took the writes with it
+		reply.Err = OK
+		return nil
+	}
+	taken := &UpdateArgs{}
+	if !c.callClient(me, "Client.TakeUpdate", &UpdateArgs{Addr: args.Addr}, taken, time.Time{}) {
+		reply.Err = ErrClientDead
+		return nil
+	}
+	c.pushUpdate(args.Addr, taken.Diff, args.ClientID)
+	reply.Err = OK
+	return nil
+}
+
+// twin a page of a write-update segment that this client may now
+// write.
+func (c *Client) twinUpdate(addr uintptr) {
+	c.update.Lock()
+	defer c.update.Unlock()
+	if _, ok := c.updateTwins[addr]; !ok {
+		c.updateTwins[addr] = c.mem.GetPage(addr)
+	}
+}
+
+// the writes to addr since it was twinned, and forget the twin. c.update
+// must be held.
+func (c *Client) takeUpdate(addr uintptr) []DiffRun {
+	twin, ok := c.updateTwins[addr]
+	if !ok {
+		return nil
+	}
+	delete(c.updateTwins, addr)
+	return makeDiff(twin, c.mem.GetPage(addr))
+}
+
+// TakeUpdate hands the central this client's writes to a page since
+// its last flush, and twins the page again.
+func (c *Client) TakeUpdate(args *UpdateArgs, reply *UpdateArgs) error {
+	c.update.Lock()
+	defer c.update.Unlock()
+	reply.Addr = args.Addr
+	reply.Diff = c.takeUpdate(args.Addr)
+	if c.mem.Access(args.Addr) == 2 {
+		c.updateTwins[args.Addr] = c.mem.GetPage(args.Addr)
+	}
+	return nil
+}
+
+// ApplyUpdate patches this client's copy of a page with another
+// client's writes.
+func (c *Client) ApplyUpdate(args *UpdateArgs, reply *Reply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bumpEpoch(args.Addr)
+	access := c.mem.Access(args.Addr)
+	page := c.mem.GetPage(args.Addr)
+	applyDiff(page, args.Diff)
+	c.mem.SetPage(args.Addr, page)
+	c.mem.ChangeAccess(args.Addr, access)
+	reply.Err = OK
+	return nil
+}
+
+// Flush sends this client's writes to pages of write-update segments
+// to every other client with a copy. Release flushes too.
+func (c *Client) Flush() {
+	c.update.Lock()
+	var addrs []uintptr
+	for addr := range c.updateTwins {
+		addrs = append(addrs, addr)
+	}
+	c.update.Unlock()
+	for _, addr := range addrs {
+		c.callManager(addr, "Central.FlushUpdate", &UpdateArgs{ClientID: c.id, Addr: addr}, &Reply{})
+	}
+}
@@ -10,7 +10,9 @@ type Reply struct {
 
 type ConfirmationArgs struct {
 	ClientID int
-	Addr     uintptr
+	Addr     uintptr // the page that faulted
+	Access   int
+	Owners   map[uintptr]string // the owner each page of its block came from
 }
 
 type RegisterArgs struct {
@@ -21,38 +23,274 @@ type RegisterReply struct {
 	Err Err
 }
 
+type JoinArgs struct {
+	Address string
+}
+
+type JoinReply struct {
+	Err        Err
+	ClientID   int
+	NumClients int // counting the new one
+	Segments   []SegmentInfo
+}
+
+type LeaveArgs struct {
+	ClientID int
+}
+
 type ReadWriteArgs struct {
 	ClientID int
+	Seq      int64 // numbers the client's faults, to spot retries
 	Addr     uintptr
 	Access   int
 }
 
 type ReadWriteReply struct {
-	Err      Err
+	Err   Err
+	Pages []PageGrant // of the faulting page's block
+}
+
+// one page of a fault's block.
+type PageGrant struct {
+	Addr     uintptr
 	HadOwner bool
 	Owner    string
 	Data     []byte
-	// Lease Lease
+	Lease    Lease // on a read-only copy
+	Update   bool  // in a write-update segment
+}
+
+type PrefetchArgs struct {
+	ClientID int
+	Addrs    []uintptr
+}
+
+type PrefetchReply struct {
+	Err   Err
+	Pages []PrefetchedPage
+}
+
+// the reply to a fault under the dynamic manager: either the page,
+// from its owner, or a hint at who the owner is.
+type OwnerReply struct {
+	Err     Err
+	Forward string // the probable owner, if ErrNotOwner
+	Data    []byte
+	Copyset map[int]bool // handed over to a writer
+}
+
+type LockArgs struct {
+	ClientID int
+	Seq      int64 // numbers the client's requests, to spot retries
+	LockID   int
+	Versions map[uintptr]int       // of the acquirer's copies of bound pages
+	Diffs    map[uintptr][]DiffRun // the releaser's writes to bound pages
+
+	// lazy release consistency
+	VC        VectorClock
+	Intervals []Interval // the releaser's, that the central hasn't got
+}
+
+type LockReply struct {
+	Err       Err
+	Bound     []BoundPage // the pages bound to the lock
+	VC        VectorClock // of the release the acquirer acquires
+	Intervals []Interval  // before it, that the acquirer hasn't seen
+}
+
+type BindArgs struct {
+	ClientID int
+	Seq      int64
+	LockID   int
+	Addr     uintptr
+	Size     uintptr
+}
+
+type BoundReadReply struct {
+	Err   Err
+	Data  []byte
+	Lease Lease
+}
+
+type BarrierArgs struct {
+	ClientID  int
+	BarrierID int
+	Gen       int // the times the client has passed this barrier
+	VC        VectorClock
+	Intervals []Interval
+	Validated VectorClock // the client's pages are up to date with these
+}
+
+type AtomicArgs struct {
+	ClientID int
+	Seq      int64
+	Addr     uintptr // of the word
+	Size     int     // 4 or 8
+	Op       AtomicOp
+	Operand  uint64 // to add, or to store
+	Expected uint64 // for a compare-and-swap
+	Home     bool   // do it at the home's copy, under release consistency
+}
+
+type AtomicReply struct {
+	Err Err
+	Old uint64
+}
+
+type RWLockArgs struct {
+	ClientID  int
+	Seq       int64
+	LockID    int
+	Access    int // 1 for shared, 2 for exclusive
+	Addr      uintptr
+	Size      uintptr // of the range to protect
+	VC        VectorClock
+	Intervals []Interval
+}
+
+type RWLockReply struct {
+	Err       Err
+	VC        VectorClock
+	Intervals []Interval
+	Protected []uintptr // the pages the lock protects
+}
+
+type CondArgs struct {
+	ClientID  int
+	Seq       int64
+	CondID    int
+	Broadcast bool
+}
+
+type SemArgs struct {
+	ClientID  int
+	Seq       int64
+	SemID     int
+	Value     int // the initial count, for SemInit
+	VC        VectorClock
+	Intervals []Interval
+}
+
+type SemReply struct {
+	Err       Err
+	VC        VectorClock
+	Intervals []Interval
+}
+
+type BarrierReply struct {
+	Err       Err
+	VC        VectorClock
+	Intervals []Interval
+	Collected VectorClock // whose diffs no client needs any more
+}
+
+type DeadArgs struct {
+	ClientID int
+}
+
+type DeadReply struct {
+	Err  Err
+	Dead bool
+}
+
+type DiffsArgs struct {
+	Addr uintptr
+	Seqs []int // of the intervals whose diffs are wanted
+}
+
+type DiffsReply struct {
+	Err   Err
+	Diffs [][]DiffRun
+}
+
+type MallocArgs struct {
+	ClientID    int
+	Seq         int64 // numbers the client's requests, to spot retries
+	Name        string
+	Size        uintptr
+	PageAligned bool
+}
+
+type MallocReply struct {
+	Err    Err
+	Offset uintptr
+}
+
+type FreeArgs struct {
+	ClientID int
+	Seq      int64 // numbers the client's requests, to spot retries
+	Offset   uintptr
+}
+
+type SegmentArgs struct {
+	ClientID  int
+	Seq       int64 // numbers the client's requests, to spot retries
+	Name      string
+	Size      uintptr
+	Base      uintptr
+	BlockSize uintptr // for a new segment; 0 for the central's
+	Update    bool    // make a new segment write-update
+}
+
+type SegmentReply struct {
+	Err  Err
+	Base uintptr
+	Size uintptr
+}
+
+type CheckpointArgs struct {
+	Path string // on the central's machine
 }
 
 type PageRequestArgs struct {
 	Addr        uintptr
 	RequestType int
-	// Lease       Lease
+	Addrs       []uintptr // instead of Addr, for a block's pages
 }
 
 type PageRequestReply struct {
-	Err  Err
-	Data []byte
+	Err     Err
+	Data    []byte
+	Version int      // of the home's copy, under release consistency
+	Pages   [][]byte // for Addrs
+}
+
+type DiffArgs struct {
+	ClientID int
+	Seq      int64 // numbers the client's diffs, to spot retries
+	Addr     uintptr
+	Diff     []DiffRun
+}
+
+type DiffReply struct {
+	Err     Err
+	Version int // of the home's copy, once the diff is merged
+}
+
+type VersionsArgs struct {
+	Addrs []uintptr
+}
+
+type VersionsReply struct {
+	Err      Err
+	Versions []int
 }
 
 type InvalidateArgs struct {
 	Addr       uintptr
 	NewAccess  int
 	ReturnPage bool
+	Owner      string // the new owner, under the dynamic manager
 }
 
 type InvalidateReply struct {
 	Err  Err
 	Data []byte
+	Diff []DiffRun // unflushed writes to a write-update page
+}
+
+type UpdateArgs struct {
+	ClientID int
+	Addr     uintptr
+	Diff     []DiffRun
 }
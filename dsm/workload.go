@@ -0,0 +1,127 @@
+package dsm
+
+/*
+#include "dsm.h"
+*/
+import "C"
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Workload is a program that runs on every client of the DSM.
+// Setup runs as soon as the client has registered, Run once every
+// client has registered, and Verify after Run, to check the result.
+type Workload interface {
+	Setup(c *Client, numpages int, index int, numservers int)
+	Run(c *Client, index int, numservers int)
+	Verify(c *Client, index int, numservers int) bool
+}
+
+var workloadsMu sync.Mutex
+var workloads = make(map[string]Workload)
+
+// RegisterWorkload makes w available to clients under name.
+func RegisterWorkload(name string, w Workload) {
+	workloadsMu.Lock()
+	defer workloadsMu.Unlock()
+	if _, ok := workloads[name]; ok {
+		log.Fatalf("workload %v registered twice", name)
+	}
+	workloads[name] = w
+}
+
+func lookupWorkload(name string) (Workload, bool) {
+	workloadsMu.Lock()
+	defer workloadsMu.Unlock()
+	w, ok := workloads[name]
+	return w, ok
+}
+
+// Workloads returns the names of the registered workloads.
+func Workloads() []string {
+	workloadsMu.Lock()
+	defer workloadsMu.Unlock()
+	var names []string
+	for name := range workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runWorkload runs w on client c, and reports whether it verified.
+func runWorkload(w Workload, c *Client, numpages int, index int, numservers int) bool {
+	w.Setup(c, numpages, index, numservers)
+	for !c.isReady() {
+		if c.killed() {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Run(c, index, numservers)
+	return w.Verify(c, index, numservers)
+}
+
+// the C programs in this directory.
+
+// multiplies matrices of ones, with each client computing its share
+// of the rows of the product.
+type matmul struct{}
+
+func (matmul) Setup(c *Client, numpages int, index int, numservers int) {
+	C.setup_matmul(C.int(numpages), C.int(index), C.int(numservers))
+}
+
+func (matmul) Run(c *Client, index int, numservers int) {
+	C.multiply_matrices(C.int(index), C.int(numservers))
+}
+
+func (matmul) Verify(c *Client, index int, numservers int) bool {
+	return C.verify_matmul() != 0
+}
+
+// client 0 checks that legal accesses don't fault and illegal ones do.
+type oneClient struct {
+	numpages int
+}
+
+func (w *oneClient) Setup(c *Client, numpages int, index int, numservers int) {
+	w.numpages = numpages
+	C.setup(C.int(numpages), C.int(index), C.int(numservers))
+}
+
+func (w *oneClient) Run(c *Client, index int, numservers int) {
+	C.test_one_client(C.int(w.numpages), C.int(index), C.int(numservers))
+}
+
+func (w *oneClient) Verify(c *Client, index int, numservers int) bool {
+	return true
+}
+
+// every client reads and then writes every page at once.
+type concurrentClients struct {
+	numpages int
+}
+
+func (w *concurrentClients) Setup(c *Client, numpages int, index int, numservers int) {
+	w.numpages = numpages
+	C.setup(C.int(numpages), C.int(index), C.int(numservers))
+}
+
+func (w *concurrentClients) Run(c *Client, index int, numservers int) {
+	C.test_concurrent_clients(C.int(w.numpages), C.int(index), C.int(numservers))
+}
+
+func (w *concurrentClients) Verify(c *Client, index int, numservers int) bool {
+	return true
+}
+
+func init() {
+	RegisterWorkload("matmul", matmul{})
+	RegisterWorkload("test_one_client", &oneClient{})
+	RegisterWorkload("test_concurrent_clients", &concurrentClients{})
+}
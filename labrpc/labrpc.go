@@ -38,7 +38,8 @@ package labrpc
 // handler function on the server side does not return.
 // the server RPC handler function must declare its args and reply arguments
 // as pointers, so that their types exactly match the types of the arguments
-// to Call().
+// to Call(). a handler may also return an error, as with net/rpc,
+// in which case Call() returns false.
 //
 // srv := MakeServer()
 // srv.AddService(svc) -- a server can have multiple services, e.g. Raft and k/v
@@ -59,7 +60,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"6.5840-dsm/labgob"
+	"github.com/6.5840-dsm/labgob"
 )
 
 type reqMsg struct {
@@ -448,6 +449,8 @@ func (rs *Server) GetCount() int {
 	return rs.count
 }
 
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
 // an object with methods that can be called via RPC.
 // a single server may have more than one Service.
 type Service struct {
@@ -476,7 +479,8 @@ func MakeService(rcvr interface{}) *Service {
 			mtype.NumIn() != 3 ||
 			//mtype.In(1).Kind() != reflect.Ptr ||
 			mtype.In(2).Kind() != reflect.Ptr ||
-			mtype.NumOut() != 0 {
+			mtype.NumOut() > 1 ||
+			(mtype.NumOut() == 1 && mtype.Out(0) != typeOfError) {
 			// the method is not suitable for a handler
 			//fmt.Printf("bad method: %v\n", mname)
 		} else {
@@ -506,7 +510,13 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 
 		// call the method.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		out := function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+
+		// net/rpc-style handlers may return an error, which
+		// the caller sees as a failed Call().
+		if len(out) == 1 && !out[0].IsNil() {
+			return replyMsg{false, nil}
+		}
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
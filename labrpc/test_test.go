@@ -304,7 +304,8 @@ func TestConcurrentMany(t *testing.T) {
 				e.Call("JunkServer.Handler2", arg, &reply)
 				wanted := "handler2-" + strconv.Itoa(arg)
 				if reply != wanted {
-					t.Fatalf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					t.Errorf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					return
 				}
 				n += 1
 			}
@@ -362,7 +363,8 @@ func TestUnreliable(t *testing.T) {
 			if ok {
 				wanted := "handler2-" + strconv.Itoa(arg)
 				if reply != wanted {
-					t.Fatalf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					t.Errorf("wrong reply %v from Handler1, expecting %v", reply, wanted)
+					return
 				}
 				n += 1
 			}
@@ -413,7 +415,8 @@ func TestConcurrentOne(t *testing.T) {
 			e.Call("JunkServer.Handler2", arg, &reply)
 			wanted := "handler2-" + strconv.Itoa(arg)
 			if reply != wanted {
-				t.Fatalf("wrong reply %v from Handler2, expecting %v", reply, wanted)
+				t.Errorf("wrong reply %v from Handler2, expecting %v", reply, wanted)
+				return
 			}
 			n += 1
 		}(ii)
@@ -5,11 +5,70 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/6.5840-dsm/dsm"
 )
 
 func main() {
+	for i, args := range os.Args {
+		if args == "-config" {
+			runConfig(os.Args[i+1:])
+			return
+		}
+	}
+	protocol := dsm.SequentialConsistency
+	workload := "matmul"
+	restore := ""
+	listen := dsm.ListenAddr("")
+	for i, args := range os.Args {
+		if args == "-rc" {
+			protocol = dsm.ReleaseConsistency
+		} else if args == "-lrc" {
+			protocol = dsm.LazyReleaseConsistency
+		} else if args == "-w" {
+			workload = os.Args[i+1]
+		} else if args == "-state" {
+			dsm.ReplicaStateDir = os.Args[i+1]
+		} else if args == "-restore" {
+			restore = os.Args[i+1]
+		} else if args == "-l" {
+			listen = os.Args[i+1]
+		} else if args == "-block" {
+			size, err := dsm.ParseBlockSize(os.Args[i+1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			dsm.BlockSize = size
+		} else if args == "-segblocks" {
+			sizes, err := dsm.ParseSegmentBlockSizes(os.Args[i+1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			dsm.SegmentBlockSizes = sizes
+		} else if args == "-rwpolicy" {
+			policy, err := dsm.ParseRWPolicy(os.Args[i+1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			dsm.RWLockPolicy = policy
+		} else if args == "-update" {
+			for _, name := range strings.Split(os.Args[i+1], ",") {
+				dsm.UpdateSegments[name] = true
+			}
+		} else if args == "-dialtimeout" || args == "-calltimeout" {
+			d, err := time.ParseDuration(os.Args[i+1])
+			if err != nil {
+				log.Fatal("could not parse timeout ", err)
+			}
+			if args == "-dialtimeout" {
+				dsm.DialTimeout = d
+			} else {
+				dsm.CallTimeout = d
+			}
+		}
+	}
 	for i, args := range os.Args {
 		if args == "-c" {
 			clients := make(map[int]string)
@@ -17,10 +76,25 @@ func main() {
 			if err != nil {
 				log.Fatal("could not parse num pages", err)
 			}
-			for j := i + 2; j < len(os.Args); j++ {
-				clients[j-3] = os.Args[j]
+			for j := i + 2; j < len(os.Args) && !strings.HasPrefix(os.Args[j], "-"); j++ {
+				clients[j-(i+2)] = os.Args[j]
+			}
+			dsm.CentralSetup(clients, numpages, listen, restore)
+		} else if args == "-r" {
+			clients := make(map[int]string)
+			me, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				log.Fatal("could not parse replica index", err)
+			}
+			numpages, err := strconv.Atoi(os.Args[i+2])
+			if err != nil {
+				log.Fatal("could not parse num pages", err)
 			}
-			dsm.CentralSetup(clients, numpages)
+			peers := strings.Split(os.Args[i+3], ",")
+			for j := i + 4; j < len(os.Args) && !strings.HasPrefix(os.Args[j], "-"); j++ {
+				clients[j-(i+4)] = os.Args[j]
+			}
+			dsm.ReplicaSetup(clients, numpages, peers, me)
 		} else if args == "-p" {
 			index, err := strconv.Atoi(os.Args[i+1])
 			if err != nil {
@@ -35,10 +109,73 @@ func main() {
 				log.Fatal("could not parse num pages", err)
 			}
 			central := os.Args[i+4]
-			dsm.ClientSetup(numpages, index, numservers, central)
+			dsm.ClientSetup(numpages, index, numservers, central, listen, protocol, workload)
+		} else if args == "-f" || args == "-d" {
+			manager := dsm.FixedManager
+			if args == "-d" {
+				manager = dsm.DynamicManager
+			}
+			index, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				log.Fatal("could not parse index", err)
+			}
+			numpages, err := strconv.Atoi(os.Args[i+2])
+			if err != nil {
+				log.Fatal("could not parse num pages", err)
+			}
+			peers := strings.Split(os.Args[i+3], ",")
+			dsm.DistributedClientSetup(numpages, index, peers, manager, protocol, workload)
+		} else if args == "-j" {
+			numpages, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				log.Fatal("could not parse num pages", err)
+			}
+			dsm.JoinSetup(numpages, os.Args[i+2], os.Args[i+3], protocol, workload)
+		} else if args == "-k" {
+			dsm.CheckpointSetup(strings.Split(os.Args[i+2], ","), os.Args[i+1])
 		} else if args == "-h" {
 			fmt.Println("If you want to run a central server, use the -c flag followed by numpages and then the addresses of the clients.")
-			fmt.Println("If you want to run a client, use the -p flag followed by the index of the client, number of servers, numpages, and the address of the central server.")
+			fmt.Println("If you want to run a replicated central server, use the -r flag followed by the index of this replica, numpages, the comma-separated addresses of all replicas, and then the addresses of the clients.")
+			fmt.Println("If you want to run a client, use the -p flag followed by the index of the client, number of servers, numpages, and the address of the central server (or the comma-separated addresses of its replicas).")
+			fmt.Println("If you want to run a client without a central server, use the -f flag (fixed distributed managers) or the -d flag (dynamic distributed manager) followed by the index of the client, numpages, and the comma-separated addresses of all clients.")
+			fmt.Println("Add the -rc flag to a client to run release consistency, where clients that write the same page merge their writes when they release, or the -lrc flag to run lazy release consistency, where a client fetches other clients' writes only when it faults after acquiring a lock or passing a barrier.")
+			fmt.Println("If you want a client to join a running DSM, use the -j flag followed by numpages, the address of the central server (or the comma-separated addresses of its replicas), and the client's own address.")
+			fmt.Println("If you want to checkpoint the shared memory, use the -k flag followed by a path on the central server's machine and the address of the central server (or the comma-separated addresses of its replicas).")
+			fmt.Println("A replica keeps its Raft state in replica-<index>.raft in the current directory, and starts from it when it restarts; add the -state flag followed by a directory to keep it there instead.")
+			fmt.Println("Add the -restore flag followed by a checkpoint's path to a central server to start it from the checkpoint.")
+			fmt.Println("Addresses are host:port, or a host alone for port 1234. Add the -l flag followed by a host:port or :port address to a central server or a client to choose the address it listens on (:1234 by default); replicas and clients run with -f or -d listen on the port of their own address.")
+			fmt.Println("If you want to run from a cluster configuration file, use the -config flag followed by the file, and then central, replica and its index, or client and its index.")
+			fmt.Println("Add the -dialtimeout or -calltimeout flag followed by a duration such as 500ms to any server to change how long it waits to connect to a peer (2s by default) or for a reply (10s by default).")
+			fmt.Println("Add the -block flag followed by a size such as 64K to a central server to make that the unit of coherence, instead of one page, and the -segblocks flag followed by name=size,... to give named segments block sizes of their own.")
+			fmt.Println("Add the -update flag followed by a comma-separated list of segment names to a central server to make those segments write-update, so that writes to them patch the other clients' copies at the writer's next release instead of invalidating them.")
+			fmt.Println("Add the -rwpolicy flag followed by writer, reader or fair to a central server (or to every client run with -f or -d) to choose who gets a reader-writer lock first when readers and writers both wait: a waiting writer holds back new readers (the default), readers go ahead of waiting writers, or requests go in the order they came.")
+			fmt.Println("Add the -w flag followed by a name to a client to choose the workload it runs, one of", dsm.Workloads(), "(matmul by default).")
+		}
+	}
+}
+
+// run this machine's part of the cluster described by a configuration
+// file: args are the file, the role, and for a replica or client, its
+// index.
+func runConfig(args []string) {
+	if len(args) < 2 {
+		log.Fatal("usage: -config file central|replica index|client index")
+	}
+	cfg, err := dsm.LoadClusterConfig(args[0])
+	if err != nil {
+		log.Fatal("bad configuration: ", err)
+	}
+	index := 0
+	if args[1] != "central" {
+		if len(args) < 3 {
+			log.Fatalf("-config needs the index of the %v", args[1])
 		}
+		index, err = strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal("could not parse index ", err)
+		}
+	}
+	if err := cfg.Run(args[1], index); err != nil {
+		log.Fatal(err)
 	}
 }
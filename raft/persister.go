@@ -0,0 +1,135 @@
+package raft
+
+//
+// support for Raft to save persistent
+// Raft state (log &c) and a snapshot of the
+// central's state.
+//
+// a persister from MakePersister keeps the state in
+// memory, so it survives a replica being killed and
+// restarted within one process, as in the tests. one
+// from MakeFilePersister also writes it to a file, so
+// that it survives the replica's process.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"sync"
+)
+
+type Persister struct {
+	mu        sync.Mutex
+	raftstate []byte
+	snapshot  []byte
+	path      string // the file the state is saved to, if any
+}
+
+func MakePersister() *Persister {
+	return &Persister{}
+}
+
+// MakeFilePersister returns a persister that saves to the file at
+// path, starting with the state saved there, if any.
+func MakeFilePersister(path string) (*Persister, error) {
+	ps := &Persister{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the length of the raft state, the raft state, and the snapshot
+	if len(data) < 8 || binary.LittleEndian.Uint64(data) > uint64(len(data)-8) {
+		return nil, errors.New("raft: corrupt state file " + path)
+	}
+	n := 8 + int(binary.LittleEndian.Uint64(data))
+	ps.raftstate = clone(data[8:n])
+	ps.snapshot = clone(data[n:])
+	return ps, nil
+}
+
+func clone(orig []byte) []byte {
+	x := make([]byte, len(orig))
+	copy(x, orig)
+	return x
+}
+
+func (ps *Persister) Copy() *Persister {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	np := MakePersister()
+	np.raftstate = ps.raftstate
+	np.snapshot = ps.snapshot
+	np.path = ps.path
+	return np
+}
+
+func (ps *Persister) ReadRaftState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.raftstate)
+}
+
+func (ps *Persister) RaftStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.raftstate)
+}
+
+// Save both Raft state and snapshot as a single atomic action,
+// to help avoid them getting out of sync.
+func (ps *Persister) Save(raftstate []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.raftstate = clone(raftstate)
+	ps.snapshot = clone(snapshot)
+	if ps.path != "" {
+		if err := ps.write(); err != nil {
+			// Raft mustn't act on state it hasn't saved
+			log.Fatalf("raft: could not save state: %v", err)
+		}
+	}
+}
+
+// write the state to ps.path. write and rename, so a crash never
+// leaves half of it. ps.mu must be held.
+func (ps *Persister) write() error {
+	data := make([]byte, 8, 8+len(ps.raftstate)+len(ps.snapshot))
+	binary.LittleEndian.PutUint64(data, uint64(len(ps.raftstate)))
+	data = append(data, ps.raftstate...)
+	data = append(data, ps.snapshot...)
+	tmp := ps.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// a vote or log entry must be on disk before Raft replies
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ps.path)
+}
+
+func (ps *Persister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.snapshot)
+}
+
+func (ps *Persister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.snapshot)
+}
@@ -0,0 +1,649 @@
+package raft
+
+//
+// the replicated log behind a fault-tolerant DSM central.
+//
+// rf = Make(...)
+//   create a new Raft server.
+// rf.Start(command interface{}) (index, term, isleader)
+//   start agreement on a new log entry
+// rf.GetState() (term, isLeader)
+//   ask a Raft for its current term, and whether it thinks it is leader
+// rf.Snapshot(index, snapshot)
+//   the service has saved everything up to index, so the log can be trimmed
+// ApplyMsg
+//   each time a new entry is committed to the log, each Raft peer
+//   should send an ApplyMsg to the service (or tester)
+//   in the same server.
+//
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/6.5840-dsm/labgob"
+)
+
+// as each Raft peer becomes aware that successive log entries are
+// committed, the peer should send an ApplyMsg to the service (or
+// tester) on the same server, via the applyCh passed to Make(). set
+// CommandValid to true to indicate that the ApplyMsg contains a newly
+// committed log entry.
+//
+// a snapshot received from the leader is delivered the same way, with
+// SnapshotValid set instead.
+type ApplyMsg struct {
+	CommandValid bool
+	Command      interface{}
+	CommandIndex int
+	CommandTerm  int
+
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
+}
+
+// A Peer is an RPC end-point for one of the other Raft servers.
+// *labrpc.ClientEnd is a Peer.
+type Peer interface {
+	Call(svcMeth string, args interface{}, reply interface{}) bool
+}
+
+const (
+	Follower = iota
+	Candidate
+	Leader
+)
+
+const (
+	heartbeatInterval  = 100 * time.Millisecond
+	electionTimeoutMin = 300 * time.Millisecond
+	electionTimeoutMax = 600 * time.Millisecond
+)
+
+const Debug = false
+
+func DPrintf(format string, a ...interface{}) {
+	if Debug {
+		log.Printf(format, a...)
+	}
+}
+
+type LogEntry struct {
+	Term    int
+	Command interface{}
+}
+
+// A Go object implementing a single Raft peer.
+type Raft struct {
+	mu        sync.Mutex // Lock to protect shared access to this peer's state
+	peers     []Peer     // RPC end points of all peers
+	persister *Persister // Object to hold this peer's persisted state
+	me        int        // this peer's index into peers[]
+	dead      int32      // set by Kill()
+	applyCh   chan ApplyMsg
+	applyCond *sync.Cond
+
+	// persistent state on all servers. log[0] is a placeholder
+	// standing for the last entry covered by the snapshot.
+	currentTerm       int
+	votedFor          int
+	log               []LogEntry
+	lastIncludedIndex int
+
+	// volatile state on all servers
+	state            int
+	commitIndex      int
+	lastApplied      int
+	electionDeadline time.Time
+
+	// volatile state on leaders
+	nextIndex  []int
+	matchIndex []int
+
+	// a snapshot received from the leader, waiting to be applied
+	pendingSnapshot bool
+}
+
+// return currentTerm and whether this server
+// believes it is the leader.
+func (rf *Raft) GetState() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.currentTerm, rf.state == Leader
+}
+
+func (rf *Raft) lastIncludedTerm() int {
+	return rf.log[0].Term
+}
+
+func (rf *Raft) lastLogIndex() int {
+	return rf.lastIncludedIndex + len(rf.log) - 1
+}
+
+func (rf *Raft) lastLogTerm() int {
+	return rf.log[len(rf.log)-1].Term
+}
+
+func (rf *Raft) entry(index int) LogEntry {
+	return rf.log[index-rf.lastIncludedIndex]
+}
+
+func (rf *Raft) encodeState() []byte {
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(rf.currentTerm)
+	e.Encode(rf.votedFor)
+	e.Encode(rf.lastIncludedIndex)
+	e.Encode(rf.log)
+	return w.Bytes()
+}
+
+// save Raft's persistent state to stable storage,
+// where it can later be retrieved after a crash and restart.
+func (rf *Raft) persist() {
+	rf.persister.Save(rf.encodeState(), rf.persister.ReadSnapshot())
+}
+
+// restore previously persisted state.
+func (rf *Raft) readPersist(data []byte) {
+	if data == nil || len(data) < 1 { // bootstrap without any state?
+		return
+	}
+	r := bytes.NewBuffer(data)
+	d := labgob.NewDecoder(r)
+	var currentTerm int
+	var votedFor int
+	var lastIncludedIndex int
+	var entries []LogEntry
+	if d.Decode(&currentTerm) != nil ||
+		d.Decode(&votedFor) != nil ||
+		d.Decode(&lastIncludedIndex) != nil ||
+		d.Decode(&entries) != nil {
+		log.Fatal("raft: could not decode persisted state")
+	}
+	rf.currentTerm = currentTerm
+	rf.votedFor = votedFor
+	rf.lastIncludedIndex = lastIncludedIndex
+	rf.log = entries
+	rf.commitIndex = lastIncludedIndex
+	rf.lastApplied = lastIncludedIndex
+}
+
+// the service says it has created a snapshot that has
+// all info up to and including index. this means the
+// service no longer needs the log through (and including)
+// that index. Raft should now trim its log as much as possible.
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if index <= rf.lastIncludedIndex || index > rf.lastApplied {
+		return
+	}
+	rf.trimLog(index, rf.entry(index).Term)
+	rf.persister.Save(rf.encodeState(), snapshot)
+}
+
+// discard the log through index, keeping any entries after it.
+func (rf *Raft) trimLog(index int, term int) {
+	entries := []LogEntry{{Term: term}}
+	if index < rf.lastLogIndex() && index >= rf.lastIncludedIndex && rf.entry(index).Term == term {
+		entries = append(entries, rf.log[index-rf.lastIncludedIndex+1:]...)
+	}
+	rf.log = entries
+	rf.lastIncludedIndex = index
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateId  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderId     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// on a mismatch, where the leader should back up to
+	XTerm  int
+	XIndex int
+	XLen   int
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// step down to follower if a peer has a newer term.
+// rf.mu must be held.
+func (rf *Raft) updateTerm(term int) {
+	if term > rf.currentTerm {
+		rf.currentTerm = term
+		rf.votedFor = -1
+		rf.state = Follower
+		rf.persist()
+	}
+}
+
+func (rf *Raft) resetElectionTimer() {
+	timeout := electionTimeoutMin + time.Duration(rand.Int63n(int64(electionTimeoutMax-electionTimeoutMin)))
+	rf.electionDeadline = time.Now().Add(timeout)
+}
+
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.updateTerm(args.Term)
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	upToDate := args.LastLogTerm > rf.lastLogTerm() ||
+		(args.LastLogTerm == rf.lastLogTerm() && args.LastLogIndex >= rf.lastLogIndex())
+	if (rf.votedFor == -1 || rf.votedFor == args.CandidateId) && upToDate {
+		rf.votedFor = args.CandidateId
+		rf.persist()
+		rf.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+	return nil
+}
+
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.updateTerm(args.Term)
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.state = Follower
+	rf.resetElectionTimer()
+
+	if args.PrevLogIndex < rf.lastIncludedIndex {
+		// already covered by our snapshot; ask for what follows it.
+		reply.XLen = rf.lastIncludedIndex + 1
+		reply.XTerm = -1
+		return nil
+	}
+	if args.PrevLogIndex > rf.lastLogIndex() {
+		reply.XLen = rf.lastLogIndex() + 1
+		reply.XTerm = -1
+		return nil
+	}
+	if term := rf.entry(args.PrevLogIndex).Term; term != args.PrevLogTerm {
+		reply.XTerm = term
+		reply.XIndex = args.PrevLogIndex
+		for reply.XIndex > rf.lastIncludedIndex+1 && rf.entry(reply.XIndex-1).Term == term {
+			reply.XIndex--
+		}
+		reply.XLen = rf.lastLogIndex() + 1
+		return nil
+	}
+
+	for i, e := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index <= rf.lastLogIndex() {
+			if rf.entry(index).Term == e.Term {
+				continue
+			}
+			rf.log = rf.log[:index-rf.lastIncludedIndex]
+		}
+		rf.log = append(rf.log, args.Entries[i:]...)
+		rf.persist()
+		break
+	}
+
+	if args.LeaderCommit > rf.commitIndex {
+		last := args.PrevLogIndex + len(args.Entries)
+		if args.LeaderCommit < last {
+			last = args.LeaderCommit
+		}
+		if last > rf.commitIndex {
+			rf.commitIndex = last
+			rf.applyCond.Signal()
+		}
+	}
+	reply.Success = true
+	return nil
+}
+
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.updateTerm(args.Term)
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.state = Follower
+	rf.resetElectionTimer()
+	if args.LastIncludedIndex <= rf.commitIndex {
+		return nil
+	}
+	rf.trimLog(args.LastIncludedIndex, args.LastIncludedTerm)
+	rf.persister.Save(rf.encodeState(), args.Data)
+	rf.commitIndex = args.LastIncludedIndex
+	rf.pendingSnapshot = true
+	rf.applyCond.Signal()
+	return nil
+}
+
+// the service using Raft wants to start
+// agreement on the next command to be appended to Raft's log. if this
+// server isn't the leader, returns false. otherwise start the
+// agreement and return immediately. there is no guarantee that this
+// command will ever be committed to the Raft log, since the leader
+// may fail or lose an election.
+//
+// the first return value is the index that the command will appear at
+// if it's ever committed. the second return value is the current
+// term. the third return value is true if this server believes it is
+// the leader.
+func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != Leader || rf.killed() {
+		return -1, rf.currentTerm, false
+	}
+	rf.log = append(rf.log, LogEntry{Term: rf.currentTerm, Command: command})
+	rf.persist()
+	rf.matchIndex[rf.me] = rf.lastLogIndex()
+	rf.broadcast()
+	return rf.lastLogIndex(), rf.currentTerm, true
+}
+
+// Kill stops this peer. long-running goroutines check killed()
+// and exit.
+func (rf *Raft) Kill() {
+	atomic.StoreInt32(&rf.dead, 1)
+	rf.mu.Lock()
+	rf.applyCond.Broadcast()
+	rf.mu.Unlock()
+}
+
+func (rf *Raft) killed() bool {
+	z := atomic.LoadInt32(&rf.dead)
+	return z == 1
+}
+
+func (rf *Raft) startElection() {
+	rf.state = Candidate
+	rf.currentTerm++
+	rf.votedFor = rf.me
+	rf.persist()
+	rf.resetElectionTimer()
+	DPrintf("%v: starting election for term %v", rf.me, rf.currentTerm)
+
+	args := RequestVoteArgs{
+		Term:         rf.currentTerm,
+		CandidateId:  rf.me,
+		LastLogIndex: rf.lastLogIndex(),
+		LastLogTerm:  rf.lastLogTerm(),
+	}
+	votes := 1
+	for i := range rf.peers {
+		if i == rf.me {
+			continue
+		}
+		go func(server int) {
+			reply := RequestVoteReply{}
+			if !rf.peers[server].Call("Raft.RequestVote", &args, &reply) {
+				return
+			}
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+			rf.updateTerm(reply.Term)
+			if rf.state != Candidate || rf.currentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(rf.peers)/2 {
+				rf.becomeLeader()
+			}
+		}(i)
+	}
+	if len(rf.peers) == 1 {
+		rf.becomeLeader()
+	}
+}
+
+func (rf *Raft) becomeLeader() {
+	DPrintf("%v: leader for term %v", rf.me, rf.currentTerm)
+	rf.state = Leader
+	rf.nextIndex = make([]int, len(rf.peers))
+	rf.matchIndex = make([]int, len(rf.peers))
+	for i := range rf.peers {
+		rf.nextIndex[i] = rf.lastLogIndex() + 1
+	}
+	rf.matchIndex[rf.me] = rf.lastLogIndex()
+	rf.broadcast()
+}
+
+// send AppendEntries (or a snapshot) to every other peer.
+// rf.mu must be held.
+func (rf *Raft) broadcast() {
+	for i := range rf.peers {
+		if i != rf.me {
+			go rf.replicate(i, rf.currentTerm)
+		}
+	}
+	if len(rf.peers) == 1 {
+		rf.advanceCommit()
+	}
+}
+
+func (rf *Raft) replicate(server int, term int) {
+	rf.mu.Lock()
+	if rf.state != Leader || rf.currentTerm != term {
+		rf.mu.Unlock()
+		return
+	}
+	if rf.nextIndex[server] <= rf.lastIncludedIndex {
+		rf.sendSnapshot(server)
+		return
+	}
+	prev := rf.nextIndex[server] - 1
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.me,
+		PrevLogIndex: prev,
+		PrevLogTerm:  rf.entry(prev).Term,
+		Entries:      append([]LogEntry{}, rf.log[prev+1-rf.lastIncludedIndex:]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	rf.mu.Unlock()
+
+	reply := AppendEntriesReply{}
+	if !rf.peers[server].Call("Raft.AppendEntries", &args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.updateTerm(reply.Term)
+	if rf.state != Leader || rf.currentTerm != args.Term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[server] {
+			rf.matchIndex[server] = match
+		}
+		rf.nextIndex[server] = rf.matchIndex[server] + 1
+		rf.advanceCommit()
+		return
+	}
+	// back up past the conflicting term in one step
+	next := reply.XLen
+	if reply.XTerm != -1 {
+		next = reply.XIndex
+		for i := rf.lastLogIndex(); i > rf.lastIncludedIndex; i-- {
+			if rf.entry(i).Term == reply.XTerm {
+				next = i + 1
+				break
+			}
+		}
+	}
+	if next < 1 {
+		next = 1
+	}
+	rf.nextIndex[server] = next
+	go rf.replicate(server, term)
+}
+
+// rf.mu must be held, and is released.
+func (rf *Raft) sendSnapshot(server int) {
+	args := InstallSnapshotArgs{
+		Term:              rf.currentTerm,
+		LeaderId:          rf.me,
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastIncludedTerm:  rf.lastIncludedTerm(),
+		Data:              rf.persister.ReadSnapshot(),
+	}
+	rf.mu.Unlock()
+
+	reply := InstallSnapshotReply{}
+	if !rf.peers[server].Call("Raft.InstallSnapshot", &args, &reply) {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.updateTerm(reply.Term)
+	if rf.state != Leader || rf.currentTerm != args.Term {
+		return
+	}
+	if args.LastIncludedIndex > rf.matchIndex[server] {
+		rf.matchIndex[server] = args.LastIncludedIndex
+	}
+	rf.nextIndex[server] = rf.matchIndex[server] + 1
+}
+
+// commit the highest index a majority has stored, if it is from the
+// current term. rf.mu must be held.
+func (rf *Raft) advanceCommit() {
+	for n := rf.lastLogIndex(); n > rf.commitIndex && rf.entry(n).Term == rf.currentTerm; n-- {
+		count := 0
+		for i := range rf.peers {
+			if rf.matchIndex[i] >= n {
+				count++
+			}
+		}
+		if count > len(rf.peers)/2 {
+			rf.commitIndex = n
+			rf.applyCond.Signal()
+			return
+		}
+	}
+}
+
+func (rf *Raft) ticker() {
+	var lastHeartbeat time.Time
+	for rf.killed() == false {
+		rf.mu.Lock()
+		if rf.state == Leader {
+			if time.Since(lastHeartbeat) >= heartbeatInterval {
+				lastHeartbeat = time.Now()
+				rf.broadcast()
+			}
+		} else if time.Now().After(rf.electionDeadline) {
+			rf.startElection()
+		}
+		rf.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// deliver committed entries and snapshots to the service, in order.
+func (rf *Raft) applier() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for rf.killed() == false {
+		if rf.pendingSnapshot {
+			rf.pendingSnapshot = false
+			msg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      rf.persister.ReadSnapshot(),
+				SnapshotTerm:  rf.lastIncludedTerm(),
+				SnapshotIndex: rf.lastIncludedIndex,
+			}
+			rf.lastApplied = rf.lastIncludedIndex
+			rf.mu.Unlock()
+			rf.applyCh <- msg
+			rf.mu.Lock()
+		} else if rf.lastApplied < rf.commitIndex {
+			rf.lastApplied++
+			e := rf.entry(rf.lastApplied)
+			msg := ApplyMsg{
+				CommandValid: true,
+				Command:      e.Command,
+				CommandIndex: rf.lastApplied,
+				CommandTerm:  e.Term,
+			}
+			rf.mu.Unlock()
+			rf.applyCh <- msg
+			rf.mu.Lock()
+		} else {
+			rf.applyCond.Wait()
+		}
+	}
+}
+
+// the service or tester wants to create a Raft server. the ports
+// of all the Raft servers (including this one) are in peers[]. this
+// server's port is peers[me]. all the servers' peers[] arrays
+// have the same order. persister is a place for this server to
+// save its persistent state, and also initially holds the most
+// recent saved state, if any. applyCh is a channel on which the
+// service expects Raft to send ApplyMsg messages.
+// Make() must return quickly, so it should start goroutines
+// for any long-running work.
+func Make(peers []Peer, me int, persister *Persister, applyCh chan ApplyMsg) *Raft {
+	rf := &Raft{}
+	rf.peers = peers
+	rf.persister = persister
+	rf.me = me
+	rf.applyCh = applyCh
+	rf.applyCond = sync.NewCond(&rf.mu)
+
+	rf.votedFor = -1
+	rf.log = []LogEntry{{Term: 0}}
+	rf.state = Follower
+	rf.resetElectionTimer()
+
+	// initialize from state persisted before a crash
+	rf.readPersist(persister.ReadRaftState())
+
+	go rf.ticker()
+	go rf.applier()
+
+	return rf
+}